@@ -0,0 +1,74 @@
+package main
+
+import "slices"
+
+// Account numbers are allocated by the server from a sequence and end in a
+// Luhn check digit, so a mistyped digit never lands on another allocated
+// account. Accounts opened before that chose their own numbers and keep
+// them; those numbers are listed as legacy and exempt from the check.
+
+const (
+	// firstAccountSequence and lastAccountSequence bound the sequence part of
+	// an account number. With the check digit appended the numbers are
+	// always nine digits and fit the INTEGER accountnumber column.
+	firstAccountSequence = 10_000_000
+	lastAccountSequence  = 99_999_999
+
+	maxAccountNumberAttempts = 5
+)
+
+// luhnCheckDigit returns the digit that makes base*10+digit pass the Luhn
+// check.
+func luhnCheckDigit(base int) int {
+	sum := 0
+	double := true
+	for n := base; n > 0; n /= 10 {
+		d := n % 10
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return (10 - sum%10) % 10
+}
+
+// withCheckDigit turns a sequence value into an account number.
+func withCheckDigit(seq int) int {
+	return seq*10 + luhnCheckDigit(seq)
+}
+
+func validAccountNumber(n int) bool {
+	return n >= 10 && luhnCheckDigit(n/10) == n%10
+}
+
+// checkAccountNumber validates an account number carried in a request.
+// Numbers in legacy were chosen before the server allocated them and are
+// let through without a check digit.
+func checkAccountNumber(field string, n int, legacy []int) error {
+	if n <= 0 {
+		return fieldError(field, "is required")
+	}
+	if !validAccountNumber(n) && !slices.Contains(legacy, n) {
+		return fieldError(field, "is not a valid account number")
+	}
+	return nil
+}
+
+// loadLegacyAccountNumbers adds the legacy numbers recorded in the store to
+// the ones listed in the config.
+func loadLegacyAccountNumbers(store Storage, config *Config) error {
+	legacy, err := store.GetLegacyAccountNumbers()
+	if err != nil {
+		return err
+	}
+	for _, n := range legacy {
+		if !slices.Contains(config.LegacyAccountNumbers, n) {
+			config.LegacyAccountNumbers = append(config.LegacyAccountNumbers, n)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLuhnCheckDigit(t *testing.T) {
+	assert.Equal(t, 3, luhnCheckDigit(7992739871))
+	assert.True(t, validAccountNumber(79927398713))
+	assert.False(t, validAccountNumber(79927398710))
+	assert.Equal(t, 100000009, withCheckDigit(firstAccountSequence))
+
+	// every single digit typo is caught
+	n := withCheckDigit(12345678)
+	for pow := 1; pow < 1_000_000_000; pow *= 10 {
+		d := n / pow % 10
+		typo := n - d*pow + (d+1)%10*pow
+		assert.False(t, validAccountNumber(typo), "%d", typo)
+	}
+}
+
+func TestCreateAccountAllocatesNumbers(t *testing.T) {
+	server := newTestServer(NewMemoryStore())
+
+	var numbers []int
+	for i := 0; i < 3; i++ {
+		w := doRequest(server, "POST", "/account", "", CreateAccountRequest{FirstName: "John", LastName: "Doe", Password: "s3cret-pass"})
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var acc AccountResponse
+		assert.Nil(t, jsonDecode(w, &acc))
+		assert.True(t, validAccountNumber(acc.AccountNumber))
+		assert.NotContains(t, numbers, acc.AccountNumber)
+		numbers = append(numbers, acc.AccountNumber)
+	}
+}
+
+func TestMalformedAccountNumbersRejected(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	newTestAccount(t, store, 1008)
+	token := login(t, server, 1008, "password").Token
+
+	w := doRequest(server, "POST", "/login", "", LoginRequest{AccountNumber: 1009, Password: "s3cret-pass"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"field":"accountnumber"`)
+
+	w = doRequest(server, "POST", "/transfer", token, TransferRequest{FromAccountNumber: 1008, ToAccountNumber: 1017, Amount: usd(100)})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"field":"toAccountNumber"`)
+
+	w = doRequest(server, "POST", "/deposit", token, DepositRequest{Amount: usd(100)})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestLegacyAccountNumbersStillWork(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	newTestAccount(t, store, 1008)
+	// chosen by the client before numbers were allocated, no check digit
+	newTestAccount(t, store, 1009)
+	server.config.LegacyAccountNumbers = []int{1009}
+	_, err := store.CreateTransaction(0, 1009, "deposit", usd(1000))
+	assert.Nil(t, err)
+
+	token := login(t, server, 1009, "password").Token
+	w := doRequest(server, "POST", "/transfer", token, TransferRequest{FromAccountNumber: 1009, ToAccountNumber: 1008, Amount: usd(100)})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	token = login(t, server, 1008, "password").Token
+	w = doRequest(server, "POST", "/transfer", token, TransferRequest{FromAccountNumber: 1008, ToAccountNumber: 1009, Amount: usd(100)})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func TestLoadLegacyAccountNumbers(t *testing.T) {
+	config := defaultConfig()
+	config.LegacyAccountNumbers = []int{1009}
+	assert.Nil(t, loadLegacyAccountNumbers(NewMemoryStore(), config))
+	assert.Equal(t, []int{1009}, config.LegacyAccountNumbers)
+
+	// only the listed numbers skip the check digit
+	assert.Nil(t, checkAccountNumber("accountnumber", 1009, config.LegacyAccountNumbers))
+	assert.NotNil(t, checkAccountNumber("accountnumber", 1017, config.LegacyAccountNumbers))
+	assert.Nil(t, checkAccountNumber("accountnumber", 1008, nil))
+}
@@ -3,11 +3,13 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	jwt "github.com/golang-jwt/jwt/v5"
@@ -16,27 +18,27 @@ import (
 )
 
 type APIServer struct {
-	listenAddr string
-	store      Storage
+	config *Config
+	store  Storage
 }
 
 type APIFunc func(w http.ResponseWriter, r *http.Request) error
 
-type APIError struct {
-	Error string `json:"error"`
-}
-
-func newApiServer(listenAddr string, store Storage) *APIServer {
+func newApiServer(config *Config, store Storage) *APIServer {
 	return &APIServer{
-		listenAddr: listenAddr,
-		store:      store,
+		config: config,
+		store:  store,
 	}
 }
 
 func makeHttpHandler(fn APIFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := fn(w, r); err != nil {
-			writeJson(w, http.StatusBadRequest, APIError{Error: err.Error()}) // handle error
+			apiErr := toAPIError(err)
+			if apiErr.Status >= http.StatusInternalServerError {
+				log.Printf("Internal error on %s %s: %v", r.Method, r.URL.Path, err)
+			}
+			writeJson(w, apiErr.Status, apiErr)
 		}
 	}
 }
@@ -48,55 +50,117 @@ func writeJson(w http.ResponseWriter, status int, val any) error {
 }
 
 func (s *APIServer) run() {
-	router := mux.NewRouter()
-	router.HandleFunc("/withdraw", JWTauthMiddleWare(makeHttpHandler(s.handleWithdraw), s.store))
-	router.HandleFunc("/deposit", JWTauthMiddleWare(makeHttpHandler(s.handleDoposit), s.store))
-	router.HandleFunc("/transfer", JWTauthMiddleWare(makeHttpHandler(s.handleTransfer), s.store))
-	router.HandleFunc("/login", makeHttpHandler(s.handleLogin))
-	router.HandleFunc("/account", makeHttpHandler(s.handleAccount))
-	router.HandleFunc("/account/{id}", JWTauthMiddleWare(makeHttpHandler(s.handleGetAccountById), s.store))
+	router := s.routes()
 
-	log.Printf("API server listening on %s", s.listenAddr)
-	http.ListenAndServe(s.listenAddr, router)
+	log.Printf("API server listening on %s", s.config.ListenAddr)
+	http.ListenAndServe(s.config.ListenAddr, router)
 
 }
 
-func (s *APIServer) handleAccount(w http.ResponseWriter, r *http.Request) error {
-	if r.Method == "GET" {
-		return s.handleGetAccounts(w)
-	}
-	if r.Method == "POST" {
-		return s.handleCreateAccount(w, r)
-	}
-	if r.Method == "DELETE" {
-		return s.handleDeleteAccount(w, r)
-	}
-	return fmt.Errorf("methid not allowed %s", r.Method)
+func (s *APIServer) routes() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/withdraw", JWTauthMiddleWare(makeHttpHandler(s.idempotent(s.handleWithdraw)), s.store, s.config.JWTSecret))
+	router.HandleFunc("/deposit", JWTauthMiddleWare(makeHttpHandler(s.idempotent(s.handleDoposit)), s.store, s.config.JWTSecret))
+	router.HandleFunc("/transfer", JWTauthMiddleWare(makeHttpHandler(s.idempotent(s.handleTransfer)), s.store, s.config.JWTSecret))
+	router.HandleFunc("/login", makeHttpHandler(s.handleLogin))
+	router.HandleFunc("/token/refresh", makeHttpHandler(s.handleRefreshToken)).Methods("POST")
+	router.HandleFunc("/logout", JWTauthMiddleWare(makeHttpHandler(s.handleLogout), s.store, s.config.JWTSecret)).Methods("POST")
+	router.HandleFunc("/account", makeHttpHandler(s.handleCreateAccount)).Methods("POST")
+	router.HandleFunc("/account", JWTauthMiddleWare(RequirePermission(makeHttpHandler(s.handleGetAccounts), PermListAccounts), s.store, s.config.JWTSecret)).Methods("GET")
+	router.HandleFunc("/account/{id}", JWTauthMiddleWare(makeHttpHandler(s.handleGetAccountById), s.store, s.config.JWTSecret)).Methods("GET")
+	router.HandleFunc("/account/{id}", JWTauthMiddleWare(makeHttpHandler(s.handleUpdateAccount), s.store, s.config.JWTSecret)).Methods("PATCH")
+	router.HandleFunc("/account/{id}/password", JWTauthMiddleWare(makeHttpHandler(s.handleChangePassword), s.store, s.config.JWTSecret)).Methods("POST")
+	router.HandleFunc("/account/{id}", JWTauthMiddleWare(makeHttpHandler(s.handleCloseAccount), s.store, s.config.JWTSecret)).Methods("DELETE")
+	router.HandleFunc("/account/{id}/2fa/enroll", JWTauthMiddleWare(makeHttpHandler(s.handleEnrollTOTP), s.store, s.config.JWTSecret)).Methods("POST")
+	router.HandleFunc("/account/{id}/2fa/confirm", JWTauthMiddleWare(makeHttpHandler(s.handleConfirmTOTP), s.store, s.config.JWTSecret)).Methods("POST")
+	router.HandleFunc("/account/{id}/2fa", JWTauthMiddleWare(makeHttpHandler(s.handleDisableTOTP), s.store, s.config.JWTSecret)).Methods("DELETE")
+	router.HandleFunc("/account/{id}/limits", JWTauthMiddleWare(makeHttpHandler(s.handleGetLimits), s.store, s.config.JWTSecret)).Methods("GET")
+	router.HandleFunc("/account/{id}/limits", JWTauthMiddleWare(RequirePermission(makeHttpHandler(s.handleSetLimits), PermManageLimits), s.store, s.config.JWTSecret)).Methods("PUT")
+	router.HandleFunc("/account/{id}/limits", JWTauthMiddleWare(RequirePermission(makeHttpHandler(s.handleResetLimits), PermManageLimits), s.store, s.config.JWTSecret)).Methods("DELETE")
+	router.HandleFunc("/account/{id}/overdraft", JWTauthMiddleWare(makeHttpHandler(s.handleSetOverdraft), s.store, s.config.JWTSecret)).Methods("PUT")
+	router.HandleFunc("/account/{id}/transactions", JWTauthMiddleWare(makeHttpHandler(s.handleGetTransactions), s.store, s.config.JWTSecret)).Methods("GET")
+	router.HandleFunc("/account/{id}/status", JWTauthMiddleWare(RequirePermission(makeHttpHandler(s.handleSetAccountStatus), PermManageStatus), s.store, s.config.JWTSecret)).Methods("PUT")
+	router.HandleFunc("/account/{id}/freeze", JWTauthMiddleWare(RequirePermission(makeHttpHandler(s.handleFreezeAccount), PermManageStatus), s.store, s.config.JWTSecret)).Methods("POST")
+	router.HandleFunc("/account/{id}/unfreeze", JWTauthMiddleWare(RequirePermission(makeHttpHandler(s.handleUnfreezeAccount), PermManageStatus), s.store, s.config.JWTSecret)).Methods("POST")
+	router.HandleFunc("/account/{id}/unlock", JWTauthMiddleWare(RequirePermission(makeHttpHandler(s.handleUnlockLogin), PermUnlockLogin), s.store, s.config.JWTSecret)).Methods("POST")
+	router.HandleFunc("/account/{id}/standing-orders", JWTauthMiddleWare(makeHttpHandler(s.handleCreateStandingOrder), s.store, s.config.JWTSecret)).Methods("POST")
+	router.HandleFunc("/account/{id}/standing-orders", JWTauthMiddleWare(makeHttpHandler(s.handleGetStandingOrders), s.store, s.config.JWTSecret)).Methods("GET")
+	router.HandleFunc("/account/{id}/standing-orders/{orderId}", JWTauthMiddleWare(makeHttpHandler(s.handleGetStandingOrder), s.store, s.config.JWTSecret)).Methods("GET")
+	router.HandleFunc("/account/{id}/standing-orders/{orderId}", JWTauthMiddleWare(makeHttpHandler(s.handleCancelStandingOrder), s.store, s.config.JWTSecret)).Methods("DELETE")
+	router.HandleFunc("/account/{id}/interest", JWTauthMiddleWare(makeHttpHandler(s.handleGetInterest), s.store, s.config.JWTSecret)).Methods("GET")
+	router.HandleFunc("/fx/rates", JWTauthMiddleWare(makeHttpHandler(s.handleGetFXRates), s.store, s.config.JWTSecret)).Methods("GET")
+	router.HandleFunc("/fx/rates", JWTauthMiddleWare(RequirePermission(makeHttpHandler(s.handleSetFXRates), PermManageFX), s.store, s.config.JWTSecret)).Methods("PUT")
+	router.HandleFunc("/fx/quote", JWTauthMiddleWare(makeHttpHandler(s.handleCreateFXQuote), s.store, s.config.JWTSecret)).Methods("POST")
+	router.HandleFunc("/fees/preview", JWTauthMiddleWare(makeHttpHandler(s.handlePreviewFees), s.store, s.config.JWTSecret)).Methods("POST")
+	router.HandleFunc("/account/{id}/role", JWTauthMiddleWare(RequirePermission(makeHttpHandler(s.handleSetAccountRole), PermManageRoles), s.store, s.config.JWTSecret)).Methods("PUT")
+
+	return router
 }
 
 func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != "POST" {
-		return fmt.Errorf("method not allowed %s", r.Method)
+		return methodNotAllowed(r.Method)
 	}
 
 	loginReq := new(LoginRequest)
-	if err := json.NewDecoder(r.Body).Decode(loginReq); err != nil {
+	if err := decodeJSON(r, loginReq); err != nil {
 		return err
 	}
 	defer r.Body.Close()
+	if err := loginReq.validate(s.config.LegacyAccountNumbers); err != nil {
+		return err
+	}
+
+	ip := clientIP(r)
+	if err := s.checkLoginThrottle(w, loginReq.AccountNumber, ip); err != nil {
+		return err
+	}
 
 	account, err := s.store.GetAccountByNumber(loginReq.AccountNumber)
-	fmt.Print(account)
-	if err != nil || bcrypt.CompareHashAndPassword([]byte(account.Password), []byte(loginReq.Password)) != nil {
-		return fmt.Errorf("ss login credentials")
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err != nil || account.Status == StatusClosed || bcrypt.CompareHashAndPassword([]byte(account.Password), []byte(loginReq.Password)) != nil {
+		// unknown accounts are counted too, so probing does not reveal
+		// which account numbers exist
+		if err := s.registerLoginFailure(loginReq.AccountNumber, ip); err != nil {
+			return err
+		}
+		return unauthorized("invalid login credentials")
+	}
+
+	// with 2FA on, the password alone only earns a request for the code
+	enabled, err := s.twoFactorEnabled(account.AccountNumber)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		if loginReq.Code == "" {
+			return newAPIError(http.StatusUnauthorized, CodeMFARequired, "a two-factor code is required")
+		}
+		ok, err := s.verifySecondFactor(account.AccountNumber, loginReq.Code)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if err := s.registerLoginFailure(account.AccountNumber, ip); err != nil {
+				return err
+			}
+			return unauthorized("invalid two-factor code")
+		}
+	}
+
+	if err := s.store.ClearLoginFailures(accountLoginKey(account.AccountNumber)); err != nil {
+		return err
 	}
+	s.recordLoginEvent(account.AccountNumber, ip, LoginSucceeded)
 
-	token, err := generateJWT(account)
+	tokens, err := s.issueTokens(account, "")
 	if err != nil {
-		return fmt.Errorf("error generating token: %v", err)
+		return err
 	}
 
-	return writeJson(w, http.StatusOK, map[string]string{"token": token})
+	return writeJson(w, http.StatusOK, tokens)
 }
 
 func (s *APIServer) handleDoposit(w http.ResponseWriter, r *http.Request) error {
@@ -104,14 +168,14 @@ func (s *APIServer) handleDoposit(w http.ResponseWriter, r *http.Request) error
 	depositReq := &DepositRequest{}
 
 	// Decode the request body into depositReq
-	if err := json.NewDecoder(r.Body).Decode(depositReq); err != nil {
-		return fmt.Errorf("invalid deposit request: %v", err)
+	if err := decodeJSON(r, depositReq); err != nil {
+		return err
 	}
 	defer r.Body.Close()
 
-	// Ensure the amount is a positive float
-	if depositReq.Amount <= 0 {
-		return fmt.Errorf("invalid deposit amount")
+	// Ensure the account number and amount are well formed
+	if err := depositReq.validate(s.config.LegacyAccountNumbers); err != nil {
+		return err
 	}
 
 	// Extract the account from the context
@@ -119,11 +183,15 @@ func (s *APIServer) handleDoposit(w http.ResponseWriter, r *http.Request) error
 
 	// Check if the account number matches
 	if account.AccountNumber != depositReq.AccountNumber {
-		return fmt.Errorf("unauthorized: You can only deposit into your own account")
+		return forbidden("You can only deposit into your own account")
+	}
+	var err error
+	if depositReq.Amount, err = depositReq.Amount.inCurrency(account.Balance.Currency); err != nil {
+		return fieldError("amount", "%v", err)
 	}
 
 	// Log the deposit information
-	fmt.Printf("Depositing into account %d, amount is %.2f\n", depositReq.AccountNumber, depositReq.Amount)
+	fmt.Printf("Depositing into account %d, amount is %s\n", depositReq.AccountNumber, depositReq.Amount)
 
 	// accountToDeposit, err := s.store.GetAccountByNumber(depositReq.AccountNumber)
 	// if err != nil {
@@ -131,26 +199,25 @@ func (s *APIServer) handleDoposit(w http.ResponseWriter, r *http.Request) error
 	// }
 
 	acc, err := s.store.CreateTransaction(0, depositReq.AccountNumber, "deposit", depositReq.Amount)
-
 	if err != nil {
-		return fmt.Errorf("error creating transaction: %v", err)
+		return err
 	}
 
-	return writeJson(w, http.StatusOK, acc)
+	return writeJson(w, http.StatusOK, newAccountResponse(acc))
 }
 
 func (s *APIServer) handleWithdraw(w http.ResponseWriter, r *http.Request) error {
 
 	withdrawReq := &WithdrawRequest{}
-	// Decode the request body into depositReq
-	if err := json.NewDecoder(r.Body).Decode(withdrawReq); err != nil {
-		return fmt.Errorf("invalid deposit request: %v", err)
+	// Decode the request body into withdrawReq
+	if err := decodeJSON(r, withdrawReq); err != nil {
+		return err
 	}
 	defer r.Body.Close()
 
-	// Ensure the amount is a positive float
-	if withdrawReq.Amount <= 0 {
-		return fmt.Errorf("invalid deposit amount")
+	// Ensure the account number and amount are well formed
+	if err := withdrawReq.validate(s.config.LegacyAccountNumbers); err != nil {
+		return err
 	}
 
 	// Extract the account from the context
@@ -158,48 +225,41 @@ func (s *APIServer) handleWithdraw(w http.ResponseWriter, r *http.Request) error
 
 	// Check if the account number matches
 	if account.AccountNumber != withdrawReq.AccountNumber {
-		return fmt.Errorf("unauthorized: You can only withdraw from your own account")
+		return forbidden("You can only withdraw from your own account")
 	}
-	accountToWithdraw, err := s.store.GetAccountByNumber(withdrawReq.AccountNumber)
-	if err != nil {
-		return fmt.Errorf("account not found: %v", err)
-	}
-
-	if withdrawReq.Amount-accountToWithdraw.Balance > 0 {
-		fmt.Println("Insufficient funds")
-		return writeJson(w, http.StatusBadRequest, APIError{Error: "Insufficient funds"})
+	var err error
+	if withdrawReq.Amount, err = withdrawReq.Amount.inCurrency(account.Balance.Currency); err != nil {
+		return fieldError("amount", "%v", err)
 	}
+	fmt.Printf("Withdrawing from account %d, amount is %s\n", withdrawReq.AccountNumber, withdrawReq.Amount)
 
-	fmt.Printf("Withdrawing from account %d, amount is %.2f\n", withdrawReq.AccountNumber, withdrawReq.Amount)
-
+	// the balance check happens inside CreateTransaction under a row lock
 	acc, err := s.store.CreateTransaction(withdrawReq.AccountNumber, 0, "withdraw", withdrawReq.Amount)
-
 	if err != nil {
-		return fmt.Errorf("error doing transaction : %v", err)
+		return err
 	}
 
-	return writeJson(w, http.StatusOK, acc)
+	return writeJson(w, http.StatusOK, newAccountResponse(acc))
 }
 
-func (s *APIServer) handleGetAccounts(w http.ResponseWriter) error {
+func (s *APIServer) handleGetAccounts(w http.ResponseWriter, r *http.Request) error {
 	accounts, err := s.store.GetAccounts()
 	if err != nil {
 		return err
 	}
-	return writeJson(w, http.StatusOK, accounts)
+	return writeJson(w, http.StatusOK, newAccountResponses(accounts))
 }
 
 func (s *APIServer) handleGetAccountById(w http.ResponseWriter, r *http.Request) error {
-	idStr := mux.Vars(r)["id"]
-	id, err := strconv.Atoi(idStr)
+	id, err := accountID(r)
 	if err != nil {
-		return fmt.Errorf("invalid account id %s", idStr)
+		return err
 	}
 
 	// Extract the account from the context
 	account := r.Context().Value("account").(*Account)
-	if account.ID != id {
-		return fmt.Errorf("unauthorized: You are not allowed to access this account")
+	if !canAccess(account, id) {
+		return forbidden("You are not allowed to access this account")
 	}
 
 	accountData, err := s.store.GetAccountById(id)
@@ -207,78 +267,257 @@ func (s *APIServer) handleGetAccountById(w http.ResponseWriter, r *http.Request)
 		return err
 	}
 
-	fmt.Printf("Getting account of id : %d", id)
+	fmt.Printf("Getting account of id : %d\n", id)
 
-	return writeJson(w, http.StatusOK, accountData)
+	return writeJson(w, http.StatusOK, newAccountResponse(accountData))
 }
 
-func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
-	createAccountReq := CreateAccountRequest{}
-	if err := json.NewDecoder(r.Body).Decode(&createAccountReq); err != nil {
+const (
+	defaultTransactionPageSize = 50
+	maxTransactionPageSize     = 200
+)
+
+func (s *APIServer) handleGetTransactions(w http.ResponseWriter, r *http.Request) error {
+	id, err := accountID(r)
+	if err != nil {
 		return err
 	}
-	fmt.Printf("Creating account for %s %s", createAccountReq.FirstName, createAccountReq.LastName)
 
-	account, err := NewAccount(createAccountReq.AccountNumber, createAccountReq.FirstName, createAccountReq.LastName, createAccountReq.Password)
+	account := r.Context().Value("account").(*Account)
+	if !canAccess(account, id) {
+		return forbidden("You are not allowed to access this account")
+	}
+	if account.ID != id {
+		if account, err = s.store.GetAccountById(id); err != nil {
+			return err
+		}
+	}
+
+	filter, err := parseTransactionFilter(r.URL.Query(), account.Balance.Currency)
 	if err != nil {
-		fmt.Print("errire1")
 		return err
 	}
-	if err := s.store.CreateAccount(account); err != nil {
-		fmt.Print("errire2")
+
+	// fetch one extra row to learn whether there is another page
+	limit := filter.Limit
+	filter.Limit++
+	transactions, err := s.store.GetTransactions(account.AccountNumber, filter)
+	if err != nil {
 		return err
 	}
 
-	return writeJson(w, http.StatusOK, account)
+	page := TransactionPage{}
+	if len(transactions) > limit {
+		transactions = transactions[:limit]
+		page.NextCursor = transactions[limit-1].ID
+	}
+	page.Transactions = newTransactionResponses(transactions)
+
+	return writeJson(w, http.StatusOK, page)
 }
 
-func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request) error {
-	idStr := mux.Vars(r)["id"]
-	id, err := strconv.Atoi(idStr)
+// parseTransactionFilter reads the history query parameters: type (repeatable
+// or comma separated), from/to (RFC 3339 or YYYY-MM-DD, a bare "to" date
+// includes that whole day), min_amount/max_amount in the account currency,
+// cursor and limit.
+func parseTransactionFilter(q url.Values, currency string) (TransactionFilter, error) {
+	filter := TransactionFilter{Limit: defaultTransactionPageSize}
+
+	for _, v := range q["type"] {
+		for _, t := range strings.Split(v, ",") {
+			switch t {
+			case "deposit", "withdraw", "transfer", "fee", "interest":
+				filter.Types = append(filter.Types, t)
+			default:
+				return filter, fieldError("type", "invalid transaction type %q", t)
+			}
+		}
+	}
+
+	var err error
+	if v := q.Get("from"); v != "" {
+		if filter.From, _, err = parseTimeParam(v); err != nil {
+			return filter, fieldError("from", "must be a date or RFC 3339 timestamp")
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		to, dateOnly, err := parseTimeParam(v)
+		if err != nil {
+			return filter, fieldError("to", "must be a date or RFC 3339 timestamp")
+		}
+		if dateOnly {
+			to = to.AddDate(0, 0, 1)
+		}
+		filter.To = to
+	}
+
+	if v := q.Get("min_amount"); v != "" {
+		m, err := ParseMoney(v, currency)
+		if err != nil {
+			return filter, fieldError("min_amount", "%v", err)
+		}
+		filter.MinAmount = &m.Amount
+	}
+	if v := q.Get("max_amount"); v != "" {
+		m, err := ParseMoney(v, currency)
+		if err != nil {
+			return filter, fieldError("max_amount", "%v", err)
+		}
+		filter.MaxAmount = &m.Amount
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		if filter.BeforeID, err = strconv.Atoi(v); err != nil || filter.BeforeID <= 0 {
+			return filter, fieldError("cursor", "must be a positive integer")
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit <= 0 {
+			return filter, fieldError("limit", "must be a positive integer")
+		}
+		if filter.Limit > maxTransactionPageSize {
+			filter.Limit = maxTransactionPageSize
+		}
+	}
+
+	return filter, nil
+}
+
+func parseTimeParam(v string) (time.Time, bool, error) {
+	if t, err := time.Parse(time.DateOnly, v); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	return t, false, err
+}
+
+func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
+	createAccountReq := CreateAccountRequest{}
+	if err := decodeJSON(r, &createAccountReq); err != nil {
+		return err
+	}
+	if err := createAccountReq.validate(); err != nil {
+		return err
+	}
+	if err := checkPasswordPolicy("password", createAccountReq.Password); err != nil {
+		return err
+	}
+	fmt.Printf("Creating account for %s %s\n", createAccountReq.FirstName, createAccountReq.LastName)
+
+	account, err := NewAccount(0, createAccountReq.FirstName, createAccountReq.LastName, createAccountReq.Password)
 	if err != nil {
-		return fmt.Errorf("invalid account id %s", idStr)
+		return err
+	}
+	account.Balance = NewMoney(0, createAccountReq.Currency)
+	account.Product = createAccountReq.Product
+	// a generated number can only clash with an account created before
+	// numbers were allocated by the server, so retrying a few times is enough
+	for attempt := 0; ; attempt++ {
+		if account.AccountNumber, err = s.store.NextAccountNumber(); err != nil {
+			return err
+		}
+		account.IBAN = s.config.IBAN.IBAN(account.AccountNumber)
+		err = s.store.CreateAccount(account)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrConflict) || attempt == maxAccountNumberAttempts-1 {
+			return err
+		}
 	}
-	fmt.Printf("Deleting account of id : %d", id)
 
-	err = s.store.DeleteAccount(id)
+	return writeJson(w, http.StatusOK, newAccountResponse(account))
+}
+
+// handleUpdateAccount applies a partial profile update for the owner. The
+// request must carry the version the client last read.
+func (s *APIServer) handleUpdateAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := accountID(r)
 	if err != nil {
-		return fmt.Errorf("error deleting account %d  : %s ", id, err)
+		return err
+	}
+	account := r.Context().Value("account").(*Account)
+	if account.ID != id {
+		return forbidden("You can only update your own account")
 	}
 
-	return writeJson(w, http.StatusOK, map[string]int{"Deleted account": id})
+	req := new(UpdateAccountRequest)
+	if err := decodeJSON(r, req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if err := req.validate(); err != nil {
+		return err
+	}
+
+	if req.FirstName != nil {
+		account.FirstName = *req.FirstName
+	}
+	if req.LastName != nil {
+		account.LastName = *req.LastName
+	}
+	account.Version = req.Version
+	if err := s.store.UpdateAccount(account); err != nil {
+		return err
+	}
+
+	return writeJson(w, http.StatusOK, newAccountResponse(account))
 }
 
 func (s *APIServer) handleTransfer(w http.ResponseWriter, r *http.Request) error {
 	TransferReq := new(TransferRequest)
-	if err := json.NewDecoder(r.Body).Decode(TransferReq); err != nil {
-		return fmt.Errorf("invalid transfer request: %v", err)
+	if err := decodeJSON(r, TransferReq); err != nil {
+		return err
 	}
 
-	if TransferReq.Amount <= 0 {
-		return fmt.Errorf("invalid transfer amount")
+	if err := TransferReq.validate(s.config.LegacyAccountNumbers); err != nil {
+		return err
 	}
 
 	defer r.Body.Close()
 	fromAccount := r.Context().Value("account").(*Account) // already authenticated user
 
 	if fromAccount.AccountNumber != TransferReq.FromAccountNumber {
-		return fmt.Errorf("unauthorized: you can only transfer from your own account")
+		return forbidden("You can only transfer from your own account")
 	}
 
-	if fromAccount.Balance < TransferReq.Amount {
-		return fmt.Errorf("insufficient funds")
+	var toAccount *Account
+	var err error
+	if TransferReq.Amount, err = TransferReq.Amount.inCurrency(fromAccount.Balance.Currency); err != nil {
+		return fieldError("amount", "%v", err)
+	}
+	if TransferReq.ToIBAN != "" {
+		toAccount, err = s.store.GetAccountByIBAN(TransferReq.ToIBAN)
+	} else {
+		toAccount, err = s.store.GetAccountByNumber(TransferReq.ToAccountNumber)
 	}
-
-	toAccount, err := s.store.GetAccountByNumber(TransferReq.ToAccountNumber)
 	if err != nil {
-		return fmt.Errorf("error getting destination account %v", err)
+		return err
 	}
 
-	fmt.Printf("Transferring from account %d to account %d, amount is %.2f\n", TransferReq.FromAccountNumber, TransferReq.ToAccountNumber, TransferReq.Amount)
+	// money only changes currency when the client asks for it, either at
+	// the current rate or at one locked in by a quote
+	var exchange *Exchange
+	if !toAccount.Balance.SameCurrency(TransferReq.Amount) {
+		if exchange, err = s.exchangeFor(TransferReq, toAccount); err != nil {
+			return err
+		}
+	}
 
-	acc, err := s.store.CreateTransaction(TransferReq.FromAccountNumber, TransferReq.ToAccountNumber, "transfer", TransferReq.Amount)
+	if err := s.requireStepUp(w, r, fromAccount.AccountNumber, TransferReq.Amount); err != nil {
+		return err
+	}
+
+	fmt.Printf("Transferring from account %d to account %d, amount is %s\n", TransferReq.FromAccountNumber, toAccount.AccountNumber, TransferReq.Amount)
+
+	var acc *Account
+	if exchange == nil {
+		acc, err = s.store.CreateTransaction(TransferReq.FromAccountNumber, toAccount.AccountNumber, "transfer", TransferReq.Amount)
+	} else {
+		acc, err = s.store.CreateExchange(exchange)
+	}
 	if err != nil {
-		return fmt.Errorf("error doing transaction : %v", err)
+		return err
 	}
 
 	return writeJson(w, http.StatusOK, map[string]interface{}{
@@ -289,27 +528,46 @@ func (s *APIServer) handleTransfer(w http.ResponseWriter, r *http.Request) error
 	})
 }
 
-func generateJWT(account *Account) (string, error) {
+// accessClaims are the claims carried by access tokens. The registered
+// claims (exp, iat, nbf, jti) are enforced by jwt.ParseWithClaims.
+type accessClaims struct {
+	AccountNumber int  `json:"accountnumber"`
+	Role          Role `json:"role"`
+	jwt.RegisteredClaims
+}
 
-	claims := &jwt.MapClaims{
-		"expiresAt":     time.Now().Add(time.Minute * 15).Unix(),
-		"accountnumber": account.AccountNumber,
+func generateJWT(account *Account, secret string, ttl time.Duration) (string, error) {
+	if secret == "" {
+		return "", fmt.Errorf("JWT secret is not configured")
 	}
 
-	mySigning := os.Getenv("JWT_SECRET")
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := &accessClaims{
+		AccountNumber: account.AccountNumber,
+		Role:          account.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
-	return token.SignedString([]byte(mySigning))
+	return token.SignedString([]byte(secret))
 }
 
 func permissionDenied(w http.ResponseWriter) {
-	writeJson(w, http.StatusUnauthorized, APIError{Error: "Permission Denied"})
+	writeJson(w, http.StatusUnauthorized, unauthorized("Permission Denied"))
 }
 
-func JWTauthMiddleWare(handlerFunc http.HandlerFunc, s Storage) http.HandlerFunc {
+func JWTauthMiddleWare(handlerFunc http.HandlerFunc, s Storage, secret string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		fmt.Printf("Middleware Authenticating request")
 		tokenString := r.Header.Get("Authorization")
 		if tokenString == "" {
 			permissionDenied(w)
@@ -320,38 +578,55 @@ func JWTauthMiddleWare(handlerFunc http.HandlerFunc, s Storage) http.HandlerFunc
 			tokenString = tokenString[7:]
 		}
 
-		token, err := validateJWT(tokenString)
-		if err != nil || !token.Valid {
+		claims, err := validateJWT(tokenString, secret)
+		if err != nil {
 			permissionDenied(w)
 			return
 		}
 
-		claims := token.Claims.(jwt.MapClaims)
-		accountNumber := int64(claims["accountnumber"].(float64))
+		revoked, err := s.IsTokenRevoked(claims.ID)
+		if err != nil || revoked {
+			permissionDenied(w)
+			return
+		}
 
-		account, err := s.GetAccountByNumber(int(accountNumber))
-		if err != nil {
+		account, err := s.GetAccountByNumber(claims.AccountNumber)
+		if err != nil || account.Status == StatusClosed {
+			permissionDenied(w)
+			return
+		}
+
+		// iat only has second precision, so compare against the start of
+		// the second the password was changed in
+		if claims.IssuedAt.Time.Before(account.PasswordChangedAt.Truncate(time.Second)) {
 			permissionDenied(w)
 			return
 		}
 
 		ctx := context.WithValue(r.Context(), "account", account) //nolint:errcheck
+		ctx = context.WithValue(ctx, "claims", claims)            //nolint:errcheck
 		r = r.WithContext(ctx)
 
 		handlerFunc(w, r)
 	}
 }
 
-func validateJWT(tokenString string) (*jwt.Token, error) {
-	secret := os.Getenv("JWT_SECRET")
-
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+func validateJWT(tokenString, secret string) (*accessClaims, error) {
+	claims := new(accessClaims)
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 
 		return []byte(secret), nil
-	})
+	}, jwt.WithExpirationRequired(), jwt.WithIssuedAt())
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid || claims.ID == "" {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return claims, nil
 }
 
 // func getID(r *http.Request) (int, error) {
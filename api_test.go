@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer(store Storage) *APIServer {
+	cfg := defaultConfig()
+	cfg.Store = "memory"
+	cfg.JWTSecret = "test-secret"
+	return newApiServer(cfg, store)
+}
+
+// authedRequest builds a request as if JWTauthMiddleWare had already
+// authenticated acc.
+func authedRequest(method, target string, body any, acc *Account) *http.Request {
+	buf := new(bytes.Buffer)
+	json.NewEncoder(buf).Encode(body)
+	r := httptest.NewRequest(method, target, buf)
+	return r.WithContext(context.WithValue(r.Context(), "account", acc))
+}
+
+func TestHandleTransfer(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	from := newTestAccount(t, store, 1008)
+	newTestAccount(t, store, 1016)
+	_, err := store.CreateTransaction(0, 1008, "deposit", usd(10000))
+	assert.Nil(t, err)
+	from, _ = store.GetAccountByNumber(from.AccountNumber)
+
+	w := httptest.NewRecorder()
+	r := authedRequest("POST", "/transfer", TransferRequest{FromAccountNumber: 1008, ToAccountNumber: 1016, Amount: usd(4000)}, from)
+	makeHttpHandler(server.handleTransfer)(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	to, _ := store.GetAccountByNumber(1016)
+	assert.Equal(t, usd(4000), to.Balance)
+}
+
+func TestHandleWithdrawInsufficientFunds(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	acc := newTestAccount(t, store, 1008)
+
+	w := httptest.NewRecorder()
+	r := authedRequest("POST", "/withdraw", WithdrawRequest{AccountNumber: 1008, Amount: usd(1000)}, acc)
+	makeHttpHandler(server.handleWithdraw)(w, r)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"insufficient_funds"`)
+
+	acc, _ = store.GetAccountByNumber(1008)
+	assert.Equal(t, usd(0), acc.Balance)
+}
+
+func TestHandleGetTransactions(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	acc := newTestAccount(t, store, 1008)
+	newTestAccount(t, store, 1016)
+	store.CreateTransaction(0, 1008, "deposit", usd(10000))
+	store.CreateTransaction(1008, 1016, "transfer", usd(2500))
+	store.CreateTransaction(1016, 1008, "transfer", usd(500))
+	store.CreateTransaction(1008, 0, "withdraw", usd(100))
+
+	get := func(query string) TransactionPage {
+		w := httptest.NewRecorder()
+		r := authedRequest("GET", "/account/1/transactions?"+query, nil, acc)
+		r = mux.SetURLVars(r, map[string]string{"id": "1"})
+		makeHttpHandler(server.handleGetTransactions)(w, r)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var page TransactionPage
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&page))
+		return page
+	}
+
+	page := get("limit=3")
+	assert.Len(t, page.Transactions, 3)
+	assert.Equal(t, "withdraw", page.Transactions[0].Type)
+	assert.Equal(t, "in", page.Transactions[1].Direction)
+	assert.Equal(t, "out", page.Transactions[2].Direction)
+	assert.NotZero(t, page.NextCursor)
+
+	page = get("limit=3&cursor=" + strconv.Itoa(page.NextCursor))
+	assert.Len(t, page.Transactions, 1)
+	assert.Equal(t, "deposit", page.Transactions[0].Type)
+	assert.Zero(t, page.NextCursor)
+
+	page = get("type=transfer&min_amount=10")
+	assert.Len(t, page.Transactions, 1)
+	assert.Equal(t, usd(2500), page.Transactions[0].Amount)
+}
+
+// doRequest sends a request through the full router, authenticating with
+// token when it is not empty.
+func doRequest(server *APIServer, method, target, token string, body any) *httptest.ResponseRecorder {
+	buf := new(bytes.Buffer)
+	if body != nil {
+		json.NewEncoder(buf).Encode(body)
+	}
+	r := httptest.NewRequest(method, target, buf)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	server.routes().ServeHTTP(w, r)
+	return w
+}
+
+func login(t *testing.T, server *APIServer, accountNumber int, password string) TokenResponse {
+	t.Helper()
+	w := doRequest(server, "POST", "/login", "", LoginRequest{AccountNumber: accountNumber, Password: password})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var tokens TokenResponse
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&tokens))
+	return tokens
+}
+
+func jsonDecode(w *httptest.ResponseRecorder, v any) error {
+	return json.NewDecoder(w.Body).Decode(v)
+}
+
+func TestHandleUpdateAccount(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	acc := newTestAccount(t, store, 1008)
+	newTestAccount(t, store, 1016)
+	token := login(t, server, 1008, "password").Token
+	accountPath := "/account/" + strconv.Itoa(acc.ID)
+
+	name := "Johnny"
+	w := doRequest(server, "PATCH", accountPath, token, UpdateAccountRequest{FirstName: &name, Version: 1})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var updated AccountResponse
+	assert.Nil(t, jsonDecode(w, &updated))
+	assert.Equal(t, "Johnny", updated.FirstName)
+	assert.Equal(t, "Doe", updated.LastName)
+	assert.Equal(t, 2, updated.Version)
+
+	// a second writer still holding version 1 loses
+	w = doRequest(server, "PATCH", accountPath, token, UpdateAccountRequest{FirstName: &name, Version: 1})
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	blank := " "
+	w = doRequest(server, "PATCH", accountPath, token, UpdateAccountRequest{LastName: &blank, Version: 2})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"field":"lastname"`)
+
+	w = doRequest(server, "PATCH", "/account/2", token, UpdateAccountRequest{FirstName: &name, Version: 1})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestBareAmountsAreInTheAccountCurrency(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	acc := newTestAccount(t, store, 1008)
+	store.accounts[acc.ID].Balance = NewMoney(0, "JPY")
+	token := login(t, server, 1008, "password").Token
+
+	w := doRequest(server, "POST", "/deposit", token, map[string]any{"accountnumber": 1008, "amount": "500"})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = doRequest(server, "POST", "/withdraw", token, map[string]any{"accountnumber": 1008, "amount": 120})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp AccountResponse
+	assert.Nil(t, jsonDecode(w, &resp))
+	assert.Equal(t, NewMoney(380, "JPY"), resp.Balance)
+
+	w = doRequest(server, "POST", "/withdraw", token, map[string]any{"accountnumber": 1008, "amount": "1.5"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var apiErr APIError
+	assert.Nil(t, jsonDecode(w, &apiErr))
+	assert.Equal(t, "amount", apiErr.Details[0].Field)
+}
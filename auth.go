@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// errRefreshTokenReused is returned by ConsumeRefreshToken when a token that
+// was already rotated (or revoked) is presented again. By then the whole
+// token family has been revoked, since the token has most likely leaked.
+var errRefreshTokenReused = errors.New("refresh token reuse detected")
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens signs a new access token and stores a new refresh token for
+// account. An empty family starts a new one (a fresh login).
+func (s *APIServer) issueTokens(account *Account, family string) (*TokenResponse, error) {
+	access, err := generateJWT(account, s.config.JWTSecret, s.config.AccessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	refresh, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	if family == "" {
+		if family, err = randomToken(16); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now().UTC()
+	err = s.store.CreateRefreshToken(&RefreshToken{
+		TokenHash:     hashToken(refresh),
+		FamilyID:      family,
+		AccountNumber: account.AccountNumber,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(s.config.RefreshTokenTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenResponse{
+		Token:        access,
+		ExpiresAt:    now.Add(s.config.AccessTokenTTL),
+		RefreshToken: refresh,
+	}, nil
+}
+
+// handleRefreshToken exchanges a refresh token for a new access token and a
+// new refresh token. The presented refresh token can never be used again.
+func (s *APIServer) handleRefreshToken(w http.ResponseWriter, r *http.Request) error {
+	req := new(RefreshTokenRequest)
+	if err := decodeJSON(r, req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if req.RefreshToken == "" {
+		return fieldError("refreshToken", "is required")
+	}
+
+	old, err := s.store.ConsumeRefreshToken(hashToken(req.RefreshToken))
+	if errors.Is(err, ErrNotFound) || errors.Is(err, errRefreshTokenReused) {
+		return unauthorized("invalid refresh token")
+	}
+	if err != nil {
+		return err
+	}
+	if time.Now().After(old.ExpiresAt) {
+		return unauthorized("refresh token expired")
+	}
+
+	account, err := s.store.GetAccountByNumber(old.AccountNumber)
+	if errors.Is(err, ErrNotFound) {
+		return unauthorized("invalid refresh token")
+	}
+	if err != nil {
+		return err
+	}
+	if account.Status == StatusClosed {
+		return unauthorized("account is closed")
+	}
+
+	tokens, err := s.issueTokens(account, old.FamilyID)
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, tokens)
+}
+
+// handleLogout revokes the access token used to call it and, when the body
+// carries one, the refresh token family of this session.
+func (s *APIServer) handleLogout(w http.ResponseWriter, r *http.Request) error {
+	claims := r.Context().Value("claims").(*accessClaims)
+
+	// the body is optional
+	req := new(RefreshTokenRequest)
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r, req); err != nil {
+			return err
+		}
+	}
+	defer r.Body.Close()
+
+	if err := s.store.RevokeToken(claims.ID, claims.ExpiresAt.Time); err != nil {
+		return err
+	}
+
+	if req.RefreshToken != "" {
+		if err := s.store.RevokeRefreshTokenFamily(hashToken(req.RefreshToken)); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+
+	return writeJson(w, http.StatusOK, map[string]string{"message": fmt.Sprintf("Logged out account %d", claims.AccountNumber)})
+}
+
+const (
+	minPasswordLength = 8
+	// bcrypt ignores everything after the first 72 bytes
+	maxPasswordLength = 72
+)
+
+// checkPasswordPolicy enforces the rules for new passwords: 8 to 72 bytes
+// with at least one letter and one digit.
+func checkPasswordPolicy(field, password string) error {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return fieldError(field, "must be %d to %d characters", minPasswordLength, maxPasswordLength)
+	}
+	if !strings.ContainsFunc(password, unicode.IsLetter) || !strings.ContainsFunc(password, unicode.IsDigit) {
+		return fieldError(field, "must contain at least one letter and one digit")
+	}
+	return nil
+}
+
+// handleChangePassword replaces the owner's password after checking the
+// current one. Every token issued before the change stops working, so the
+// client has to log in again.
+func (s *APIServer) handleChangePassword(w http.ResponseWriter, r *http.Request) error {
+	id, err := accountID(r)
+	if err != nil {
+		return err
+	}
+	account := r.Context().Value("account").(*Account)
+	if account.ID != id {
+		return forbidden("You can only change your own password")
+	}
+
+	req := new(ChangePasswordRequest)
+	if err := decodeJSON(r, req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if err := checkPasswordPolicy("newPassword", req.NewPassword); err != nil {
+		return err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(account.Password), []byte(req.CurrentPassword)) != nil {
+		return forbidden("current password is incorrect")
+	}
+	if req.NewPassword == req.CurrentPassword {
+		return fieldError("newPassword", "must differ from the current password")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	account.Password = string(hash)
+	account.PasswordChangedAt = time.Now().UTC()
+	if err := s.store.UpdateAccount(account); err != nil {
+		return err
+	}
+	fmt.Printf("Password changed for account %d\n", account.AccountNumber)
+
+	// tokens issued in the same second as the change still pass the iat
+	// check in JWTauthMiddleWare, so revoke the one used here explicitly
+	claims := r.Context().Value("claims").(*accessClaims)
+	if err := s.store.RevokeToken(claims.ID, claims.ExpiresAt.Time); err != nil {
+		return err
+	}
+
+	return writeJson(w, http.StatusOK, map[string]string{"message": "Password changed, please log in again"})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefreshTokenRotationAndReuse(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	acc := newTestAccount(t, store, 1008)
+	accountPath := "/account/" + strconv.Itoa(acc.ID)
+
+	first := login(t, server, 1008, "password")
+	assert.NotEmpty(t, first.RefreshToken)
+	assert.Equal(t, http.StatusOK, doRequest(server, "GET", accountPath, first.Token, nil).Code)
+
+	w := doRequest(server, "POST", "/token/refresh", "", RefreshTokenRequest{RefreshToken: first.RefreshToken})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var second TokenResponse
+	assert.Nil(t, jsonDecode(w, &second))
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+
+	// replaying the rotated token is treated as theft and kills the family
+	w = doRequest(server, "POST", "/token/refresh", "", RefreshTokenRequest{RefreshToken: first.RefreshToken})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = doRequest(server, "POST", "/token/refresh", "", RefreshTokenRequest{RefreshToken: second.RefreshToken})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestLogoutRevokesTokens(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	acc := newTestAccount(t, store, 1008)
+	accountPath := "/account/" + strconv.Itoa(acc.ID)
+
+	tokens := login(t, server, 1008, "password")
+	w := doRequest(server, "POST", "/logout", tokens.Token, RefreshTokenRequest{RefreshToken: tokens.RefreshToken})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	assert.Equal(t, http.StatusUnauthorized, doRequest(server, "GET", accountPath, tokens.Token, nil).Code)
+	w = doRequest(server, "POST", "/token/refresh", "", RefreshTokenRequest{RefreshToken: tokens.RefreshToken})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestExpiredAndUnsignedTokensRejected(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	acc := newTestAccount(t, store, 1008)
+	accountPath := "/account/" + strconv.Itoa(acc.ID)
+
+	expired, err := generateJWT(acc, server.config.JWTSecret, -time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, doRequest(server, "GET", accountPath, expired, nil).Code)
+
+	// the old token format had no exp claim and must no longer be accepted
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"expiresAt":     time.Now().Add(time.Hour).Unix(),
+		"accountnumber": 1008,
+	}).SignedString([]byte(server.config.JWTSecret))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, doRequest(server, "GET", accountPath, legacy, nil).Code)
+
+	_, err = generateJWT(acc, "", time.Minute)
+	assert.NotNil(t, err)
+}
+
+func TestChangePasswordInvalidatesTokens(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	acc := newTestAccount(t, store, 1008)
+	accountPath := "/account/" + strconv.Itoa(acc.ID)
+	passwordPath := accountPath + "/password"
+
+	tokens := login(t, server, 1008, "password")
+	other := login(t, server, 1008, "password")
+
+	w := doRequest(server, "POST", passwordPath, tokens.Token, ChangePasswordRequest{CurrentPassword: "wrong", NewPassword: "n3w-password"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = doRequest(server, "POST", passwordPath, tokens.Token, ChangePasswordRequest{CurrentPassword: "password", NewPassword: "short1"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(server, "POST", passwordPath, tokens.Token, ChangePasswordRequest{CurrentPassword: "password", NewPassword: "n3w-password"})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	assert.Equal(t, http.StatusUnauthorized, doRequest(server, "GET", accountPath, tokens.Token, nil).Code)
+	w = doRequest(server, "POST", "/token/refresh", "", RefreshTokenRequest{RefreshToken: other.RefreshToken})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = doRequest(server, "POST", "/login", "", LoginRequest{AccountNumber: 1008, Password: "password"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	fresh := login(t, server, 1008, "n3w-password")
+	assert.Equal(t, http.StatusOK, doRequest(server, "GET", accountPath, fresh.Token, nil).Code)
+
+	acc, _ = store.GetAccountById(acc.ID)
+	assert.Equal(t, 2, acc.Version)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds everything the server needs at startup. Values are layered:
+// built-in defaults, then the optional YAML or TOML config file, then
+// environment variables, then command line flags.
+type Config struct {
+	ListenAddr           string          `yaml:"listen_addr"`
+	Store                string          `yaml:"store"`
+	JWTSecret            string          `yaml:"jwt_secret"`
+	AccessTokenTTL       time.Duration   `yaml:"access_token_ttl"`
+	RefreshTokenTTL      time.Duration   `yaml:"refresh_token_ttl"`
+	IdempotencyKeyTTL    time.Duration   `yaml:"idempotency_key_ttl"`
+	LegacyAccountNumbers []int           `yaml:"legacy_account_numbers"`
+	IBAN                 IBANConfig      `yaml:"iban"`
+	Login                LoginConfig     `yaml:"login"`
+	TwoFactor            TwoFactorConfig `yaml:"two_factor"`
+	Limits               AccountLimits   `yaml:"limits"`
+	Overdraft            OverdraftConfig `yaml:"overdraft"`
+	FX                   FXConfig        `yaml:"fx"`
+	Scheduler            SchedulerConfig `yaml:"scheduler"`
+	Savings              SavingsConfig   `yaml:"savings"`
+	Fees                 FeeSchedule     `yaml:"fees"`
+	Database             DatabaseConfig  `yaml:"database"`
+}
+
+type DatabaseConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Name     string `yaml:"name"`
+	Password string `yaml:"password"`
+	SSLMode  string `yaml:"sslmode"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr:        ":8080",
+		Store:             "postgres",
+		AccessTokenTTL:    15 * time.Minute,
+		RefreshTokenTTL:   30 * 24 * time.Hour,
+		IdempotencyKeyTTL: 24 * time.Hour,
+		// placeholder bank code, set the real one in the config file
+		IBAN: IBANConfig{
+			CountryCode: "DE",
+			BankCode:    "12345678",
+		},
+		Login: LoginConfig{
+			MaxAttempts:   5,
+			IPMaxAttempts: 20,
+			BaseDelay:     time.Second,
+			Lockout:       15 * time.Minute,
+		},
+		TwoFactor: TwoFactorConfig{
+			Issuer:       "goBank",
+			StepUpAmount: NewMoney(100000, DefaultCurrency),
+		},
+		Limits: AccountLimits{
+			SingleMax:  NewMoney(500000, DefaultCurrency),
+			DailyMax:   NewMoney(1000000, DefaultCurrency),
+			MonthlyMax: NewMoney(5000000, DefaultCurrency),
+		},
+		Overdraft: OverdraftConfig{
+			Fee:      NewMoney(2500, DefaultCurrency),
+			MaxLimit: NewMoney(100000, DefaultCurrency),
+		},
+		FX: FXConfig{
+			Spread:   "0.005",
+			QuoteTTL: 30 * time.Second,
+		},
+		Scheduler: SchedulerConfig{
+			Interval:    time.Minute,
+			MaxAttempts: 3,
+			RetryDelay:  time.Hour,
+		},
+		Savings: SavingsConfig{
+			AnnualRate: "0.02",
+			DayCount:   DayCountACT365,
+		},
+		Database: DatabaseConfig{
+			Host:    "localhost",
+			Port:    5432,
+			User:    "postgres",
+			Name:    "gobankpostgres",
+			SSLMode: "disable",
+		},
+	}
+}
+
+// ConnString renders the database settings as a postgres:// URL.
+func (c DatabaseConfig) ConnString() string {
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(c.User, c.Password),
+		Host:     fmt.Sprintf("%s:%d", c.Host, c.Port),
+		Path:     "/" + c.Name,
+		RawQuery: url.Values{"sslmode": {c.SSLMode}}.Encode(),
+	}
+	return u.String()
+}
+
+// loadConfig builds the Config from defaults, file, environment and the given
+// command line arguments, and validates the result. It returns the remaining
+// non-flag arguments (e.g. the migrate subcommand).
+func loadConfig(args []string) (*Config, []string, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("gobank", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("GOBANK_CONFIG"), "path to a YAML or TOML config file")
+	listenAddr := fs.String("listen", "", "address the API server listens on")
+	store := fs.String("store", "", "storage backend to use: postgres or memory")
+	dbHost := fs.String("db-host", "", "database host")
+	dbPort := fs.Int("db-port", 0, "database port")
+	dbUser := fs.String("db-user", "", "database user")
+	dbName := fs.String("db-name", "", "database name")
+	dbSSLMode := fs.String("db-sslmode", "", "database sslmode")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, nil, err
+	}
+
+	// only flags that were given explicitly override the other sources
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.ListenAddr = *listenAddr
+		case "store":
+			cfg.Store = *store
+		case "db-host":
+			cfg.Database.Host = *dbHost
+		case "db-port":
+			cfg.Database.Port = *dbPort
+		case "db-user":
+			cfg.Database.User = *dbUser
+		case "db-name":
+			cfg.Database.Name = *dbName
+		case "db-sslmode":
+			cfg.Database.SSLMode = *dbSSLMode
+		}
+	})
+
+	if err := cfg.validate(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+// loadFile reads a YAML or TOML config file. Both use the same keys; TOML
+// is turned into YAML first so amounts and durations are read the same way
+// in either format.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %v", err)
+	}
+
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+	case ".toml":
+		var m map[string]any
+		if err := toml.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("parsing config file %s: %v", path, err)
+		}
+		if data, err = yaml.Marshal(m); err != nil {
+			return fmt.Errorf("parsing config file %s: %v", path, err)
+		}
+	default:
+		return fmt.Errorf("config file %s: only YAML and TOML config files are supported", path)
+	}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("parsing config file %s: %v", path, err)
+	}
+	return nil
+}
+
+func (c *Config) applyEnv() error {
+	strs := map[string]*string{
+		"GOBANK_LISTEN_ADDR":  &c.ListenAddr,
+		"GOBANK_STORE":        &c.Store,
+		"JWT_SECRET":          &c.JWTSecret,
+		"GOBANK_IBAN_COUNTRY": &c.IBAN.CountryCode,
+		"GOBANK_IBAN_BANK":    &c.IBAN.BankCode,
+		"GOBANK_FX_RATES":     &c.FX.RatesFile,
+		"GOBANK_DB_HOST":      &c.Database.Host,
+		"GOBANK_DB_USER":      &c.Database.User,
+		"GOBANK_DB_NAME":      &c.Database.Name,
+		"GOBANK_DB_PASSWORD":  &c.Database.Password,
+		"GOBANK_DB_SSLMODE":   &c.Database.SSLMode,
+	}
+	for env, field := range strs {
+		if v, ok := os.LookupEnv(env); ok {
+			*field = v
+		}
+	}
+
+	if v, ok := os.LookupEnv("GOBANK_DB_PORT"); ok {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid GOBANK_DB_PORT %q", v)
+		}
+		c.Database.Port = port
+	}
+	return nil
+}
+
+// validateServer checks the settings only the API server needs, so the
+// migrate and role subcommands run without a JWT secret.
+func (c *Config) validateServer() error {
+	if c.JWTSecret == "" {
+		return fmt.Errorf("JWT secret is not set, refusing to sign tokens with an empty key (set JWT_SECRET or jwt_secret in the config file)")
+	}
+	if c.ListenAddr == "" {
+		return fmt.Errorf("listen address is not set")
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.AccessTokenTTL <= 0 || c.RefreshTokenTTL <= 0 {
+		return fmt.Errorf("token lifetimes must be positive")
+	}
+	if c.IdempotencyKeyTTL <= 0 {
+		return fmt.Errorf("idempotency key lifetime must be positive")
+	}
+	for _, n := range c.LegacyAccountNumbers {
+		if n <= 0 {
+			return fmt.Errorf("legacy account number %d must be positive", n)
+		}
+	}
+	if err := c.IBAN.validate(); err != nil {
+		return err
+	}
+	if err := c.Login.validate(); err != nil {
+		return err
+	}
+	if c.TwoFactor.Issuer == "" || strings.Contains(c.TwoFactor.Issuer, ":") {
+		return fmt.Errorf("two-factor issuer must be set and must not contain a colon")
+	}
+	if c.TwoFactor.StepUpAmount.IsNegative() {
+		return fmt.Errorf("two-factor step-up amount must not be negative")
+	}
+	if err := c.Limits.validate(); err != nil {
+		return err
+	}
+	if err := c.Overdraft.validate(); err != nil {
+		return err
+	}
+	if err := c.FX.validate(); err != nil {
+		return err
+	}
+	if err := c.Scheduler.validate(); err != nil {
+		return err
+	}
+	if err := c.Savings.validate(); err != nil {
+		return err
+	}
+	if err := c.Fees.validate(); err != nil {
+		return err
+	}
+
+	switch c.Store {
+	case "memory":
+		return nil
+	case "postgres":
+	default:
+		return fmt.Errorf("unknown store %q, expected postgres or memory", c.Store)
+	}
+
+	if c.Database.Host == "" || c.Database.User == "" || c.Database.Name == "" {
+		return fmt.Errorf("database host, user and name must be set")
+	}
+	if c.Database.Port <= 0 || c.Database.Port > 65535 {
+		return fmt.Errorf("invalid database port %d", c.Database.Port)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Sentinels classifying errors raised below the HTTP layer. Storage and
+// domain code attach them with notFoundf, conflictf, invalidf and
+// forbiddenf, and makeHttpHandler turns them into the matching status code.
+var (
+	ErrNotFound  = errors.New("not found")
+	ErrConflict  = errors.New("conflict")
+	ErrInvalid   = errors.New("invalid")
+	ErrForbidden = errors.New("forbidden")
+)
+
+// domainError carries a sentinel kind without changing the message.
+type domainError struct {
+	kind error
+	msg  string
+}
+
+func (e *domainError) Error() string { return e.msg }
+func (e *domainError) Unwrap() error { return e.kind }
+
+func notFoundf(format string, args ...any) error {
+	return &domainError{kind: ErrNotFound, msg: fmt.Sprintf(format, args...)}
+}
+
+func conflictf(format string, args ...any) error {
+	return &domainError{kind: ErrConflict, msg: fmt.Sprintf(format, args...)}
+}
+
+func invalidf(format string, args ...any) error {
+	return &domainError{kind: ErrInvalid, msg: fmt.Sprintf(format, args...)}
+}
+
+func forbiddenf(format string, args ...any) error {
+	return &domainError{kind: ErrForbidden, msg: fmt.Sprintf(format, args...)}
+}
+
+// ErrorCode is the stable, machine-readable identifier sent to clients in
+// every error response. Clients should switch on it, never on the message.
+type ErrorCode string
+
+const (
+	CodeBadRequest        ErrorCode = "bad_request"
+	CodeValidation        ErrorCode = "validation_failed"
+	CodeUnauthorized      ErrorCode = "unauthorized"
+	CodeForbidden         ErrorCode = "forbidden"
+	CodeNotFound          ErrorCode = "not_found"
+	CodeMethodNotAllowed  ErrorCode = "method_not_allowed"
+	CodeConflict          ErrorCode = "conflict"
+	CodeUnprocessable     ErrorCode = "unprocessable"
+	CodeInsufficientFunds ErrorCode = "insufficient_funds"
+	CodeTooManyRequests   ErrorCode = "too_many_requests"
+	CodeMFARequired       ErrorCode = "mfa_required"
+	CodeLimitExceeded     ErrorCode = "limit_exceeded"
+	CodeCurrencyMismatch  ErrorCode = "currency_mismatch"
+	CodeInternal          ErrorCode = "internal_error"
+)
+
+// FieldError describes a problem with a single request field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// APIError is the body of every error response. Handlers can return one
+// directly to control the status and code.
+type APIError struct {
+	Status  int          `json:"-"`
+	Code    ErrorCode    `json:"code"`
+	Message string       `json:"error"`
+	Details []FieldError `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string { return e.Message }
+
+func newAPIError(status int, code ErrorCode, format string, args ...any) *APIError {
+	return &APIError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func badRequest(format string, args ...any) *APIError {
+	return newAPIError(http.StatusBadRequest, CodeBadRequest, format, args...)
+}
+
+func unauthorized(format string, args ...any) *APIError {
+	return newAPIError(http.StatusUnauthorized, CodeUnauthorized, format, args...)
+}
+
+func forbidden(format string, args ...any) *APIError {
+	return newAPIError(http.StatusForbidden, CodeForbidden, format, args...)
+}
+
+func notFound(format string, args ...any) *APIError {
+	return newAPIError(http.StatusNotFound, CodeNotFound, format, args...)
+}
+
+func methodNotAllowed(method string) *APIError {
+	return newAPIError(http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed %s", method)
+}
+
+func conflict(format string, args ...any) *APIError {
+	return newAPIError(http.StatusConflict, CodeConflict, format, args...)
+}
+
+func unprocessable(format string, args ...any) *APIError {
+	return newAPIError(http.StatusUnprocessableEntity, CodeUnprocessable, format, args...)
+}
+
+func tooManyRequests(format string, args ...any) *APIError {
+	return newAPIError(http.StatusTooManyRequests, CodeTooManyRequests, format, args...)
+}
+
+// validationError reports one or more invalid fields.
+func validationError(details ...FieldError) *APIError {
+	e := newAPIError(http.StatusBadRequest, CodeValidation, "validation failed")
+	e.Details = details
+	return e
+}
+
+func fieldError(field, format string, args ...any) *APIError {
+	return validationError(FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// decodeJSON decodes a request body, turning malformed input into a 400 that
+// names the offending field when the decoder knows it.
+func decodeJSON(r *http.Request, v any) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil {
+		return nil
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return fieldError(typeErr.Field, "must be a %s", typeErr.Type.Kind())
+	}
+	var domErr *domainError
+	if errors.As(err, &domErr) {
+		return badRequest("invalid request body: %s", domErr.msg)
+	}
+	return badRequest("invalid request body")
+}
+
+// toAPIError maps any error returned by a handler to the response sent to
+// the client. Errors that are not recognised are treated as internal and
+// their message is never exposed.
+func toAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	var insufficient *InsufficientFundsError
+	if errors.As(err, &insufficient) {
+		return newAPIError(http.StatusUnprocessableEntity, CodeInsufficientFunds, "insufficient funds")
+	}
+	var mismatch *CurrencyMismatchError
+	if errors.As(err, &mismatch) {
+		return newAPIError(http.StatusUnprocessableEntity, CodeCurrencyMismatch, "%s", mismatch.Error())
+	}
+	var overLimit *LimitExceededError
+	if errors.As(err, &overLimit) {
+		return newAPIError(http.StatusUnprocessableEntity, CodeLimitExceeded, "%s limit of %s exceeded, %s remaining",
+			overLimit.Limit, overLimit.Max, overLimit.Remaining)
+	}
+
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return notFound("%s", err.Error())
+	case errors.Is(err, ErrConflict):
+		return conflict("%s", err.Error())
+	case errors.Is(err, ErrInvalid):
+		return unprocessable("%s", err.Error())
+	case errors.Is(err, ErrForbidden):
+		return forbidden("%s", err.Error())
+	}
+
+	return newAPIError(http.StatusInternalServerError, CodeInternal, "internal server error")
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToAPIError(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		code   ErrorCode
+	}{
+		{notFoundf("Account with number %d not found", 7), http.StatusNotFound, CodeNotFound},
+		{fmt.Errorf("loading: %w", notFoundf("gone")), http.StatusNotFound, CodeNotFound},
+		{conflictf("taken"), http.StatusConflict, CodeConflict},
+		{invalidf("currency mismatch"), http.StatusUnprocessableEntity, CodeUnprocessable},
+		{&InsufficientFundsError{AccountNumber: 1}, http.StatusUnprocessableEntity, CodeInsufficientFunds},
+		{forbidden("nope"), http.StatusForbidden, CodeForbidden},
+		{fieldError("amount", "must be positive"), http.StatusBadRequest, CodeValidation},
+		{errors.New(`pq: relation "accounts" does not exist`), http.StatusInternalServerError, CodeInternal},
+	}
+	for _, c := range cases {
+		apiErr := toAPIError(c.err)
+		assert.Equal(t, c.status, apiErr.Status, c.err.Error())
+		assert.Equal(t, c.code, apiErr.Code, c.err.Error())
+	}
+}
+
+func TestInternalErrorsAreSanitized(t *testing.T) {
+	handler := makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return errors.New(`pq: password authentication failed for user "postgres"`)
+	})
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"code": "internal_error", "error": "internal server error"}`, w.Body.String())
+}
+
+func TestDecodeJSONFieldErrors(t *testing.T) {
+	r := httptest.NewRequest("POST", "/deposit", strings.NewReader(`{"accountnumber": "abc", "amount": 5}`))
+	err := decodeJSON(r, &DepositRequest{})
+	apiErr := toAPIError(err)
+	assert.Equal(t, CodeValidation, apiErr.Code)
+	assert.Equal(t, "accountnumber", apiErr.Details[0].Field)
+
+	r = httptest.NewRequest("POST", "/deposit", strings.NewReader(`{"amount": "1.2345"}`))
+	apiErr = toAPIError(decodeJSON(r, &DepositRequest{}))
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status)
+	assert.Contains(t, apiErr.Message, "decimal places")
+}
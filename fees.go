@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+)
+
+// FeeRule charges a fee on one transaction type, optionally only for one
+// account product. The fee is Flat plus Percent of the amount, plus the
+// flat and percentage parts of the first tier the amount falls in, then
+// held between Min and Max; a zero Max means no cap. Money fields set on a
+// rule must share one currency and the rule only applies to transactions
+// in it; a rule with percentages only applies to every currency.
+type FeeRule struct {
+	Name            string    `yaml:"name"`
+	TransactionType string    `yaml:"transaction_type"`
+	Product         string    `yaml:"product"`
+	Flat            Money     `yaml:"flat"`
+	Percent         string    `yaml:"percent"`
+	Tiers           []FeeTier `yaml:"tiers"`
+	Min             Money     `yaml:"min"`
+	Max             Money     `yaml:"max"`
+}
+
+// FeeTier covers amounts up to and including UpTo. Tiers are listed in
+// ascending order and the last may leave UpTo zero to cover everything
+// above.
+type FeeTier struct {
+	UpTo    Money  `yaml:"up_to"`
+	Flat    Money  `yaml:"flat"`
+	Percent string `yaml:"percent"`
+}
+
+// FeeSchedule is every fee rule in force. All matching rules are charged,
+// each as its own fee transaction.
+type FeeSchedule []FeeRule
+
+// Fee is one charge owed for a transaction, named after the rule behind
+// it.
+type Fee struct {
+	Rule   string
+	Amount Money
+}
+
+// overdraftFeeRule names the fee charged for going into overdraft.
+const overdraftFeeRule = "overdraft"
+
+func (s FeeSchedule) validate() error {
+	names := map[string]bool{overdraftFeeRule: true}
+	for _, r := range s {
+		if r.Name == "" || names[r.Name] {
+			return fmt.Errorf("fee rules need a unique name other than %q", overdraftFeeRule)
+		}
+		names[r.Name] = true
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("fee rule %s: %w", r.Name, err)
+		}
+	}
+	return nil
+}
+
+func (r FeeRule) validate() error {
+	switch r.TransactionType {
+	case "deposit", "withdraw", "transfer":
+	default:
+		return fmt.Errorf("transaction type must be deposit, withdraw or transfer")
+	}
+	if r.Product != "" && !validProduct(r.Product) {
+		return fmt.Errorf("product must be checking or savings")
+	}
+	amounts := []Money{r.Flat, r.Min, r.Max}
+	percents := []string{r.Percent}
+	for i, t := range r.Tiers {
+		if t.UpTo.IsZero() && i != len(r.Tiers)-1 {
+			return fmt.Errorf("only the last tier can be open-ended")
+		}
+		if i > 0 && !t.UpTo.IsZero() && t.UpTo.Amount <= r.Tiers[i-1].UpTo.Amount {
+			return fmt.Errorf("tiers must be in ascending order")
+		}
+		amounts = append(amounts, t.UpTo, t.Flat)
+		percents = append(percents, t.Percent)
+	}
+	currency := r.currency()
+	for _, m := range amounts {
+		if m.IsNegative() {
+			return fmt.Errorf("amounts must not be negative")
+		}
+		if m.Currency != "" && m.Currency != currency {
+			return fmt.Errorf("amounts must all be in the same currency")
+		}
+	}
+	for _, p := range percents {
+		if _, err := parsePercent(p); err != nil {
+			return err
+		}
+	}
+	if !r.Max.IsZero() && r.Max.Amount < r.Min.Amount {
+		return fmt.Errorf("max must not be below min")
+	}
+	return nil
+}
+
+// parsePercent parses a fraction of the amount, "0.01" for one percent.
+// Empty means none.
+func parsePercent(s string) (*big.Rat, error) {
+	if s == "" {
+		return new(big.Rat), nil
+	}
+	p, ok := new(big.Rat).SetString(s)
+	if !ok || p.Sign() < 0 || p.Cmp(big.NewRat(1, 1)) > 0 {
+		return nil, fmt.Errorf("percent %q must be a fraction from 0 to 1", s)
+	}
+	return p, nil
+}
+
+// currency returns the currency of the rule's amounts, or "" when it only
+// has percentages.
+func (r FeeRule) currency() string {
+	amounts := []Money{r.Flat, r.Min, r.Max}
+	for _, t := range r.Tiers {
+		amounts = append(amounts, t.UpTo, t.Flat)
+	}
+	for _, m := range amounts {
+		if m.Currency != "" {
+			return m.Currency
+		}
+	}
+	return ""
+}
+
+func (r FeeRule) matches(transactionType, product string, amount Money) bool {
+	if r.TransactionType != transactionType || (r.Product != "" && r.Product != product) {
+		return false
+	}
+	currency := r.currency()
+	return currency == "" || currency == amount.Currency
+}
+
+// fee works out what the rule charges on amount.
+func (r FeeRule) fee(amount Money) Money {
+	fee := new(big.Rat).SetInt64(r.Flat.Amount)
+	addPercent := func(percent string) {
+		p, _ := parsePercent(percent)
+		fee.Add(fee, p.Mul(p, new(big.Rat).SetInt64(amount.Amount)))
+	}
+	addPercent(r.Percent)
+	for _, t := range r.Tiers {
+		if t.UpTo.IsZero() || amount.Amount <= t.UpTo.Amount {
+			fee.Add(fee, new(big.Rat).SetInt64(t.Flat.Amount))
+			addPercent(t.Percent)
+			break
+		}
+	}
+
+	m := Money{Amount: roundHalfEven(fee), Currency: amount.Currency}
+	if m.Amount < r.Min.Amount {
+		m.Amount = r.Min.Amount
+	}
+	if !r.Max.IsZero() && m.Amount > r.Max.Amount {
+		m.Amount = r.Max.Amount
+	}
+	return m
+}
+
+// feePayer returns the account that pays the fees on t, or 0 when t is
+// not charged. Fees and interest never are, so a fee never triggers
+// another fee.
+func feePayer(t *Transaction) int {
+	switch t.Type {
+	case "deposit":
+		return t.ToAccount
+	case "withdraw", "transfer":
+		return t.FromAccount
+	}
+	return 0
+}
+
+// transactionFees returns the fees payer owes for t, in the order they are
+// posted: the scheduled fees, then the overdraft fee if t and those fees
+// together take the balance from zero or above into overdraft. The
+// transaction and all its fees must fit in the account together, so
+// nothing is posted unless everything can be.
+func transactionFees(schedule FeeSchedule, payer *Account, t *Transaction) ([]Fee, error) {
+	fees := []Fee{}
+	change := t.Amount.Neg()
+	if creditTransaction(t.Type) {
+		change = t.Amount
+	}
+	for _, r := range schedule {
+		if !r.matches(t.Type, payer.Product, t.Amount) {
+			continue
+		}
+		if fee := r.fee(t.Amount); fee.IsPositive() {
+			fees = append(fees, Fee{Rule: r.Name, Amount: fee})
+			change.Amount -= fee.Amount
+		}
+	}
+
+	overdrawn := !payer.Balance.IsNegative() && payer.Balance.Amount+change.Amount < 0
+	if overdrawn && !payer.OverdraftFee.IsZero() && !creditTransaction(t.Type) {
+		fees = append(fees, Fee{Rule: overdraftFeeRule, Amount: payer.OverdraftFee})
+		change.Amount -= payer.OverdraftFee.Amount
+	}
+	if len(fees) == 0 {
+		return fees, nil
+	}
+	if _, err := checkBalanceChange(payer, change); err != nil {
+		return nil, err
+	}
+	return fees, nil
+}
+
+// feeTransaction returns the fee transaction for fee and its journal entry.
+func feeTransaction(payer int, fee Fee) (*Transaction, *JournalEntry, error) {
+	entry, err := transactionEntry(payer, 0, "fee", fee.Amount)
+	if err != nil {
+		return nil, nil, err
+	}
+	entry.Description = "fee " + fee.Rule
+	return &Transaction{FromAccount: payer, Type: "fee", Amount: fee.Amount}, entry, nil
+}
+
+// handlePreviewFees is a dry run of a deposit, withdrawal or transfer: it
+// shows the fees it would be charged right now without moving any money.
+func (s *APIServer) handlePreviewFees(w http.ResponseWriter, r *http.Request) error {
+	req := new(FeePreviewRequest)
+	if err := decodeJSON(r, req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if err := req.validate(s.config.LegacyAccountNumbers); err != nil {
+		return err
+	}
+
+	caller := r.Context().Value("account").(*Account)
+	if caller.AccountNumber != req.AccountNumber && !caller.Role.Can(PermViewAnyAccount) {
+		return forbidden("You are not allowed to access this account")
+	}
+	account, err := s.store.GetAccountByNumber(req.AccountNumber)
+	if err != nil {
+		return err
+	}
+	if req.Amount, err = req.Amount.inCurrency(account.Balance.Currency); err != nil {
+		return fieldError("amount", "%v", err)
+	}
+	if !account.Balance.SameCurrency(req.Amount) {
+		return &CurrencyMismatchError{AccountNumber: account.AccountNumber, AccountCurrency: account.Balance.Currency, Currency: req.Amount.Currency}
+	}
+
+	t := &Transaction{Type: req.Type, Amount: req.Amount}
+	if t.Type == "deposit" {
+		t.ToAccount = account.AccountNumber
+	} else {
+		t.FromAccount = account.AccountNumber
+	}
+	fees, err := transactionFees(s.config.Fees, account, t)
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, newFeePreviewResponse(req.Amount, fees))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeeRuleAmounts(t *testing.T) {
+	// 1.00 plus 0.5%, between 2.00 and 10.00
+	capped := FeeRule{Name: "wire", TransactionType: "transfer", Flat: usd(100), Percent: "0.005", Min: usd(200), Max: usd(1000)}
+	assert.Nil(t, capped.validate())
+	assert.Equal(t, usd(200), capped.fee(usd(1000)))
+	assert.Equal(t, usd(600), capped.fee(usd(100000)))
+	assert.Equal(t, usd(1000), capped.fee(usd(1000000)))
+
+	tiered := FeeRule{Name: "atm", TransactionType: "withdraw", Tiers: []FeeTier{
+		{UpTo: usd(10000), Flat: usd(150)},
+		{UpTo: usd(50000), Flat: usd(250)},
+		{Percent: "0.01"},
+	}}
+	assert.Nil(t, tiered.validate())
+	assert.Equal(t, usd(150), tiered.fee(usd(10000)))
+	assert.Equal(t, usd(250), tiered.fee(usd(10001)))
+	assert.Equal(t, usd(1000), tiered.fee(usd(100000)))
+
+	// a percentage-only rule charges in any currency, rounding half to even
+	percent := FeeRule{Name: "fx", TransactionType: "transfer", Percent: "0.01"}
+	assert.True(t, percent.matches("transfer", ProductSavings, NewMoney(250, "EUR")))
+	assert.Equal(t, NewMoney(2, "EUR"), percent.fee(NewMoney(250, "EUR")))
+	assert.False(t, capped.matches("transfer", ProductChecking, NewMoney(250, "EUR")))
+
+	invalid := []FeeRule{
+		{Name: "a", TransactionType: "fee"},
+		{Name: "b", TransactionType: "withdraw", Product: "bond"},
+		{Name: "c", TransactionType: "withdraw", Flat: usd(100), Max: NewMoney(500, "EUR")},
+		{Name: "d", TransactionType: "withdraw", Percent: "1.5"},
+		{Name: "e", TransactionType: "withdraw", Min: usd(500), Max: usd(100)},
+		{Name: "f", TransactionType: "withdraw", Tiers: []FeeTier{{Flat: usd(100)}, {UpTo: usd(500)}}},
+	}
+	for _, r := range invalid {
+		assert.NotNil(t, r.validate(), r.Name)
+	}
+	assert.NotNil(t, FeeSchedule{{Name: overdraftFeeRule, TransactionType: "withdraw"}}.validate())
+}
+
+func TestScheduledFeesPostedWithTransaction(t *testing.T) {
+	store := NewMemoryStore()
+	checking := newTestAccount(t, store, 1008)
+	savings := newTestAccount(t, store, 1016)
+	store.accounts[savings.ID].Product = ProductSavings
+	store.SetFeeSchedule(FeeSchedule{
+		{Name: "transfer", TransactionType: "transfer", Flat: usd(100)},
+		{Name: "savings withdrawal", TransactionType: "transfer", Product: ProductSavings, Percent: "0.01"},
+	})
+	_, err := store.CreateTransaction(0, 1008, "deposit", usd(10000))
+	assert.Nil(t, err)
+
+	// the transfer and its fee must fit together, or neither is posted
+	var insufficient *InsufficientFundsError
+	_, err = store.CreateTransaction(1008, 1016, "transfer", usd(10000))
+	assert.True(t, errors.As(err, &insufficient))
+	acc, err := store.GetAccountByNumber(1008)
+	assert.Nil(t, err)
+	assert.Equal(t, usd(10000), acc.Balance)
+
+	updated, err := store.CreateTransaction(1008, 1016, "transfer", usd(9000))
+	assert.Nil(t, err)
+	assert.Equal(t, usd(900), updated.Balance)
+
+	// savings accounts pay both rules
+	updated, err = store.CreateTransaction(1016, 1008, "transfer", usd(5000))
+	assert.Nil(t, err)
+	assert.Equal(t, usd(3850), updated.Balance)
+
+	fees, err := store.GetTransactions(1016, TransactionFilter{Types: []string{"fee"}})
+	assert.Nil(t, err)
+	assert.Len(t, fees, 2)
+	income, err := store.GetLedgerBalance(LedgerFeeIncome, DefaultCurrency)
+	assert.Nil(t, err)
+	assert.Equal(t, usd(250), income)
+	mismatches, err := store.ReconcileBalances()
+	assert.Nil(t, err)
+	assert.Empty(t, mismatches)
+
+	// deposits are not charged unless a rule says so
+	updated, err = store.CreateTransaction(0, checking.AccountNumber, "deposit", usd(100))
+	assert.Nil(t, err)
+	assert.Equal(t, usd(6000), updated.Balance)
+}
+
+func TestPreviewFeesEndpoint(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	server.config.Fees = FeeSchedule{{Name: "transfer", TransactionType: "transfer", Flat: usd(100), Percent: "0.001"}}
+	store.SetFeeSchedule(server.config.Fees)
+	acc := newTestAccount(t, store, 1008)
+	newTestAccount(t, store, 1016)
+	assert.Nil(t, store.SetOverdraft(acc.ID, usd(10000), usd(500)))
+	_, err := store.CreateTransaction(0, 1008, "deposit", usd(10000))
+	assert.Nil(t, err)
+	token := login(t, server, 1008, "password").Token
+
+	w := doRequest(server, "POST", "/fees/preview", token, FeePreviewRequest{Type: "fee", AccountNumber: 1008, Amount: usd(100)})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(server, "POST", "/fees/preview", token, FeePreviewRequest{Type: "transfer", AccountNumber: 1016, Amount: usd(100)})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// going into overdraft adds the overdraft fee to the scheduled one
+	w = doRequest(server, "POST", "/fees/preview", token, FeePreviewRequest{Type: "transfer", AccountNumber: 1008, Amount: usd(15000)})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var preview FeePreviewResponse
+	assert.Nil(t, jsonDecode(w, &preview))
+	assert.Equal(t, []FeeResponse{{Rule: "transfer", Amount: usd(115)}, {Rule: overdraftFeeRule, Amount: usd(500)}}, preview.Fees)
+	assert.Equal(t, usd(615), preview.TotalFees)
+
+	// nothing moved, and the real transfer charges what was previewed
+	w = doRequest(server, "POST", "/transfer", token, TransferRequest{FromAccountNumber: 1008, ToAccountNumber: 1016, Amount: usd(15000)})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	updated, err := store.GetAccountByNumber(1008)
+	assert.Nil(t, err)
+	assert.Equal(t, usd(10000-15000-615), updated.Balance)
+}
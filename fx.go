@@ -0,0 +1,406 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// rateDecimals is how many decimal places offered rates are rounded to.
+// Converted amounts are computed from the rounded rate, so the rate stored
+// on a transaction reproduces its converted amount exactly.
+const rateDecimals = 10
+
+// FXConfig configures currency exchange. Rates, and the file at RatesFile in
+// the same "EUR/USD": "1.08" form, seed the rate table at startup with the
+// pairs it does not have yet; admins update it through the API afterwards. Customers get the mid rate less
+// Spread (a fraction, "0.005" is half a percent), and a quote holds its rate
+// for QuoteTTL.
+type FXConfig struct {
+	Rates     map[string]string `yaml:"rates"`
+	RatesFile string            `yaml:"rates_file"`
+	Spread    string            `yaml:"spread"`
+	QuoteTTL  time.Duration     `yaml:"quote_ttl"`
+}
+
+func (c FXConfig) validate() error {
+	if _, err := parseRates(c.Rates); err != nil {
+		return err
+	}
+	spread, ok := new(big.Rat).SetString(c.Spread)
+	if !ok || spread.Sign() < 0 || spread.Cmp(big.NewRat(1, 1)) >= 0 {
+		return fmt.Errorf("FX spread %q must be a decimal from 0 up to 1", c.Spread)
+	}
+	if c.QuoteTTL <= 0 {
+		return fmt.Errorf("FX quote TTL must be positive")
+	}
+	return nil
+}
+
+// FXRate is one row of the rate table: one Base buys Rate units of Quote.
+// The inverse pair is derived, so only one direction needs to be listed.
+type FXRate struct {
+	Base      string
+	Quote     string
+	Rate      string // exact decimal
+	UpdatedAt time.Time
+}
+
+func (r *FXRate) Pair() string { return r.Base + "/" + r.Quote }
+
+// FXQuote holds a rate for converting Amount into Converted until
+// ExpiresAt. It can be used once, by the account that asked for it.
+type FXQuote struct {
+	ID            string
+	AccountNumber int
+	Amount        Money
+	Converted     Money
+	Rate          string
+	Spread        string
+	CreatedAt     time.Time
+	ExpiresAt     time.Time
+	UsedAt        *time.Time
+}
+
+// Exchange is a transfer between accounts held in different currencies.
+// Rate is the rate applied after Spread. When QuoteID is set, CreateExchange
+// consumes the quote in the same transaction as the transfer.
+type Exchange struct {
+	FromAccount int
+	ToAccount   int
+	Debit       Money
+	Credit      Money
+	Rate        string
+	Spread      string
+	QuoteID     string
+}
+
+// transaction is the transfer row recorded for x.
+func (x *Exchange) transaction() *Transaction {
+	return &Transaction{
+		FromAccount: x.FromAccount,
+		ToAccount:   x.ToAccount,
+		Type:        "transfer",
+		Amount:      x.Debit,
+		Converted:   x.Credit,
+		FXRate:      x.Rate,
+		FXSpread:    x.Spread,
+		FXQuoteID:   x.QuoteID,
+	}
+}
+
+func parseCurrencyPair(pair string) (string, string, error) {
+	base, quote, ok := strings.Cut(strings.ToUpper(strings.TrimSpace(pair)), "/")
+	if !ok {
+		return "", "", fmt.Errorf("currency pair %q must look like EUR/USD", pair)
+	}
+	for _, c := range []string{base, quote} {
+		if _, err := currencyExponent(c); err != nil {
+			return "", "", err
+		}
+	}
+	if base == quote {
+		return "", "", fmt.Errorf("currency pair %q needs two different currencies", pair)
+	}
+	return base, quote, nil
+}
+
+func parseRate(s string) (*big.Rat, error) {
+	rate, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok || rate.Sign() <= 0 {
+		return nil, fmt.Errorf("exchange rate %q must be a positive decimal", s)
+	}
+	return rate, nil
+}
+
+// parseRates turns a "EUR/USD": "1.08" map into rate table rows, sorted by
+// pair.
+func parseRates(m map[string]string) ([]*FXRate, error) {
+	rates := make([]*FXRate, 0, len(m))
+	for pair, s := range m {
+		base, quote, err := parseCurrencyPair(pair)
+		if err != nil {
+			return nil, err
+		}
+		rate, err := parseRate(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pair, err)
+		}
+		rates = append(rates, &FXRate{Base: base, Quote: quote, Rate: formatDecimal(rate, rateDecimals)})
+	}
+	slices.SortFunc(rates, func(a, b *FXRate) int { return strings.Compare(a.Pair(), b.Pair()) })
+	return rates, nil
+}
+
+// loadFXRates seeds the rate table from the config and the rates file.
+// Pairs already in the table, either way round, are left alone so a
+// restart does not undo rates an admin has set since.
+func loadFXRates(store Storage, c FXConfig) error {
+	m := map[string]string{}
+	if c.RatesFile != "" {
+		data, err := os.ReadFile(c.RatesFile)
+		if err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("parsing %s: %w", c.RatesFile, err)
+		}
+	}
+	for pair, rate := range c.Rates {
+		m[pair] = rate
+	}
+	parsed, err := parseRates(m)
+	if err != nil {
+		return err
+	}
+	existing, err := store.GetFXRates()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	rates := []*FXRate{}
+	for _, r := range parsed {
+		if _, err := midRate(existing, r.Base, r.Quote); err == nil {
+			continue
+		}
+		r.UpdatedAt = now
+		rates = append(rates, r)
+	}
+	if len(rates) == 0 {
+		return nil
+	}
+	fmt.Printf("Loaded %d exchange rates\n", len(rates))
+	return store.SetFXRates(rates)
+}
+
+// midRate returns how many units of to one unit of from buys, using the
+// inverse pair when only that one is listed.
+func midRate(rates []*FXRate, from, to string) (*big.Rat, error) {
+	for _, r := range rates {
+		switch {
+		case r.Base == from && r.Quote == to:
+			return parseRate(r.Rate)
+		case r.Base == to && r.Quote == from:
+			rate, err := parseRate(r.Rate)
+			if err != nil {
+				return nil, err
+			}
+			return rate.Inv(rate), nil
+		}
+	}
+	return nil, invalidf("no exchange rate for %s/%s", from, to)
+}
+
+// applyRate multiplies amount by rate into currency, taking the difference
+// in minor-unit exponents into account and rounding ties to even.
+func applyRate(amount Money, currency string, rate *big.Rat) (Money, error) {
+	converted, err := scaleByRate(amount, currency, rate)
+	if err != nil {
+		return Money{}, err
+	}
+	if !converted.IsPositive() {
+		return Money{}, invalidf("%s is too small to convert to %s", amount, currency)
+	}
+	return converted, nil
+}
+
+// convertMid converts amount into currency at the mid rate. Limits,
+// thresholds and fees are configured in one currency but apply to accounts
+// in any, so callers must fail closed when there is no rate rather than
+// skip the rule.
+func convertMid(rates []*FXRate, amount Money, currency string) (Money, error) {
+	if amount.Currency == currency {
+		return amount, nil
+	}
+	if amount.IsZero() {
+		return NewMoney(0, currency), nil
+	}
+	rate, err := midRate(rates, amount.Currency, currency)
+	if err != nil {
+		return Money{}, err
+	}
+	return scaleByRate(amount, currency, rate)
+}
+
+func scaleByRate(amount Money, currency string, rate *big.Rat) (Money, error) {
+	fromExp, err := currencyExponent(amount.Currency)
+	if err != nil {
+		return Money{}, err
+	}
+	toExp, err := currencyExponent(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	factor := new(big.Rat).Set(rate)
+	for i := fromExp; i < toExp; i++ {
+		factor.Mul(factor, big.NewRat(10, 1))
+	}
+	for i := toExp; i < fromExp; i++ {
+		factor.Quo(factor, big.NewRat(10, 1))
+	}
+	converted := amount.MulRat(factor)
+	converted.Currency = currency
+	return converted, nil
+}
+
+// offerExchange prices converting amount into currency at the current rate
+// less the spread.
+func (s *APIServer) offerExchange(amount Money, currency string) (*Exchange, error) {
+	rates, err := s.store.GetFXRates()
+	if err != nil {
+		return nil, err
+	}
+	mid, err := midRate(rates, amount.Currency, currency)
+	if err != nil {
+		return nil, err
+	}
+	spread, ok := new(big.Rat).SetString(s.config.FX.Spread)
+	if !ok {
+		spread = new(big.Rat)
+	}
+	offered := new(big.Rat).Mul(mid, new(big.Rat).Sub(big.NewRat(1, 1), spread))
+	rate := formatDecimal(offered, rateDecimals)
+	applied, err := parseRate(rate)
+	if err != nil {
+		return nil, invalidf("no usable exchange rate for %s/%s", amount.Currency, currency)
+	}
+
+	credit, err := applyRate(amount, currency, applied)
+	if err != nil {
+		return nil, err
+	}
+	return &Exchange{Debit: amount, Credit: credit, Rate: rate, Spread: formatDecimal(spread, rateDecimals)}, nil
+}
+
+// exchangeFor prices a transfer into an account held in another currency,
+// either from the quote the client locked or at the current rate.
+func (s *APIServer) exchangeFor(req *TransferRequest, to *Account) (*Exchange, error) {
+	if req.QuoteID == "" {
+		if !req.Convert {
+			return nil, newAPIError(http.StatusUnprocessableEntity, CodeCurrencyMismatch,
+				"account %d is in %s, set convert or use a quote to exchange %s", to.AccountNumber, to.Balance.Currency, req.Amount.Currency)
+		}
+		x, err := s.offerExchange(req.Amount, to.Balance.Currency)
+		if err != nil {
+			return nil, err
+		}
+		x.FromAccount, x.ToAccount = req.FromAccountNumber, to.AccountNumber
+		return x, nil
+	}
+
+	quote, err := s.store.GetFXQuote(req.QuoteID)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case quote.AccountNumber != req.FromAccountNumber:
+		return nil, notFound("FX quote %s not found", req.QuoteID)
+	case quote.Amount != req.Amount:
+		return nil, fieldError("amount", "must match the quoted %s", quote.Amount)
+	case !quote.Converted.SameCurrency(to.Balance):
+		return nil, fieldError("quoteId", "quotes %s but account %d is in %s", quote.Converted.Currency, to.AccountNumber, to.Balance.Currency)
+	case quote.UsedAt != nil || !time.Now().Before(quote.ExpiresAt):
+		return nil, conflict("FX quote %s has expired or was already used", quote.ID)
+	}
+	return &Exchange{
+		FromAccount: req.FromAccountNumber,
+		ToAccount:   to.AccountNumber,
+		Debit:       quote.Amount,
+		Credit:      quote.Converted,
+		Rate:        quote.Rate,
+		Spread:      quote.Spread,
+		QuoteID:     quote.ID,
+	}, nil
+}
+
+// handleCreateFXQuote locks the current rate for converting an amount out
+// of the caller's account for the configured TTL.
+func (s *APIServer) handleCreateFXQuote(w http.ResponseWriter, r *http.Request) error {
+	req := new(FXQuoteRequest)
+	if err := decodeJSON(r, req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if err := req.validate(); err != nil {
+		return err
+	}
+
+	account := r.Context().Value("account").(*Account)
+	var err error
+	if req.Amount, err = req.Amount.inCurrency(account.Balance.Currency); err != nil {
+		return fieldError("amount", "%v", err)
+	}
+	if req.To == req.Amount.Currency {
+		return fieldError("to", "must differ from the amount's currency")
+	}
+	if !account.Balance.SameCurrency(req.Amount) {
+		return &CurrencyMismatchError{AccountNumber: account.AccountNumber, AccountCurrency: account.Balance.Currency, Currency: req.Amount.Currency}
+	}
+	x, err := s.offerExchange(req.Amount, req.To)
+	if err != nil {
+		return err
+	}
+
+	id, err := randomToken(16)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	quote := &FXQuote{
+		ID:            id,
+		AccountNumber: account.AccountNumber,
+		Amount:        x.Debit,
+		Converted:     x.Credit,
+		Rate:          x.Rate,
+		Spread:        x.Spread,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(s.config.FX.QuoteTTL),
+	}
+	if err := s.store.CreateFXQuote(quote); err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, newFXQuoteResponse(quote))
+}
+
+func (s *APIServer) handleGetFXRates(w http.ResponseWriter, r *http.Request) error {
+	rates, err := s.store.GetFXRates()
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, newFXRateResponses(rates))
+}
+
+// handleSetFXRates adds or replaces rates in the table. Quotes already
+// handed out keep their rate.
+func (s *APIServer) handleSetFXRates(w http.ResponseWriter, r *http.Request) error {
+	req := new(SetFXRatesRequest)
+	if err := decodeJSON(r, req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	rates, err := parseRates(req.Rates)
+	if err != nil {
+		return fieldError("rates", "%v", err)
+	}
+	if len(rates) == 0 {
+		return fieldError("rates", "is required")
+	}
+	now := time.Now().UTC()
+	for _, rate := range rates {
+		rate.UpdatedAt = now
+	}
+	if err := s.store.SetFXRates(rates); err != nil {
+		return err
+	}
+	fmt.Printf("Updated %d exchange rates\n", len(rates))
+
+	return s.handleGetFXRates(w, r)
+}
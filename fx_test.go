@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyRate(t *testing.T) {
+	rates, err := parseRates(map[string]string{"eur/usd": "1.08", "USD/JPY": "151.25", "KWD/USD": "3.25"})
+	assert.Nil(t, err)
+	convert := func(amount Money, currency string) (Money, error) {
+		rate, err := midRate(rates, amount.Currency, currency)
+		if err != nil {
+			return Money{}, err
+		}
+		return applyRate(amount, currency, rate)
+	}
+
+	converted, err := convert(NewMoney(10000, "EUR"), "USD")
+	assert.Nil(t, err)
+	assert.Equal(t, usd(10800), converted)
+
+	// inverse pair, rounded to the cent
+	converted, err = convert(usd(10000), "EUR")
+	assert.Nil(t, err)
+	assert.Equal(t, NewMoney(9259, "EUR"), converted)
+
+	// minor units differ: JPY has none, KWD has three
+	converted, err = convert(usd(1000), "JPY")
+	assert.Nil(t, err)
+	assert.Equal(t, NewMoney(1512, "JPY"), converted)
+	converted, err = convert(NewMoney(1000, "KWD"), "USD")
+	assert.Nil(t, err)
+	assert.Equal(t, usd(325), converted)
+
+	_, err = convert(usd(100), "GBP")
+	assert.True(t, errors.Is(err, ErrInvalid))
+
+	_, err = parseRates(map[string]string{"EURUSD": "1.08"})
+	assert.NotNil(t, err)
+	_, err = parseRates(map[string]string{"EUR/USD": "-1"})
+	assert.NotNil(t, err)
+	assert.NotNil(t, FXConfig{Spread: "1", QuoteTTL: time.Second}.validate())
+	assert.Nil(t, FXConfig{Spread: "0.005", QuoteTTL: time.Second}.validate())
+}
+
+func TestCrossCurrencyTransfer(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	server.config.FX.Spread = "0"
+	assert.Nil(t, loadFXRates(store, FXConfig{Rates: map[string]string{"EUR/USD": "1.25"}}))
+	newTestAccount(t, store, 1008)
+	_, err := store.CreateTransaction(0, 1008, "deposit", usd(10000))
+	assert.Nil(t, err)
+
+	w := doRequest(server, "POST", "/account", "", CreateAccountRequest{FirstName: "Jane", LastName: "Doe", Password: "s3cret-pass", Currency: "xyz"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(server, "POST", "/account", "", CreateAccountRequest{FirstName: "Jane", LastName: "Doe", Password: "s3cret-pass", Currency: "eur"})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var created AccountResponse
+	assert.Nil(t, jsonDecode(w, &created))
+	assert.Equal(t, NewMoney(0, "EUR"), created.Balance)
+
+	// plain operations refuse the wrong currency
+	_, err = store.CreateTransaction(0, created.AccountNumber, "deposit", usd(100))
+	var mismatch *CurrencyMismatchError
+	assert.True(t, errors.As(err, &mismatch))
+
+	token := login(t, server, 1008, "password").Token
+	req := TransferRequest{FromAccountNumber: 1008, ToAccountNumber: created.AccountNumber, Amount: usd(5000)}
+	w = doRequest(server, "POST", "/transfer", token, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	var apiErr APIError
+	assert.Nil(t, jsonDecode(w, &apiErr))
+	assert.Equal(t, CodeCurrencyMismatch, apiErr.Code)
+
+	req.Convert = true
+	w = doRequest(server, "POST", "/transfer", token, req)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	sender, err := store.GetAccountByNumber(1008)
+	assert.Nil(t, err)
+	assert.Equal(t, usd(5000), sender.Balance)
+	receiver, err := store.GetAccountByNumber(created.AccountNumber)
+	assert.Nil(t, err)
+	assert.Equal(t, NewMoney(4000, "EUR"), receiver.Balance)
+
+	w = doRequest(server, "GET", "/account/"+strconv.Itoa(sender.ID)+"/transactions", token, nil)
+	var page TransactionPage
+	assert.Nil(t, jsonDecode(w, &page))
+	assert.Equal(t, usd(5000), page.Transactions[0].Amount)
+	assert.Equal(t, NewMoney(4000, "EUR"), *page.Transactions[0].ConvertedAmount)
+	assert.Equal(t, "0.8", page.Transactions[0].Rate)
+
+	mismatches, err := store.ReconcileBalances()
+	assert.Nil(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func TestFXQuoteTransfer(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	server.config.FX.Spread = "0.005"
+	server.config.FX.QuoteTTL = time.Minute
+	admin := newTestAccount(t, store, 1008)
+	assert.Nil(t, store.SetAccountRole(admin.ID, RoleAdmin))
+	newTestAccount(t, store, 1016)
+	assert.Nil(t, store.CreateAccount(&Account{FirstName: "Jane", LastName: "Doe", AccountNumber: 1024, Balance: NewMoney(0, "EUR"), Status: StatusActive}))
+	_, err := store.CreateTransaction(0, 1016, "deposit", usd(10000))
+	assert.Nil(t, err)
+
+	adminToken := login(t, server, 1008, "password").Token
+	token := login(t, server, 1016, "password").Token
+
+	// only admins set rates, and a pair replaces its inverse
+	rates := SetFXRatesRequest{Rates: map[string]string{"EUR/USD": "1.25"}}
+	assert.Equal(t, http.StatusForbidden, doRequest(server, "PUT", "/fx/rates", token, rates).Code)
+	w := doRequest(server, "PUT", "/fx/rates", adminToken, SetFXRatesRequest{Rates: map[string]string{"USD/EUR": "0.9"}})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = doRequest(server, "PUT", "/fx/rates", adminToken, rates)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var table []FXRateResponse
+	assert.Nil(t, jsonDecode(w, &table))
+	assert.Len(t, table, 1)
+	assert.Equal(t, "EUR/USD", table[0].Pair)
+
+	// 0.8 less half a percent
+	w = doRequest(server, "POST", "/fx/quote", token, FXQuoteRequest{Amount: usd(5000), To: "eur"})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var quote FXQuoteResponse
+	assert.Nil(t, jsonDecode(w, &quote))
+	assert.Equal(t, "0.796", quote.Rate)
+	assert.Equal(t, "0.005", quote.Spread)
+	assert.Equal(t, NewMoney(3980, "EUR"), quote.Converted)
+
+	// the quote holds even after the rate moves
+	w = doRequest(server, "PUT", "/fx/rates", adminToken, SetFXRatesRequest{Rates: map[string]string{"EUR/USD": "1.5"}})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	req := TransferRequest{FromAccountNumber: 1016, ToAccountNumber: 1024, Amount: usd(4000), QuoteID: quote.ID}
+	w = doRequest(server, "POST", "/transfer", token, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	req.Amount = usd(5000)
+	w = doRequest(server, "POST", "/transfer", token, req)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	receiver, err := store.GetAccountByNumber(1024)
+	assert.Nil(t, err)
+	assert.Equal(t, NewMoney(3980, "EUR"), receiver.Balance)
+	transactions, err := store.GetTransactions(1016, TransactionFilter{})
+	assert.Nil(t, err)
+	assert.Equal(t, "0.796", transactions[0].FXRate)
+	assert.Equal(t, "0.005", transactions[0].FXSpread)
+	assert.Equal(t, quote.ID, transactions[0].FXQuoteID)
+
+	// a quote is good for one transfer only
+	w = doRequest(server, "POST", "/transfer", token, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// nor after it expires
+	server.config.FX.QuoteTTL = time.Nanosecond
+	w = doRequest(server, "POST", "/fx/quote", token, FXQuoteRequest{Amount: usd(1000), To: "EUR"})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Nil(t, jsonDecode(w, &quote))
+	req = TransferRequest{FromAccountNumber: 1016, ToAccountNumber: 1024, Amount: usd(1000), QuoteID: quote.ID}
+	w = doRequest(server, "POST", "/transfer", token, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// quotes belong to the account that asked for them
+	adminReq := TransferRequest{FromAccountNumber: 1008, ToAccountNumber: 1024, Amount: usd(1000), QuoteID: quote.ID}
+	w = doRequest(server, "POST", "/transfer", adminToken, adminReq)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	mismatches, err := store.ReconcileBalances()
+	assert.Nil(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func TestLoadFXRatesKeepsExistingPairs(t *testing.T) {
+	store := NewMemoryStore()
+	config := FXConfig{Rates: map[string]string{"EUR/USD": "1.25", "GBP/USD": "1.5"}}
+	assert.Nil(t, loadFXRates(store, config))
+
+	// an admin updates one pair, the inverse way round, and the server restarts
+	assert.Nil(t, store.SetFXRates([]*FXRate{{Base: "USD", Quote: "EUR", Rate: "0.9"}}))
+	config.Rates["JPY/USD"] = "0.0066"
+	assert.Nil(t, loadFXRates(store, config))
+
+	rates, err := store.GetFXRates()
+	assert.Nil(t, err)
+	got := map[string]string{}
+	for _, r := range rates {
+		got[r.Pair()] = r.Rate
+	}
+	assert.Equal(t, map[string]string{"USD/EUR": "0.9", "GBP/USD": "1.5", "JPY/USD": "0.0066"}, got)
+}
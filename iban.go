@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ibanLengths is the total IBAN length per country from the ISO 13616
+// registry. Only countries listed here are accepted.
+var ibanLengths = map[string]int{
+	"AD": 24, "AE": 23, "AT": 20, "BE": 16, "BG": 22, "CH": 21, "CY": 28,
+	"CZ": 24, "DE": 22, "DK": 18, "EE": 20, "ES": 24, "FI": 18, "FR": 27,
+	"GB": 22, "GI": 23, "GR": 27, "HR": 21, "HU": 28, "IE": 22, "IS": 26,
+	"IT": 27, "LI": 21, "LT": 20, "LU": 20, "LV": 21, "MC": 27, "MT": 31,
+	"NL": 18, "NO": 15, "PL": 28, "PT": 25, "RO": 24, "SE": 24, "SI": 19,
+	"SK": 24, "SM": 27,
+}
+
+// accountNumberDigits is the width of every server-allocated account number.
+const accountNumberDigits = 9
+
+// IBANConfig identifies this bank inside IBANs. The BBAN is the bank code
+// followed by the account number, zero padded to fill the country's length.
+type IBANConfig struct {
+	CountryCode string `yaml:"country_code"`
+	BankCode    string `yaml:"bank_code"`
+}
+
+func (c IBANConfig) accountWidth() int {
+	return ibanLengths[c.CountryCode] - 4 - len(c.BankCode)
+}
+
+func (c IBANConfig) validate() error {
+	if _, ok := ibanLengths[c.CountryCode]; !ok {
+		return fmt.Errorf("unknown IBAN country code %q", c.CountryCode)
+	}
+	if c.BankCode == "" || !isAlphanumeric(c.BankCode) {
+		return fmt.Errorf("IBAN bank code must be uppercase letters and digits")
+	}
+	if c.accountWidth() < accountNumberDigits {
+		return fmt.Errorf("IBAN bank code %q leaves no room for %d digit account numbers in %s IBANs",
+			c.BankCode, accountNumberDigits, c.CountryCode)
+	}
+	return nil
+}
+
+// IBAN builds the IBAN of an internal account number.
+func (c IBANConfig) IBAN(accountNumber int) string {
+	bban := c.BankCode + fmt.Sprintf("%0*d", c.accountWidth(), accountNumber)
+	return c.CountryCode + ibanCheckDigits(c.CountryCode, bban) + bban
+}
+
+// ibanCheckDigits computes the two check digits for country and bban.
+func ibanCheckDigits(country, bban string) string {
+	return fmt.Sprintf("%02d", 98-mod97(bban+country+"00"))
+}
+
+// normalizeIBAN strips the spaces of the printed form and upper-cases it.
+func normalizeIBAN(s string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(s), " ", ""))
+}
+
+// validateIBAN checks a normalized IBAN: known country, registered length,
+// character set and the ISO 13616 mod-97 checksum.
+func validateIBAN(iban string) error {
+	if len(iban) < 4 || !isAlphanumeric(iban) {
+		return fmt.Errorf("is not a valid IBAN")
+	}
+	length, ok := ibanLengths[iban[:2]]
+	if !ok {
+		return fmt.Errorf("has unsupported country code %s", iban[:2])
+	}
+	if len(iban) != length {
+		return fmt.Errorf("must be %d characters for %s", length, iban[:2])
+	}
+	if !isDigits(iban[2:4]) || mod97(iban[4:]+iban[:4]) != 1 {
+		return fmt.Errorf("has an invalid checksum")
+	}
+	return nil
+}
+
+// mod97 returns s mod 97 where letters count as two digit numbers (A=10 ..
+// Z=35), processed piecewise so it never overflows.
+func mod97(s string) int {
+	rem := 0
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			rem = (rem*10 + int(c-'0')) % 97
+		case c >= 'A' && c <= 'Z':
+			rem = (rem*100 + int(c-'A') + 10) % 97
+		}
+	}
+	return rem
+}
+
+func isAlphanumeric(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateIBAN(t *testing.T) {
+	for _, iban := range []string{"GB82 WEST 1234 5698 7654 32", "DE89 3704 0044 0532 0130 00", "nl91abna0417164300"} {
+		assert.Nil(t, validateIBAN(normalizeIBAN(iban)), iban)
+	}
+	for _, iban := range []string{"GB82 WEST 1234 5698 7654 33", "DE89 3704 0044 0532 0130", "XX89 3704 0044 0532 0130 00", "DE89-3704"} {
+		assert.NotNil(t, validateIBAN(normalizeIBAN(iban)), iban)
+	}
+}
+
+func TestIBANConfig(t *testing.T) {
+	cfg := IBANConfig{CountryCode: "DE", BankCode: "37040044"}
+	assert.Nil(t, cfg.validate())
+	assert.Equal(t, "DE89370400440532013000", cfg.IBAN(532013000))
+
+	iban := defaultConfig().IBAN.IBAN(withCheckDigit(firstAccountSequence))
+	assert.Nil(t, validateIBAN(iban))
+
+	// GB IBANs only have room for an 8 digit account number after the sort code
+	assert.NotNil(t, IBANConfig{CountryCode: "GB", BankCode: "WEST123456"}.validate())
+	assert.NotNil(t, IBANConfig{CountryCode: "ZZ", BankCode: "1234"}.validate())
+}
+
+func TestTransferToIBAN(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	newTestAccount(t, store, 1008)
+	store.CreateTransaction(0, 1008, "deposit", usd(10000))
+
+	w := doRequest(server, "POST", "/account", "", CreateAccountRequest{FirstName: "Jane", LastName: "Doe", Password: "s3cret-pass"})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var to AccountResponse
+	assert.Nil(t, jsonDecode(w, &to))
+	assert.Nil(t, validateIBAN(to.IBAN))
+
+	token := login(t, server, 1008, "password").Token
+	w = doRequest(server, "POST", "/transfer", token, TransferRequest{FromAccountNumber: 1008, ToIBAN: to.IBAN[:4] + " " + to.IBAN[4:], Amount: usd(2500)})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	acc, _ := store.GetAccountByNumber(to.AccountNumber)
+	assert.Equal(t, usd(2500), acc.Balance)
+
+	w = doRequest(server, "POST", "/transfer", token, TransferRequest{FromAccountNumber: 1008, ToIBAN: "DE89370400440532013000", Amount: usd(100)})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = doRequest(server, "POST", "/transfer", token, TransferRequest{FromAccountNumber: 1008, ToAccountNumber: to.AccountNumber, ToIBAN: to.IBAN, Amount: usd(100)})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	idempotencyHeader    = "Idempotency-Key"
+	maxIdempotencyKeyLen = 255
+)
+
+// idempotencyLease is how long a key stays reserved for a request that is
+// still running. If the server dies before the request finishes, the key
+// can be used again once the lease runs out.
+const idempotencyLease = 5 * time.Minute
+
+// idempotent wraps a money-moving handler so that requests carrying an
+// Idempotency-Key header are executed at most once per account. A replay with
+// the same key and the same request gets the original response back; reusing
+// the key for a different request is rejected with 422. Responses are kept
+// for the configured IdempotencyKeyTTL, after which the key is forgotten.
+// Must run inside JWTauthMiddleWare since keys are scoped to the
+// authenticated account.
+func (s *APIServer) idempotent(fn APIFunc) APIFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" {
+			return fn(w, r)
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			return badRequest("%s must be at most %d characters", idempotencyHeader, maxIdempotencyKeyLen)
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body.Close()
+
+		account := r.Context().Value("account").(*Account)
+		now := time.Now().UTC()
+		rec := &IdempotencyRecord{
+			AccountNumber: account.AccountNumber,
+			Key:           key,
+			Fingerprint:   requestFingerprint(r, body),
+			CreatedAt:     now,
+			ExpiresAt:     now.Add(idempotencyLease),
+		}
+
+		existing, err := s.store.ReserveIdempotencyKey(rec)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			switch {
+			case existing.Fingerprint != rec.Fingerprint:
+				return unprocessable("idempotency key was already used for a different request")
+			case existing.StatusCode == 0:
+				return conflict("a request with this idempotency key is still in progress")
+			}
+			w.Header().Add("Content-Type", "application/json")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(existing.StatusCode)
+			_, err := w.Write(existing.Response)
+			return err
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		rw := &recordingWriter{header: make(http.Header), status: http.StatusOK}
+		if err := fn(rw, r); err != nil {
+			// nothing was committed under this key, let the client retry
+			if err := s.store.ReleaseIdempotencyKey(rec.AccountNumber, rec.Key); err != nil {
+				log.Printf("Error releasing idempotency key %q of account %d: %v", rec.Key, rec.AccountNumber, err)
+			}
+			return err
+		}
+
+		rec.StatusCode = rw.status
+		rec.Response = rw.body.Bytes()
+		rec.ExpiresAt = time.Now().UTC().Add(s.config.IdempotencyKeyTTL)
+		if err := s.store.CompleteIdempotencyKey(rec); err != nil {
+			// the request went through but cannot be replayed; free the key
+			// rather than answer every retry with "still in progress"
+			log.Printf("Error saving idempotency key %q of account %d: %v", rec.Key, rec.AccountNumber, err)
+			if err := s.store.ReleaseIdempotencyKey(rec.AccountNumber, rec.Key); err != nil {
+				log.Printf("Error releasing idempotency key %q of account %d: %v", rec.Key, rec.AccountNumber, err)
+			}
+		}
+
+		for k, v := range rw.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rw.status)
+		_, err = w.Write(rec.Response)
+		return err
+	}
+}
+
+// requestFingerprint hashes the parts of a request that must match for a
+// replay to be considered the same request. JSON bodies are canonicalised
+// first so whitespace and key order do not matter.
+func requestFingerprint(r *http.Request, body []byte) string {
+	canonical := body
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err == nil {
+		if b, err := json.Marshal(v); err == nil {
+			canonical = b
+		}
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.Path)
+	h.Write(canonical)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordingWriter buffers a handler's response so it can be stored before
+// being sent to the client.
+type recordingWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) Header() http.Header         { return rw.header }
+func (rw *recordingWriter) Write(b []byte) (int, error) { return rw.body.Write(b) }
+func (rw *recordingWriter) WriteHeader(status int)      { rw.status = status }
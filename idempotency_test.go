@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotentTransfer(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	from := newTestAccount(t, store, 1008)
+	newTestAccount(t, store, 1016)
+	store.CreateTransaction(0, 1008, "deposit", usd(10000))
+	from, _ = store.GetAccountByNumber(from.AccountNumber)
+	handler := makeHttpHandler(server.idempotent(server.handleTransfer))
+
+	send := func(amount Money) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := authedRequest("POST", "/transfer", TransferRequest{FromAccountNumber: 1008, ToAccountNumber: 1016, Amount: amount}, from)
+		r.Header.Set(idempotencyHeader, "retry-1")
+		handler(w, r)
+		return w
+	}
+
+	first := send(usd(1000))
+	assert.Equal(t, http.StatusOK, first.Code)
+	replay := send(usd(1000))
+	assert.Equal(t, http.StatusOK, replay.Code)
+	assert.Equal(t, first.Body.String(), replay.Body.String())
+	assert.Equal(t, "true", replay.Header().Get("Idempotent-Replayed"))
+
+	to, _ := store.GetAccountByNumber(1016)
+	assert.Equal(t, usd(1000), to.Balance, "replay must not move money twice")
+
+	conflict := send(usd(2000))
+	assert.Equal(t, http.StatusUnprocessableEntity, conflict.Code)
+}
+
+func TestIdempotencyKeyReleasedOnError(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	from := newTestAccount(t, store, 1008)
+	handler := makeHttpHandler(server.idempotent(server.handleTransfer))
+
+	w := httptest.NewRecorder()
+	r := authedRequest("POST", "/transfer", TransferRequest{FromAccountNumber: 1008, ToAccountNumber: 1016, Amount: usd(-1)}, from)
+	r.Header.Set(idempotencyHeader, "k")
+	handler(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, store.idempotency)
+}
+
+func TestIdempotencyKeysExpire(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	from := newTestAccount(t, store, 1008)
+	newTestAccount(t, store, 1016)
+	store.CreateTransaction(0, 1008, "deposit", usd(10000))
+	handler := makeHttpHandler(server.idempotent(server.handleTransfer))
+
+	send := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := authedRequest("POST", "/transfer", TransferRequest{FromAccountNumber: 1008, ToAccountNumber: 1016, Amount: usd(1000)}, from)
+		r.Header.Set(idempotencyHeader, "k")
+		handler(w, r)
+		return w
+	}
+
+	// a request that never finished holds its key for the lease only
+	k := idempotencyKey{1008, "k"}
+	store.idempotency[k] = &IdempotencyRecord{AccountNumber: 1008, Key: "k", Fingerprint: "other", ExpiresAt: time.Now().Add(time.Minute)}
+	assert.Equal(t, http.StatusUnprocessableEntity, send().Code)
+	store.idempotency[k].ExpiresAt = time.Now().Add(-time.Minute)
+	assert.Equal(t, http.StatusOK, send().Code)
+
+	rec := store.idempotency[k]
+	assert.Equal(t, http.StatusOK, rec.StatusCode)
+	assert.WithinDuration(t, time.Now().Add(server.config.IdempotencyKeyTTL), rec.ExpiresAt, time.Minute)
+	assert.Equal(t, "true", send().Header().Get("Idempotent-Replayed"))
+
+	// once the response expires the key is forgotten and runs again
+	rec.ExpiresAt = time.Now().Add(-time.Minute)
+	assert.Empty(t, send().Header().Get("Idempotent-Replayed"))
+	to, _ := store.GetAccountByNumber(1016)
+	assert.Equal(t, usd(2000), to.Balance)
+}
+
+// failingCompleteStore cannot save the outcome of an idempotent request.
+type failingCompleteStore struct {
+	*MemoryStore
+}
+
+func (s failingCompleteStore) CompleteIdempotencyKey(*IdempotencyRecord) error {
+	return errors.New("connection reset")
+}
+
+func TestIdempotencyKeyReleasedWhenNotSaved(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(failingCompleteStore{store})
+	from := newTestAccount(t, store, 1008)
+	newTestAccount(t, store, 1016)
+	store.CreateTransaction(0, 1008, "deposit", usd(10000))
+	handler := makeHttpHandler(server.idempotent(server.handleTransfer))
+
+	w := httptest.NewRecorder()
+	r := authedRequest("POST", "/transfer", TransferRequest{FromAccountNumber: 1008, ToAccountNumber: 1016, Amount: usd(1000)}, from)
+	r.Header.Set(idempotencyHeader, "k")
+	handler(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, store.idempotency, "a key that cannot be replayed must not block retries")
+}
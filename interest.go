@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// Account products. Savings accounts earn interest; checking accounts,
+// the default, do not.
+const (
+	ProductChecking = "checking"
+	ProductSavings  = "savings"
+)
+
+func validProduct(product string) bool {
+	return product == ProductChecking || product == ProductSavings
+}
+
+// Day-count conventions for turning the annual rate into daily interest.
+// ACT/365 counts every calendar day as 1/365 of a year; 30/360 treats every
+// month as 30 days, so in a 31-day month the 30th earns nothing, and the
+// last day of February earns for the days up to the 30th.
+const (
+	DayCountACT365 = "ACT/365"
+	DayCount30360  = "30/360"
+)
+
+// accrualDecimals is how many decimal places of a minor unit accrued
+// interest is kept to.
+const accrualDecimals = 10
+
+// SavingsConfig is the savings product: the annual rate paid on positive
+// end-of-day balances, as a fraction ("0.02" is 2%), and the day-count
+// convention.
+type SavingsConfig struct {
+	AnnualRate string `yaml:"annual_rate"`
+	DayCount   string `yaml:"day_count"`
+}
+
+func (c SavingsConfig) validate() error {
+	rate, ok := new(big.Rat).SetString(c.AnnualRate)
+	if !ok || rate.Sign() < 0 || rate.Cmp(big.NewRat(1, 1)) > 0 {
+		return fmt.Errorf("savings annual rate %q must be a decimal from 0 to 1", c.AnnualRate)
+	}
+	if c.DayCount != DayCountACT365 && c.DayCount != DayCount30360 {
+		return fmt.Errorf("savings day count must be %s or %s", DayCountACT365, DayCount30360)
+	}
+	return nil
+}
+
+// InterestState is where accrual stands for one savings account. Accrued
+// is in minor units of the account's currency and keeps fractions of them;
+// whole units are paid out monthly and the remainder carries over.
+// AccruedThrough and PaidThrough are zero until the first accrual and the
+// first payout.
+type InterestState struct {
+	AccountNumber  int
+	Accrued        string
+	AccruedThrough time.Time
+	PaidThrough    time.Time
+}
+
+// InterestAccrual is the interest one savings account earned on one day,
+// in minor units with fractions.
+type InterestAccrual struct {
+	AccountNumber int
+	Day           time.Time
+	Balance       Money
+	Rate          string
+	Amount        string
+}
+
+// startOfDay truncates t to midnight UTC.
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// days30360 counts the days from one date to another under the 30/360
+// bond basis.
+func days30360(from, to time.Time) int64 {
+	d1, d2 := from.Day(), to.Day()
+	if d1 == 31 {
+		d1 = 30
+	}
+	if d2 == 31 && d1 == 30 {
+		d2 = 30
+	}
+	return int64(360*(to.Year()-from.Year()) + 30*(int(to.Month())-int(from.Month())) + d2 - d1)
+}
+
+// yearFraction is the share of a year the given day counts for.
+func (c SavingsConfig) yearFraction(day time.Time) *big.Rat {
+	if c.DayCount == DayCount30360 {
+		return big.NewRat(days30360(day, day.AddDate(0, 0, 1)), 360)
+	}
+	return big.NewRat(1, 365)
+}
+
+// dailyInterest returns what balance earns over day, in minor units.
+// Overdrawn and empty accounts earn nothing.
+func (c SavingsConfig) dailyInterest(balance Money, day time.Time) *big.Rat {
+	if !balance.IsPositive() {
+		return new(big.Rat)
+	}
+	rate, _ := new(big.Rat).SetString(c.AnnualRate)
+	interest := new(big.Rat).Mul(rate, c.yearFraction(day))
+	return interest.Mul(interest, new(big.Rat).SetInt64(balance.Amount))
+}
+
+// interestPayout splits accrued interest into the whole minor units due
+// now and the fraction that carries over, as a decimal string.
+func interestPayout(state *InterestState, currency string) (Money, string) {
+	accrued, ok := new(big.Rat).SetString(state.Accrued)
+	if !ok || accrued.Sign() <= 0 {
+		return NewMoney(0, currency), state.Accrued
+	}
+	whole := new(big.Int).Quo(accrued.Num(), accrued.Denom())
+	rest := new(big.Rat).Sub(accrued, new(big.Rat).SetInt(whole))
+	return NewMoney(whole.Int64(), currency), formatDecimal(rest, accrualDecimals)
+}
+
+// accrueInterest accrues every savings account for each whole day before
+// now that it has not been accrued for yet, paying out a month's interest
+// once its last day is accrued. Days missed while the server was down are
+// caught up.
+func (s *Scheduler) accrueInterest(now time.Time) error {
+	accounts, err := s.store.GetAccounts()
+	if err != nil {
+		return err
+	}
+	today := startOfDay(now)
+	for _, acc := range accounts {
+		if acc.Product != ProductSavings || acc.Status == StatusClosed {
+			continue
+		}
+		if err := s.accrueAccount(acc, today); err != nil {
+			log.Printf("Error accruing interest for account %d: %v", acc.AccountNumber, err)
+		}
+	}
+	return nil
+}
+
+func (s *Scheduler) accrueAccount(acc *Account, today time.Time) error {
+	state, err := s.store.GetInterestState(acc.AccountNumber)
+	if err != nil {
+		return err
+	}
+	day := startOfDay(acc.CreatedAt)
+	if !state.AccruedThrough.IsZero() {
+		day = state.AccruedThrough.AddDate(0, 0, 1)
+
+		// a month accrued in full but not paid, because the payout failed,
+		// is paid now rather than with the next month
+		monthEnd := lastMonthEnd(state.AccruedThrough)
+		if monthEnd.After(state.PaidThrough) && !monthEnd.Before(startOfDay(acc.CreatedAt)) {
+			if err := s.payInterest(acc, monthEnd); err != nil {
+				return err
+			}
+		}
+	}
+
+	for ; day.Before(today); day = day.AddDate(0, 0, 1) {
+		end := day.AddDate(0, 0, 1)
+		balance, err := s.store.GetBalanceAt(acc.AccountNumber, end)
+		if err != nil {
+			return err
+		}
+		accrual := &InterestAccrual{
+			AccountNumber: acc.AccountNumber,
+			Day:           day,
+			Balance:       balance,
+			Rate:          s.savings.AnnualRate,
+			Amount:        formatDecimal(s.savings.dailyInterest(balance, day), accrualDecimals),
+		}
+		if err := s.store.RecordInterestAccrual(accrual); err != nil {
+			return err
+		}
+
+		// day was the last of its month
+		if end.Day() == 1 {
+			if err := s.payInterest(acc, day); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// payInterest pays out what acc accrued through the last day of a month.
+func (s *Scheduler) payInterest(acc *Account, monthEnd time.Time) error {
+	paid, err := s.store.PostInterest(acc.AccountNumber, monthEnd)
+	if err != nil {
+		return err
+	}
+	if paid.IsPositive() {
+		fmt.Printf("Paid %s interest to account %d for %s\n", paid, acc.AccountNumber, monthEnd.Format("January 2006"))
+	}
+	return nil
+}
+
+// lastMonthEnd returns day if it is the last of its month, or else the
+// last day of the month before.
+func lastMonthEnd(day time.Time) time.Time {
+	if day.AddDate(0, 0, 1).Day() == 1 {
+		return day
+	}
+	return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, -1)
+}
+
+// handleGetInterest shows how much interest a savings account has accrued
+// but not been paid yet.
+func (s *APIServer) handleGetInterest(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.accessibleAccount(r)
+	if err != nil {
+		return err
+	}
+	if account.Product != ProductSavings {
+		return notFound("account %d is not a savings account", account.AccountNumber)
+	}
+	state, err := s.store.GetInterestState(account.AccountNumber)
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, newInterestResponse(account, state, s.config.Savings))
+}
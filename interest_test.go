@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDayCountConventions(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+	assert.Equal(t, int64(0), days30360(date(2026, 1, 30), date(2026, 1, 31)))
+	assert.Equal(t, int64(1), days30360(date(2026, 1, 31), date(2026, 2, 1)))
+	assert.Equal(t, int64(3), days30360(date(2026, 2, 28), date(2026, 3, 1)))
+	assert.Equal(t, int64(2), days30360(date(2028, 2, 29), date(2028, 3, 1)))
+	assert.Equal(t, int64(1), days30360(date(2026, 12, 31), date(2027, 1, 1)))
+
+	// under 30/360 every month earns the same, however long it is
+	savings := SavingsConfig{AnnualRate: "0.036", DayCount: DayCount30360}
+	for _, month := range []time.Month{time.January, time.February, time.April} {
+		total := new(big.Rat)
+		for day := date(2026, month, 1); day.Month() == month; day = day.AddDate(0, 0, 1) {
+			total.Add(total, savings.dailyInterest(usd(100000), day))
+		}
+		assert.Equal(t, big.NewRat(300, 1), total, month.String())
+	}
+
+	// ACT/365 pays the same for every day, and nothing on an overdraft
+	savings = SavingsConfig{AnnualRate: "0.0365", DayCount: DayCountACT365}
+	assert.Equal(t, big.NewRat(1000, 1), savings.dailyInterest(usd(10000000), date(2026, 1, 31)))
+	assert.Equal(t, 0, savings.dailyInterest(usd(-5000), date(2026, 2, 1)).Sign())
+}
+
+func TestInterestAccrual(t *testing.T) {
+	store := NewMemoryStore()
+	savings := newTestAccount(t, store, 1008)
+	checking := newTestAccount(t, store, 1016)
+	store.accounts[savings.ID].Product = ProductSavings
+	_, err := store.CreateTransaction(0, 1008, "deposit", usd(10000000))
+	assert.Nil(t, err)
+	_, err = store.CreateTransaction(0, 1016, "deposit", usd(10000000))
+	assert.Nil(t, err)
+
+	// 100,000.00 at 3.65% earns exactly 10.00 a day
+	scheduler := newScheduler(store, SchedulerConfig{}, SavingsConfig{AnnualRate: "0.0365", DayCount: DayCountACT365})
+
+	// accrue through the end of this month and one day into the next
+	today := startOfDay(time.Now())
+	nextMonth := time.Date(today.Year(), today.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	days := int64(nextMonth.Sub(today) / (24 * time.Hour))
+	now := nextMonth.AddDate(0, 0, 1).Add(time.Hour)
+	assert.Nil(t, scheduler.accrueInterest(now))
+	assert.Nil(t, scheduler.accrueInterest(now))
+
+	paid, err := store.GetTransactions(1008, TransactionFilter{Types: []string{"interest"}})
+	assert.Nil(t, err)
+	assert.Len(t, paid, 1)
+	assert.Equal(t, usd(days*1000), paid[0].Amount)
+	assert.Equal(t, "in", paid[0].Direction)
+
+	// the first of the month earns on the interest just paid as well
+	state, err := store.GetInterestState(1008)
+	assert.Nil(t, err)
+	assert.Equal(t, nextMonth, state.AccruedThrough)
+	assert.Equal(t, nextMonth.AddDate(0, 0, -1), state.PaidThrough)
+	assert.Equal(t, formatDecimal(big.NewRat(10000+days, 10), accrualDecimals), state.Accrued)
+
+	unpaid, err := store.GetTransactions(1016, TransactionFilter{Types: []string{"interest"}})
+	assert.Nil(t, err)
+	assert.Empty(t, unpaid)
+	expense, err := store.GetLedgerBalance(LedgerInterestExpense, DefaultCurrency)
+	assert.Nil(t, err)
+	assert.Equal(t, usd(-days*1000), expense)
+	mismatches, err := store.ReconcileBalances()
+	assert.Nil(t, err)
+	assert.Empty(t, mismatches)
+
+	server := newTestServer(store)
+	token := login(t, server, 1008, "password").Token
+	w := doRequest(server, "GET", "/account/"+strconv.Itoa(savings.ID)+"/interest", token, nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp InterestResponse
+	assert.Nil(t, jsonDecode(w, &resp))
+	assert.Equal(t, formatDecimal(big.NewRat(10000+days, 1000), accrualDecimals+2), resp.Accrued)
+
+	token = login(t, server, 1016, "password").Token
+	w = doRequest(server, "GET", "/account/"+strconv.Itoa(checking.ID)+"/interest", token, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestCreateSavingsAccount(t *testing.T) {
+	server := newTestServer(NewMemoryStore())
+	req := CreateAccountRequest{FirstName: "Jane", LastName: "Doe", Password: "s3cret-pass", Product: "bond"}
+	assert.Equal(t, http.StatusBadRequest, doRequest(server, "POST", "/account", "", req).Code)
+
+	req.Product = "Savings"
+	w := doRequest(server, "POST", "/account", "", req)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var created AccountResponse
+	assert.Nil(t, jsonDecode(w, &created))
+	assert.Equal(t, ProductSavings, created.Product)
+}
+
+// failingPayoutStore cannot post interest while fail is set.
+type failingPayoutStore struct {
+	*MemoryStore
+	fail bool
+}
+
+func (s *failingPayoutStore) PostInterest(accountNumber int, through time.Time) (Money, error) {
+	if s.fail {
+		return Money{}, errors.New("connection reset")
+	}
+	return s.MemoryStore.PostInterest(accountNumber, through)
+}
+
+func TestFailedInterestPayoutRetried(t *testing.T) {
+	store := &failingPayoutStore{MemoryStore: NewMemoryStore(), fail: true}
+	savings := newTestAccount(t, store, 1008)
+	store.accounts[savings.ID].Product = ProductSavings
+	_, err := store.CreateTransaction(0, 1008, "deposit", usd(10000000))
+	assert.Nil(t, err)
+	scheduler := newScheduler(store, SchedulerConfig{}, SavingsConfig{AnnualRate: "0.0365", DayCount: DayCountACT365})
+
+	// the month end accrues but its payout fails
+	today := startOfDay(time.Now())
+	nextMonth := time.Date(today.Year(), today.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Nil(t, scheduler.accrueInterest(nextMonth.Add(time.Hour)))
+	state, err := store.GetInterestState(1008)
+	assert.Nil(t, err)
+	assert.Equal(t, nextMonth.AddDate(0, 0, -1), state.AccruedThrough)
+	assert.True(t, state.PaidThrough.IsZero())
+
+	// the next pass pays it without waiting for the following month end
+	store.fail = false
+	assert.Nil(t, scheduler.accrueInterest(nextMonth.Add(2*time.Hour)))
+	paid, err := store.GetTransactions(1008, TransactionFilter{Types: []string{"interest"}})
+	assert.Nil(t, err)
+	assert.Len(t, paid, 1)
+	state, err = store.GetInterestState(1008)
+	assert.Nil(t, err)
+	assert.Equal(t, nextMonth.AddDate(0, 0, -1), state.PaidThrough)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LedgerAccount names an account in the general ledger. Customer accounts are
+// "customer:<accountnumber>", everything else is a system account that only
+// exists in the ledger.
+type LedgerAccount string
+
+const (
+	LedgerCashIn         LedgerAccount = "system:cash_in"
+	LedgerCashOut        LedgerAccount = "system:cash_out"
+	LedgerOpeningBalance LedgerAccount = "system:opening_balance"
+	LedgerAdjustments    LedgerAccount = "system:adjustments"
+	LedgerFeeIncome      LedgerAccount = "system:fee_income"
+	// LedgerFXPosition takes the other side of both legs of a currency
+	// exchange, so its balance per currency is the bank's FX position.
+	LedgerFXPosition LedgerAccount = "system:fx_position"
+	// LedgerInterestExpense pays the interest earned by savings accounts.
+	LedgerInterestExpense LedgerAccount = "system:interest_expense"
+)
+
+func customerLedgerAccount(accountNumber int) LedgerAccount {
+	return LedgerAccount("customer:" + strconv.Itoa(accountNumber))
+}
+
+// customerNumber returns the account number behind a customer ledger account.
+func (a LedgerAccount) customerNumber() (int, bool) {
+	rest, ok := strings.CutPrefix(string(a), "customer:")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(rest)
+	return n, err == nil
+}
+
+func (a LedgerAccount) valid() bool {
+	if _, ok := a.customerNumber(); ok {
+		return true
+	}
+	rest, ok := strings.CutPrefix(string(a), "system:")
+	return ok && rest != "" && len(a) <= 64
+}
+
+type PostingSide string
+
+const (
+	Debit  PostingSide = "debit"
+	Credit PostingSide = "credit"
+)
+
+// Posting is one leg of a journal entry. Amount is always positive; Side
+// says which way it moves. Ledger balances are credits minus debits, so
+// customer accounts read positive and the whole ledger always sums to zero.
+type Posting struct {
+	Account LedgerAccount `json:"account"`
+	Side    PostingSide   `json:"side"`
+	Amount  Money         `json:"amount"`
+}
+
+func (p Posting) signed() int64 {
+	if p.Side == Debit {
+		return -p.Amount.Amount
+	}
+	return p.Amount.Amount
+}
+
+// JournalEntry is a set of postings that must balance: per currency, the
+// debits equal the credits. TransactionID links the entry to the row in
+// transactions it was created for, if any.
+type JournalEntry struct {
+	ID            int       `json:"id"`
+	TransactionID int       `json:"transactionId,omitempty"`
+	Description   string    `json:"description"`
+	CreatedAt     time.Time `json:"createdAt"`
+	Postings      []Posting `json:"postings"`
+}
+
+// BalanceMismatch reports a customer account whose stored balance disagrees
+// with the sum of its ledger postings.
+type BalanceMismatch struct {
+	AccountNumber int   `json:"accountnumber"`
+	Balance       Money `json:"balance"`
+	Ledger        Money `json:"ledger"`
+}
+
+func (e *JournalEntry) validate() error {
+	if len(e.Postings) < 2 {
+		return invalidf("journal entry needs at least two postings")
+	}
+
+	net := map[string]int64{}
+	for _, p := range e.Postings {
+		if !p.Account.valid() {
+			return invalidf("invalid ledger account %q", p.Account)
+		}
+		if p.Side != Debit && p.Side != Credit {
+			return invalidf("invalid posting side %q", p.Side)
+		}
+		if !p.Amount.IsPositive() {
+			return invalidf("posting amounts must be positive")
+		}
+		if _, err := currencyExponent(p.Amount.Currency); err != nil {
+			return err
+		}
+		net[p.Amount.Currency] += p.signed()
+	}
+	for currency, sum := range net {
+		if sum != 0 {
+			return invalidf("journal entry does not balance in %s", currency)
+		}
+	}
+	return nil
+}
+
+// customerChanges sums the postings per customer account, returning the net
+// change each balance must undergo and the account numbers in ascending
+// order (the order locks must be taken in).
+func (e *JournalEntry) customerChanges() (map[int]Money, []int) {
+	changes := map[int]Money{}
+	for _, p := range e.Postings {
+		n, ok := p.Account.customerNumber()
+		if !ok {
+			continue
+		}
+		c := changes[n]
+		c.Currency = p.Amount.Currency
+		c.Amount += p.signed()
+		changes[n] = c
+	}
+
+	numbers := make([]int, 0, len(changes))
+	for n := range changes {
+		numbers = append(numbers, n)
+	}
+	slices.Sort(numbers)
+	return changes, numbers
+}
+
+// checkEntries checks entries one after the other against the accounts
+// they touch, each change as checkBalanceChange does, and returns the
+// balances the accounts end up with. accounts must hold every customer
+// account in the entries.
+func checkEntries(accounts map[int]*Account, entries ...*JournalEntry) (map[int]Money, error) {
+	updated := map[int]Money{}
+	for _, entry := range entries {
+		changes, numbers := entry.customerChanges()
+		for _, n := range numbers {
+			acc, ok := accounts[n]
+			if !ok {
+				return nil, notFoundf("Account with number %d not found", n)
+			}
+			current := *acc
+			if balance, ok := updated[n]; ok {
+				current.Balance = balance
+			}
+			balance, err := checkBalanceChange(&current, changes[n])
+			if err != nil {
+				return nil, err
+			}
+			updated[n] = balance
+		}
+	}
+	return updated, nil
+}
+
+// checkBalanceChange verifies that applying change to acc is allowed and
+// returns the resulting balance: currencies must match, the account's
+// lifecycle state must allow money to move in that direction and the result
+// may not go below the account's overdraft limit when money is being taken
+// out.
+func checkBalanceChange(acc *Account, change Money) (Money, error) {
+	if !acc.Balance.SameCurrency(change) {
+		return Money{}, &CurrencyMismatchError{AccountNumber: acc.AccountNumber, AccountCurrency: acc.Balance.Currency, Currency: change.Currency}
+	}
+	if change.IsNegative() && !canSend(acc.Status) {
+		return Money{}, forbiddenf("account %d is %s and cannot send money", acc.AccountNumber, acc.Status)
+	}
+	if change.IsPositive() && !canReceive(acc.Status) {
+		return Money{}, forbiddenf("account %d is %s and cannot receive money", acc.AccountNumber, acc.Status)
+	}
+	updated, err := acc.Balance.Add(change)
+	if err != nil {
+		return Money{}, err
+	}
+	if change.IsNegative() && updated.Amount < -acc.OverdraftLimit.Amount {
+		return Money{}, &InsufficientFundsError{AccountNumber: acc.AccountNumber, Balance: acc.Balance, Requested: change.Neg()}
+	}
+	return updated, nil
+}
+
+// creditTransaction reports whether a transaction type only pays into
+// ToAccount, with no customer account on the sending side.
+func creditTransaction(transactionType string) bool {
+	return transactionType == "deposit" || transactionType == "interest"
+}
+
+// transactionEntry builds the journal entry backing a deposit, withdraw,
+// transfer, fee or interest payment created through CreateTransaction.
+func transactionEntry(fromAccount, toAccount int, transactionType string, amount Money) (*JournalEntry, error) {
+	var debit, credit LedgerAccount
+	switch transactionType {
+	case "deposit":
+		debit, credit = LedgerCashIn, customerLedgerAccount(toAccount)
+	case "withdraw":
+		debit, credit = customerLedgerAccount(fromAccount), LedgerCashOut
+	case "transfer":
+		if fromAccount == toAccount {
+			return nil, invalidf("cannot transfer to the same account")
+		}
+		debit, credit = customerLedgerAccount(fromAccount), customerLedgerAccount(toAccount)
+	case "fee":
+		debit, credit = customerLedgerAccount(fromAccount), LedgerFeeIncome
+	case "interest":
+		debit, credit = LedgerInterestExpense, customerLedgerAccount(toAccount)
+	default:
+		return nil, invalidf("invalid transaction type %s", transactionType)
+	}
+
+	return &JournalEntry{
+		Description: transactionType,
+		Postings: []Posting{
+			{Account: debit, Side: Debit, Amount: amount},
+			{Account: credit, Side: Credit, Amount: amount},
+		},
+	}, nil
+}
+
+// exchangeEntry builds the journal entry of a transfer across currencies:
+// debit leaves fromAccount and credit reaches toAccount, each leg balanced
+// against the FX position in its own currency.
+func exchangeEntry(fromAccount, toAccount int, debit, credit Money) (*JournalEntry, error) {
+	if !debit.IsPositive() || !credit.IsPositive() {
+		return nil, invalidf("transaction amount must be positive")
+	}
+	if debit.SameCurrency(credit) {
+		return nil, invalidf("an exchange needs two different currencies")
+	}
+	if fromAccount == toAccount {
+		return nil, invalidf("cannot transfer to the same account")
+	}
+	return &JournalEntry{
+		Description: "transfer " + debit.Currency + "/" + credit.Currency,
+		Postings: []Posting{
+			{Account: customerLedgerAccount(fromAccount), Side: Debit, Amount: debit},
+			{Account: LedgerFXPosition, Side: Credit, Amount: debit},
+			{Account: LedgerFXPosition, Side: Debit, Amount: credit},
+			{Account: customerLedgerAccount(toAccount), Side: Credit, Amount: credit},
+		},
+	}, nil
+}
+
+// balancingEntry moves change into (or, when negative, out of) a customer
+// account against the given system account.
+func balancingEntry(description string, counter LedgerAccount, accountNumber int, change Money) *JournalEntry {
+	debit, credit := counter, customerLedgerAccount(accountNumber)
+	if change.IsNegative() {
+		debit, credit = credit, debit
+		change = change.Neg()
+	}
+	return &JournalEntry{
+		Description: description,
+		Postings: []Posting{
+			{Account: debit, Side: Debit, Amount: change},
+			{Account: credit, Side: Credit, Amount: change},
+		},
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalEntryValidate(t *testing.T) {
+	unbalanced := &JournalEntry{Postings: []Posting{
+		{Account: LedgerCashIn, Side: Debit, Amount: usd(100)},
+		{Account: customerLedgerAccount(1), Side: Credit, Amount: usd(90)},
+	}}
+	assert.NotNil(t, unbalanced.validate())
+
+	mixedCurrency := &JournalEntry{Postings: []Posting{
+		{Account: LedgerCashIn, Side: Debit, Amount: usd(100)},
+		{Account: customerLedgerAccount(1), Side: Credit, Amount: NewMoney(100, "EUR")},
+	}}
+	assert.NotNil(t, mixedCurrency.validate())
+
+	badAccount := &JournalEntry{Postings: []Posting{
+		{Account: "cash", Side: Debit, Amount: usd(100)},
+		{Account: customerLedgerAccount(1), Side: Credit, Amount: usd(100)},
+	}}
+	assert.NotNil(t, badAccount.validate())
+}
+
+func TestLedgerStaysReconciled(t *testing.T) {
+	s := NewMemoryStore()
+	newTestAccount(t, s, 1001)
+	newTestAccount(t, s, 1002)
+	newTestAccount(t, s, 1003)
+
+	_, err := s.CreateTransaction(0, 1001, "deposit", usd(10000))
+	assert.Nil(t, err)
+	_, err = s.CreateTransaction(1001, 1002, "transfer", usd(3000))
+	assert.Nil(t, err)
+	_, err = s.CreateTransaction(1002, 0, "withdraw", usd(500))
+	assert.Nil(t, err)
+
+	// split one payment across two payees in a single entry
+	err = s.PostJournalEntry(&JournalEntry{Description: "split", Postings: []Posting{
+		{Account: customerLedgerAccount(1001), Side: Debit, Amount: usd(1500)},
+		{Account: customerLedgerAccount(1002), Side: Credit, Amount: usd(1000)},
+		{Account: customerLedgerAccount(1003), Side: Credit, Amount: usd(500)},
+	}})
+	assert.Nil(t, err)
+
+	// an entry overdrawing one leg is rejected as a whole
+	err = s.PostJournalEntry(&JournalEntry{Postings: []Posting{
+		{Account: customerLedgerAccount(1003), Side: Debit, Amount: usd(10000)},
+		{Account: customerLedgerAccount(1002), Side: Credit, Amount: usd(10000)},
+	}})
+	var insufficient *InsufficientFundsError
+	assert.True(t, errors.As(err, &insufficient))
+
+	_, err = s.UpdateAccountBalance(1003, usd(700))
+	assert.Nil(t, err)
+
+	mismatches, err := s.ReconcileBalances()
+	assert.Nil(t, err)
+	assert.Empty(t, mismatches)
+
+	total := int64(0)
+	for _, a := range []LedgerAccount{LedgerCashIn, LedgerCashOut, LedgerAdjustments,
+		customerLedgerAccount(1001), customerLedgerAccount(1002), customerLedgerAccount(1003)} {
+		b, err := s.GetLedgerBalance(a, "USD")
+		assert.Nil(t, err)
+		total += b.Amount
+	}
+	assert.Zero(t, total, "the ledger as a whole must always sum to zero")
+
+	acc, _ := s.GetAccountByNumber(1002)
+	assert.Equal(t, usd(3500), acc.Balance)
+	cashIn, _ := s.GetLedgerBalance(LedgerCashIn, "USD")
+	assert.Equal(t, usd(-10000), cashIn)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// Account lifecycle states. New accounts start out active; pending is for
+// accounts that still need to be activated by an admin.
+const (
+	StatusPending = "pending"
+	StatusActive  = "active"
+	StatusFrozen  = "frozen"
+	StatusDormant = "dormant"
+	StatusClosed  = "closed"
+)
+
+// statusTransitions lists the states each state may move to. Closed is
+// final: closed accounts are kept for their history but never reopened.
+var statusTransitions = map[string][]string{
+	StatusPending: {StatusActive, StatusClosed},
+	StatusActive:  {StatusFrozen, StatusDormant, StatusClosed},
+	StatusFrozen:  {StatusActive, StatusClosed},
+	StatusDormant: {StatusActive, StatusFrozen, StatusClosed},
+	StatusClosed:  nil,
+}
+
+func validStatus(status string) bool {
+	_, ok := statusTransitions[status]
+	return ok
+}
+
+// canSend reports whether money may leave an account in this state.
+func canSend(status string) bool {
+	return status == StatusActive
+}
+
+// canReceive reports whether money may enter an account in this state.
+func canReceive(status string) bool {
+	return status != StatusClosed
+}
+
+// checkStatusTransition verifies that acc may move to status. Storage calls
+// it with the account row locked. An account must be empty to be closed.
+func checkStatusTransition(acc *Account, status string) error {
+	if acc.Status == status {
+		return nil
+	}
+	if !slices.Contains(statusTransitions[acc.Status], status) {
+		return conflictf("account %d cannot go from %s to %s", acc.AccountNumber, acc.Status, status)
+	}
+	if status == StatusClosed && !acc.Balance.IsZero() {
+		return conflictf("account %d still holds %s, it must be empty before it can be closed", acc.AccountNumber, acc.Balance)
+	}
+	return nil
+}
+
+func (s *APIServer) handleSetAccountStatus(w http.ResponseWriter, r *http.Request) error {
+	req := new(SetStatusRequest)
+	if err := decodeJSON(r, req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if !validStatus(req.Status) {
+		return fieldError("status", "must be one of pending, active, frozen, dormant or closed")
+	}
+	return s.setAccountStatus(w, r, req.Status)
+}
+
+func (s *APIServer) handleFreezeAccount(w http.ResponseWriter, r *http.Request) error {
+	return s.setAccountStatus(w, r, StatusFrozen)
+}
+
+func (s *APIServer) handleUnfreezeAccount(w http.ResponseWriter, r *http.Request) error {
+	return s.setAccountStatus(w, r, StatusActive)
+}
+
+// handleCloseAccount soft-closes an account. Owners can close their own
+// account, admins any account; either way it has to be empty.
+func (s *APIServer) handleCloseAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := accountID(r)
+	if err != nil {
+		return err
+	}
+	account := r.Context().Value("account").(*Account)
+	if account.ID != id && !account.Role.Can(PermCloseAccount) {
+		return forbidden("You can only close your own account")
+	}
+	return s.setAccountStatus(w, r, StatusClosed)
+}
+
+func (s *APIServer) setAccountStatus(w http.ResponseWriter, r *http.Request, status string) error {
+	id, err := accountID(r)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Setting status of account %d to %s\n", id, status)
+
+	if err := s.store.SetAccountStatus(id, status); err != nil {
+		return err
+	}
+	account, err := s.store.GetAccountById(id)
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, newAccountResponse(account))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckStatusTransition(t *testing.T) {
+	acc := &Account{AccountNumber: 1008, Status: StatusActive, Balance: usd(0)}
+	assert.Nil(t, checkStatusTransition(acc, StatusDormant))
+	assert.Nil(t, checkStatusTransition(acc, StatusActive))
+
+	acc.Status = StatusPending
+	assert.ErrorIs(t, checkStatusTransition(acc, StatusFrozen), ErrConflict)
+
+	acc.Status = StatusClosed
+	assert.ErrorIs(t, checkStatusTransition(acc, StatusActive), ErrConflict)
+
+	acc.Status = StatusActive
+	acc.Balance = usd(1)
+	assert.ErrorIs(t, checkStatusTransition(acc, StatusClosed), ErrConflict)
+}
+
+func TestLifecycleRestrictsMoneyMovement(t *testing.T) {
+	s := NewMemoryStore()
+	from := newTestAccount(t, s, 1008)
+	to := newTestAccount(t, s, 1016)
+	_, err := s.CreateTransaction(0, 1008, "deposit", usd(1000))
+	assert.Nil(t, err)
+
+	for _, status := range []string{StatusFrozen, StatusDormant} {
+		assert.Nil(t, s.SetAccountStatus(from.ID, status))
+		_, err = s.CreateTransaction(1008, 1016, "transfer", usd(100))
+		assert.ErrorIs(t, err, ErrForbidden, status)
+		_, err = s.CreateTransaction(0, 1008, "deposit", usd(100))
+		assert.Nil(t, err, status)
+		assert.Nil(t, s.SetAccountStatus(from.ID, StatusActive))
+	}
+
+	assert.Nil(t, s.SetAccountStatus(to.ID, StatusClosed))
+	_, err = s.CreateTransaction(1008, 1016, "transfer", usd(100))
+	assert.ErrorIs(t, err, ErrForbidden)
+	acc, _ := s.GetAccountByNumber(1008)
+	assert.Equal(t, usd(1200), acc.Balance)
+}
+
+func TestCloseAccountKeepsHistory(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	acc := newTestAccount(t, store, 1008)
+	newTestAccount(t, store, 1016)
+	store.CreateTransaction(0, 1008, "deposit", usd(500))
+	token := login(t, server, 1008, "password").Token
+	accountPath := "/account/" + strconv.Itoa(acc.ID)
+
+	w := doRequest(server, "DELETE", "/account/2", token, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = doRequest(server, "DELETE", accountPath, token, nil)
+	assert.Equal(t, http.StatusConflict, w.Code, "accounts holding money cannot be closed")
+
+	w = doRequest(server, "POST", "/transfer", token, TransferRequest{FromAccountNumber: 1008, ToAccountNumber: 1016, Amount: usd(500)})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = doRequest(server, "DELETE", accountPath, token, nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var closed AccountResponse
+	assert.Nil(t, jsonDecode(w, &closed))
+	assert.Equal(t, StatusClosed, closed.Status)
+	assert.NotNil(t, closed.ClosedAt)
+
+	// the history survives and the account can no longer sign in
+	txs, err := store.GetTransactions(1016, TransactionFilter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1008, txs[0].FromAccount)
+	assert.Equal(t, http.StatusUnauthorized, doRequest(server, "GET", accountPath, token, nil).Code)
+	w = doRequest(server, "POST", "/login", "", LoginRequest{AccountNumber: 1008, Password: "password"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Rolling windows the daily and monthly limits are measured over.
+const (
+	dailyLimitWindow   = 24 * time.Hour
+	monthlyLimitWindow = 30 * 24 * time.Hour
+)
+
+// Names of the individual limits, as reported in LimitExceededError.
+const (
+	LimitSingle  = "single"
+	LimitDaily   = "daily"
+	LimitMonthly = "monthly"
+)
+
+// AccountLimits caps how much an account can send through withdrawals and
+// transfers. A zero amount means no limit. All three amounts share one
+// currency; accounts held in another are held to the same limits converted
+// at the mid rate.
+type AccountLimits struct {
+	SingleMax  Money `yaml:"single_max"`
+	DailyMax   Money `yaml:"daily_max"`
+	MonthlyMax Money `yaml:"monthly_max"`
+}
+
+func (l AccountLimits) currency() string { return l.SingleMax.Currency }
+
+// in returns the limits converted into currency. Without a rate the
+// account cannot be checked, so sending from it is refused instead of left
+// unlimited.
+func (l AccountLimits) in(currency string, rates []*FXRate) (AccountLimits, error) {
+	var converted AccountLimits
+	for _, c := range []struct{ from, to *Money }{
+		{&l.SingleMax, &converted.SingleMax},
+		{&l.DailyMax, &converted.DailyMax},
+		{&l.MonthlyMax, &converted.MonthlyMax},
+	} {
+		m, err := convertMid(rates, *c.from, currency)
+		if err != nil {
+			return AccountLimits{}, conflictf("limits are set in %s and there is no exchange rate to apply them in %s", l.currency(), currency)
+		}
+		*c.to = m
+	}
+	return converted, nil
+}
+
+func (l AccountLimits) validate() error {
+	for _, m := range []Money{l.SingleMax, l.DailyMax, l.MonthlyMax} {
+		if m.IsNegative() {
+			return fmt.Errorf("limits must not be negative")
+		}
+		if m.Currency != l.currency() {
+			return fmt.Errorf("limits must all be in the same currency")
+		}
+	}
+	return nil
+}
+
+// DebitTotals is what an account has sent over the rolling windows.
+type DebitTotals struct {
+	Daily   Money
+	Monthly Money
+}
+
+// limitedTransaction reports whether a transaction type counts against the
+// limits. Deposits never do.
+func limitedTransaction(transactionType string) bool {
+	return transactionType == "withdraw" || transactionType == "transfer"
+}
+
+// LimitExceededError is returned by CreateTransaction when the amount would
+// break one of the source account's limits.
+type LimitExceededError struct {
+	AccountNumber int
+	Limit         string
+	Max           Money
+	Remaining     Money
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("account %d would exceed its %s limit of %s", e.AccountNumber, e.Limit, e.Max)
+}
+
+// remaining returns what is left of max after used, never less than zero.
+func remaining(max, used Money) Money {
+	if used.Amount >= max.Amount {
+		return NewMoney(0, max.Currency)
+	}
+	return NewMoney(max.Amount-used.Amount, max.Currency)
+}
+
+// check rejects sending amount from an account that has already sent
+// totals within the windows. The limits must already be in the amount's
+// currency.
+func (l AccountLimits) check(accountNumber int, amount Money, totals DebitTotals) error {
+	if amount.Currency != l.currency() {
+		return conflictf("limits in %s cannot be applied to %s", l.currency(), amount.Currency)
+	}
+	if !l.SingleMax.IsZero() && amount.Amount > l.SingleMax.Amount {
+		return &LimitExceededError{AccountNumber: accountNumber, Limit: LimitSingle, Max: l.SingleMax, Remaining: l.SingleMax}
+	}
+	windows := []struct {
+		name      string
+		max, used Money
+	}{
+		{LimitDaily, l.DailyMax, totals.Daily},
+		{LimitMonthly, l.MonthlyMax, totals.Monthly},
+	}
+	for _, w := range windows {
+		if w.max.IsZero() {
+			continue
+		}
+		if left := remaining(w.max, w.used); amount.Amount > left.Amount {
+			return &LimitExceededError{AccountNumber: accountNumber, Limit: w.name, Max: w.max, Remaining: left}
+		}
+	}
+	return nil
+}
+
+// handleGetLimits shows an account's limits and how much of the daily and
+// monthly allowance is left.
+func (s *APIServer) handleGetLimits(w http.ResponseWriter, r *http.Request) error {
+	id, err := accountID(r)
+	if err != nil {
+		return err
+	}
+	account := r.Context().Value("account").(*Account)
+	if !canAccess(account, id) {
+		return forbidden("You are not allowed to access this account")
+	}
+	if account.ID != id {
+		if account, err = s.store.GetAccountById(id); err != nil {
+			return err
+		}
+	}
+
+	return s.writeLimits(w, account)
+}
+
+// handleSetLimits lets an admin override the configured limits for one
+// account.
+func (s *APIServer) handleSetLimits(w http.ResponseWriter, r *http.Request) error {
+	id, err := accountID(r)
+	if err != nil {
+		return err
+	}
+	req := new(SetLimitsRequest)
+	if err := decodeJSON(r, req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	account, err := s.store.GetAccountById(id)
+	if err != nil {
+		return err
+	}
+	// bare amounts are in the account's currency
+	for _, m := range []*Money{req.SingleMax, req.DailyMax, req.MonthlyMax} {
+		if m == nil {
+			continue
+		}
+		if *m, err = m.inCurrency(account.Balance.Currency); err != nil {
+			return badRequest("%v", err)
+		}
+	}
+	if err := req.validate(); err != nil {
+		return err
+	}
+	limits := AccountLimits{SingleMax: *req.SingleMax, DailyMax: *req.DailyMax, MonthlyMax: *req.MonthlyMax}
+	if err := s.store.SetAccountLimits(account.AccountNumber, limits); err != nil {
+		return err
+	}
+	fmt.Printf("Set limits of account %d to %s single, %s daily, %s monthly\n",
+		account.AccountNumber, limits.SingleMax, limits.DailyMax, limits.MonthlyMax)
+
+	return s.writeLimits(w, account)
+}
+
+// handleResetLimits drops an account's override so the configured limits
+// apply again.
+func (s *APIServer) handleResetLimits(w http.ResponseWriter, r *http.Request) error {
+	id, err := accountID(r)
+	if err != nil {
+		return err
+	}
+	account, err := s.store.GetAccountById(id)
+	if err != nil {
+		return err
+	}
+	if err := s.store.ClearAccountLimits(account.AccountNumber); err != nil {
+		return err
+	}
+	fmt.Printf("Reset limits of account %d\n", account.AccountNumber)
+
+	return s.writeLimits(w, account)
+}
+
+// writeLimits shows the limits in the account's currency.
+func (s *APIServer) writeLimits(w http.ResponseWriter, account *Account) error {
+	limits, custom, err := s.store.GetAccountLimits(account.AccountNumber)
+	if err != nil {
+		return err
+	}
+	rates, err := s.store.GetFXRates()
+	if err != nil {
+		return err
+	}
+	if limits, err = limits.in(account.Balance.Currency, rates); err != nil {
+		return err
+	}
+	totals, err := s.store.GetDebitTotals(account.AccountNumber, limits.currency())
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, newLimitsResponse(limits, totals, custom))
+}
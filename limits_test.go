@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountLimitsCheck(t *testing.T) {
+	limits := AccountLimits{SingleMax: usd(5000), DailyMax: usd(8000), MonthlyMax: usd(0)}
+	totals := DebitTotals{Daily: usd(4000), Monthly: usd(100000)}
+
+	assert.Nil(t, limits.check(1008, usd(4000), totals))
+
+	var overLimit *LimitExceededError
+	err := limits.check(1008, usd(5001), DebitTotals{Daily: usd(0)})
+	assert.True(t, errors.As(err, &overLimit))
+	assert.Equal(t, LimitSingle, overLimit.Limit)
+
+	err = limits.check(1008, usd(4001), totals)
+	assert.True(t, errors.As(err, &overLimit))
+	assert.Equal(t, LimitDaily, overLimit.Limit)
+	assert.Equal(t, usd(4000), overLimit.Remaining)
+
+	// other currencies are held to the converted limits, and refused
+	// without a rate
+	_, err = limits.in("EUR", nil)
+	assert.True(t, errors.Is(err, ErrConflict))
+	rates := []*FXRate{{Base: "EUR", Quote: "USD", Rate: "1.25"}}
+	eur, err := limits.in("EUR", rates)
+	assert.Nil(t, err)
+	assert.Equal(t, AccountLimits{SingleMax: NewMoney(4000, "EUR"), DailyMax: NewMoney(6400, "EUR"), MonthlyMax: NewMoney(0, "EUR")}, eur)
+	err = eur.check(1008, NewMoney(4001, "EUR"), DebitTotals{Daily: NewMoney(0, "EUR")})
+	assert.True(t, errors.As(err, &overLimit))
+	assert.True(t, errors.Is(limits.check(1008, NewMoney(1, "EUR"), totals), ErrConflict))
+}
+
+func TestCreateTransactionEnforcesLimits(t *testing.T) {
+	store := NewMemoryStore()
+	store.SetDefaultLimits(AccountLimits{SingleMax: usd(5000), DailyMax: usd(8000), MonthlyMax: usd(20000)})
+	newTestAccount(t, store, 1008)
+	newTestAccount(t, store, 1016)
+	_, err := store.CreateTransaction(0, 1008, "deposit", usd(50000))
+	assert.Nil(t, err)
+
+	_, err = store.CreateTransaction(1008, 0, "withdraw", usd(5000))
+	assert.Nil(t, err)
+	_, err = store.CreateTransaction(1008, 1016, "transfer", usd(3000))
+	assert.Nil(t, err)
+
+	var overLimit *LimitExceededError
+	_, err = store.CreateTransaction(1008, 1016, "transfer", usd(1))
+	assert.True(t, errors.As(err, &overLimit))
+	assert.Equal(t, LimitDaily, overLimit.Limit)
+
+	// deposits and money received never count
+	_, err = store.CreateTransaction(1016, 1008, "transfer", usd(3000))
+	assert.Nil(t, err)
+	totals, err := store.GetDebitTotals(1008, DefaultCurrency)
+	assert.Nil(t, err)
+	assert.Equal(t, usd(8000), totals.Daily)
+
+	assert.Nil(t, store.SetAccountLimits(1008, AccountLimits{SingleMax: usd(0), DailyMax: usd(0), MonthlyMax: usd(0)}))
+	_, err = store.CreateTransaction(1008, 0, "withdraw", usd(20000))
+	assert.Nil(t, err)
+}
+
+func TestLimitsApplyInOtherCurrencies(t *testing.T) {
+	store := NewMemoryStore()
+	store.SetDefaultLimits(AccountLimits{SingleMax: usd(5000), DailyMax: usd(8000), MonthlyMax: usd(20000)})
+	acc := newTestAccount(t, store, 1008)
+	store.accounts[acc.ID].Balance = NewMoney(0, "EUR")
+	_, err := store.CreateTransaction(0, 1008, "deposit", NewMoney(90000000, "EUR"))
+	assert.Nil(t, err)
+
+	// without a rate nothing can be sent rather than everything
+	_, err = store.CreateTransaction(1008, 0, "withdraw", NewMoney(100, "EUR"))
+	assert.True(t, errors.Is(err, ErrConflict))
+
+	assert.Nil(t, store.SetFXRates([]*FXRate{{Base: "EUR", Quote: "USD", Rate: "1.25"}}))
+	var overLimit *LimitExceededError
+	_, err = store.CreateTransaction(1008, 0, "withdraw", NewMoney(90000000, "EUR"))
+	assert.True(t, errors.As(err, &overLimit))
+	assert.Equal(t, NewMoney(4000, "EUR"), overLimit.Max)
+	_, err = store.CreateTransaction(1008, 0, "withdraw", NewMoney(4000, "EUR"))
+	assert.Nil(t, err)
+	_, err = store.CreateTransaction(1008, 0, "withdraw", NewMoney(2401, "EUR"))
+	assert.True(t, errors.As(err, &overLimit))
+	assert.Equal(t, LimitDaily, overLimit.Limit)
+}
+
+func TestLimitsEndpoints(t *testing.T) {
+	store := NewMemoryStore()
+	store.SetDefaultLimits(AccountLimits{SingleMax: usd(5000), DailyMax: usd(8000), MonthlyMax: usd(20000)})
+	server := newTestServer(store)
+	admin := newTestAccount(t, store, 1008)
+	acc := newTestAccount(t, store, 1016)
+	assert.Nil(t, store.SetAccountRole(admin.ID, RoleAdmin))
+	_, err := store.CreateTransaction(0, 1016, "deposit", usd(50000))
+	assert.Nil(t, err)
+
+	adminToken := login(t, server, 1008, "password").Token
+	token := login(t, server, 1016, "password").Token
+	limitsPath := "/account/" + strconv.Itoa(acc.ID) + "/limits"
+
+	w := doRequest(server, "POST", "/withdraw", token, WithdrawRequest{AccountNumber: 1016, Amount: usd(5001)})
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	var apiErr APIError
+	assert.Nil(t, jsonDecode(w, &apiErr))
+	assert.Equal(t, CodeLimitExceeded, apiErr.Code)
+
+	w = doRequest(server, "POST", "/withdraw", token, WithdrawRequest{AccountNumber: 1016, Amount: usd(3000)})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = doRequest(server, "GET", limitsPath, token, nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var limits LimitsResponse
+	assert.Nil(t, jsonDecode(w, &limits))
+	assert.False(t, limits.Custom)
+	assert.Equal(t, usd(3000), limits.DailyUsed)
+	assert.Equal(t, usd(5000), *limits.DailyRemaining)
+	assert.Equal(t, usd(17000), *limits.MonthlyRemaining)
+
+	// only admins can override, and the override applies straight away
+	unlimitedDaily := SetLimitsRequest{SingleMax: ptr(usd(10000)), DailyMax: ptr(usd(0)), MonthlyMax: ptr(usd(20000))}
+	assert.Equal(t, http.StatusForbidden, doRequest(server, "PUT", limitsPath, token, unlimitedDaily).Code)
+	w = doRequest(server, "PUT", limitsPath, adminToken, SetLimitsRequest{SingleMax: ptr(usd(-1))})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(server, "PUT", limitsPath, adminToken, unlimitedDaily)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	limits = LimitsResponse{}
+	assert.Nil(t, jsonDecode(w, &limits))
+	assert.True(t, limits.Custom)
+	assert.Nil(t, limits.DailyRemaining)
+
+	w = doRequest(server, "POST", "/withdraw", token, WithdrawRequest{AccountNumber: 1016, Amount: usd(9000)})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	assert.Equal(t, http.StatusOK, doRequest(server, "DELETE", limitsPath, adminToken, nil).Code)
+	w = doRequest(server, "POST", "/withdraw", token, WithdrawRequest{AccountNumber: 1016, Amount: usd(100)})
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
+
+func ptr[T any](v T) *T { return &v }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginRetryAt(t *testing.T) {
+	cfg := LoginConfig{MaxAttempts: 5, BaseDelay: time.Second, Lockout: time.Minute}
+	last := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.True(t, cfg.retryAt(nil, 5).IsZero())
+	assert.True(t, cfg.retryAt(&LoginFailures{Failures: 1, LastFailureAt: last}, 5).IsZero())
+	assert.Equal(t, last.Add(time.Second), cfg.retryAt(&LoginFailures{Failures: 2, LastFailureAt: last}, 5))
+	assert.Equal(t, last.Add(4*time.Second), cfg.retryAt(&LoginFailures{Failures: 4, LastFailureAt: last}, 5))
+	assert.Equal(t, last.Add(time.Minute), cfg.retryAt(&LoginFailures{Failures: 5, LastFailureAt: last}, 5))
+
+	// the backoff never exceeds the lockout
+	cfg.MaxAttempts = 100
+	assert.Equal(t, last.Add(time.Minute), cfg.retryAt(&LoginFailures{Failures: 90, LastFailureAt: last}, 100))
+}
+
+func TestLoginLockout(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	admin := newTestAccount(t, store, 1016)
+	assert.Nil(t, store.SetAccountRole(admin.ID, RoleAdmin))
+	acc := newTestAccount(t, store, 1008)
+	adminToken := login(t, server, 1016, "password").Token
+
+	wrong := LoginRequest{AccountNumber: 1008, Password: "wrong"}
+	w := doRequest(server, "POST", "/login", "", wrong)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = doRequest(server, "POST", "/login", "", wrong)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// the second failure starts the backoff, even for the right password
+	w = doRequest(server, "POST", "/login", "", LoginRequest{AccountNumber: 1008, Password: "password"})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	server.config.Login.BaseDelay = 0
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, doRequest(server, "POST", "/login", "", wrong).Code)
+	}
+	w = doRequest(server, "POST", "/login", "", LoginRequest{AccountNumber: 1008, Password: "password"})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "900", w.Header().Get("Retry-After"))
+
+	unlockPath := "/account/" + strconv.Itoa(acc.ID) + "/unlock"
+	assert.Equal(t, http.StatusUnauthorized, doRequest(server, "POST", unlockPath, "", nil).Code)
+	assert.Equal(t, http.StatusOK, doRequest(server, "POST", unlockPath, adminToken, nil).Code)
+	login(t, server, 1008, "password")
+
+	var outcomes []string
+	for _, e := range store.loginEvents {
+		if e.AccountNumber == 1008 {
+			outcomes = append(outcomes, e.Outcome)
+		}
+	}
+	assert.Equal(t, []string{"failure", "failure", "throttled", "failure", "failure", "failure", "throttled", "success"}, outcomes)
+}
+
+func TestLoginLockoutPerIP(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	server.config.Login.BaseDelay = 0
+	server.config.Login.IPMaxAttempts = 3
+	newTestAccount(t, store, 1008)
+
+	// spraying different account numbers from one address
+	for _, n := range []int{1016, 1024, 1032} {
+		w := doRequest(server, "POST", "/login", "", LoginRequest{AccountNumber: n, Password: "password"})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+	w := doRequest(server, "POST", "/login", "", LoginRequest{AccountNumber: 1008, Password: "password"})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
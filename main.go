@@ -3,19 +3,85 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
 )
 
 func main() {
-	store, err := NewPostGresStore()
+	config, args, err := loadConfig(os.Args[1:])
 	if err != nil {
-		fmt.Print("Error connecting to database")
+		log.Fatalf("Invalid configuration: %v", err)
 	}
 
-	if err := store.init(); err != nil {
-		log.Fatal("Error initializing database")
+	// gobank migrate [status|up|down] [n]
+	if len(args) > 0 && args[0] == "migrate" {
+		pgStore, err := NewPostGresStore(config.Database)
+		if err != nil {
+			log.Fatal("Error connecting to database")
+		}
+		if err := runMigrateCommand(pgStore.db, args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	server := newApiServer(":8080", store)
+	// gobank role <accountnumber> <role>
+	if len(args) > 0 && args[0] == "role" {
+		pgStore, err := NewPostGresStore(config.Database)
+		if err != nil {
+			log.Fatal("Error connecting to database")
+		}
+		if err := loadLegacyAccountNumbers(pgStore, config); err != nil {
+			log.Fatalf("Loading legacy account numbers: %v", err)
+		}
+		if err := runRoleCommand(pgStore, args[1:], config.LegacyAccountNumbers); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := config.validateServer(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	var store Storage
+	switch config.Store {
+	case "memory":
+		fmt.Println("Using in-memory store, data will not be persisted")
+		store = NewMemoryStore()
+	case "postgres":
+		pgStore, err := NewPostGresStore(config.Database)
+		if err != nil {
+			log.Fatal("Error connecting to database")
+		}
+
+		if err := pgStore.init(); err != nil {
+			log.Fatalf("Error initializing database: %v", err)
+		}
+		if err := pgStore.assignMissingIBANs(config.IBAN); err != nil {
+			log.Fatalf("Error assigning IBANs: %v", err)
+		}
+		store = pgStore
+	}
+	if err := loadLegacyAccountNumbers(store, config); err != nil {
+		log.Fatalf("Loading legacy account numbers: %v", err)
+	}
+	store.SetDefaultLimits(config.Limits)
+	store.SetFeeSchedule(config.Fees)
+	if err := loadFXRates(store, config.FX); err != nil {
+		log.Fatalf("Loading exchange rates: %v", err)
+	}
+
+	mismatches, err := store.ReconcileBalances()
+	if err != nil {
+		log.Printf("Error reconciling balances against the ledger: %v", err)
+	}
+	for _, m := range mismatches {
+		log.Printf("Account %d balance %s does not match ledger %s", m.AccountNumber, m.Balance, m.Ledger)
+	}
+
+	go newScheduler(store, config.Scheduler, config.Savings).run()
+
+	server := newApiServer(config, store)
 	server.run()
 }
 
@@ -0,0 +1,1082 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Storage implementation that keeps everything in process
+// memory. It is meant for tests and for running the API locally without a
+// database; all data is lost when the process exits.
+type MemoryStore struct {
+	mu           sync.Mutex
+	accounts     map[int]*Account // keyed by id
+	byNumber     map[int]int      // accountnumber -> id
+	transactions []*Transaction
+	journal      []*JournalEntry
+	idempotency  map[idempotencyKey]*IdempotencyRecord
+	refresh      map[string]*RefreshToken // keyed by token hash
+	revoked      map[string]time.Time     // access token jti -> expiry
+	nextID       int
+	nextTxID     int
+	nextEntryID  int
+	nextAccSeq   int
+	loginFails   map[string]*LoginFailures
+	loginEvents  []*LoginEvent
+	totp         map[int]*TOTPCredential
+	recovery     map[int]map[string]bool // accountnumber -> code hash -> used
+	limits       AccountLimits           // for accounts without an override
+	accLimits    map[int]AccountLimits   // overrides by accountnumber
+	fxRates      map[[2]string]*FXRate   // keyed by base, quote
+	fxQuotes     map[string]*FXQuote
+	fees         FeeSchedule
+	orders       map[int]*StandingOrder
+	orderRuns    []*StandingOrderRun
+	nextOrderID  int
+	interest     map[int]*InterestState
+	accruals     []*InterestAccrual
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		accounts:    make(map[int]*Account),
+		byNumber:    make(map[int]int),
+		idempotency: make(map[idempotencyKey]*IdempotencyRecord),
+		refresh:     make(map[string]*RefreshToken),
+		revoked:     make(map[string]time.Time),
+		nextID:      1,
+		nextTxID:    1,
+		nextEntryID: 1,
+		nextAccSeq:  firstAccountSequence,
+		loginFails:  make(map[string]*LoginFailures),
+		totp:        make(map[int]*TOTPCredential),
+		recovery:    make(map[int]map[string]bool),
+		accLimits:   make(map[int]AccountLimits),
+		fxRates:     make(map[[2]string]*FXRate),
+		fxQuotes:    make(map[string]*FXQuote),
+		orders:      make(map[int]*StandingOrder),
+		nextOrderID: 1,
+		interest:    make(map[int]*InterestState),
+	}
+}
+
+func (s *MemoryStore) CreateAccount(ac *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.byNumber[ac.AccountNumber]; ok {
+		return conflictf("account with number %d already exists", ac.AccountNumber)
+	}
+
+	ac.ID = s.nextID
+	s.nextID++
+
+	stored := *ac
+	if stored.Product == "" {
+		stored.Product = ProductChecking
+	}
+	s.accounts[stored.ID] = &stored
+	s.byNumber[stored.AccountNumber] = stored.ID
+	return nil
+}
+
+func (s *MemoryStore) NextAccountNumber() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.nextAccSeq > lastAccountSequence {
+		return 0, fmt.Errorf("account numbers exhausted")
+	}
+	seq := s.nextAccSeq
+	s.nextAccSeq++
+	return withCheckDigit(seq), nil
+}
+
+// GetLegacyAccountNumbers returns nothing: a memory store starts empty, so
+// every account in it got an allocated number.
+func (s *MemoryStore) GetLegacyAccountNumbers() ([]int, error) {
+	return nil, nil
+}
+
+func (s *MemoryStore) UpdateAccount(a *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[a.ID]
+	if !ok {
+		return notFoundf("Account with id %d not found", a.ID)
+	}
+	if acc.Version != a.Version {
+		return conflictf("account %d was modified by another request, reload it and try again", a.ID)
+	}
+
+	acc.FirstName = a.FirstName
+	acc.LastName = a.LastName
+	acc.Password = a.Password
+	acc.PasswordChangedAt = a.PasswordChangedAt
+	acc.Version++
+	a.Version = acc.Version
+
+	if !a.PasswordChangedAt.IsZero() {
+		now := time.Now().UTC()
+		for _, t := range s.refresh {
+			if t.AccountNumber == acc.AccountNumber && t.RevokedAt == nil && t.CreatedAt.Before(a.PasswordChangedAt) {
+				t.RevokedAt = &now
+			}
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetAccountById(id int) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[id]
+	if !ok {
+		return nil, notFoundf("Account with id %d not found", id)
+	}
+	return copyAccount(acc), nil
+}
+
+func (s *MemoryStore) GetAccounts() ([]*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accounts := make([]*Account, 0, len(s.accounts))
+	for id := 1; id < s.nextID; id++ {
+		if acc, ok := s.accounts[id]; ok {
+			accounts = append(accounts, copyAccount(acc))
+		}
+	}
+	return accounts, nil
+}
+
+func (s *MemoryStore) GetAccountByNumber(accountnumber int) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.lookupNumber(accountnumber)
+	if !ok {
+		return nil, notFoundf("Account with number %d not found", accountnumber)
+	}
+	return copyAccount(acc), nil
+}
+
+func (s *MemoryStore) SetAccountStatus(id int, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[id]
+	if !ok {
+		return notFoundf("Account with id %d not found", id)
+	}
+	if err := checkStatusTransition(acc, status); err != nil {
+		return err
+	}
+	if status == StatusClosed && acc.Status != StatusClosed {
+		acc.ClosedAt = time.Now().UTC()
+	}
+	acc.Status = status
+	return nil
+}
+
+func (s *MemoryStore) SetAccountRole(id int, role Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[id]
+	if !ok {
+		return notFoundf("Account with id %d not found", id)
+	}
+	acc.Role = role
+	return nil
+}
+
+func (s *MemoryStore) SetOverdraft(id int, limit, fee Money) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[id]
+	if !ok {
+		return notFoundf("Account with id %d not found", id)
+	}
+	if err := checkOverdraft(acc, limit, fee); err != nil {
+		return err
+	}
+	acc.OverdraftLimit = limit
+	acc.OverdraftFee = fee
+	return nil
+}
+
+func (s *MemoryStore) GetAccountByIBAN(iban string) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, acc := range s.accounts {
+		if acc.IBAN != "" && acc.IBAN == iban {
+			return copyAccount(acc), nil
+		}
+	}
+	return nil, notFoundf("Account with IBAN %s not found", iban)
+}
+
+// UpdateAccountBalance sets an account's balance by posting the difference
+// against the adjustments ledger account, so the ledger stays balanced.
+func (s *MemoryStore) UpdateAccountBalance(accountNumber int, newBalance Money) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.lookupNumber(accountNumber)
+	if !ok {
+		return nil, notFoundf("Account with number %d not found", accountNumber)
+	}
+	diff, err := newBalance.Sub(acc.Balance)
+	if err != nil {
+		return nil, err
+	}
+	if !diff.IsZero() {
+		if err := s.postEntryLocked(balancingEntry("balance adjustment", LedgerAdjustments, accountNumber, diff)); err != nil {
+			return nil, err
+		}
+	}
+	return copyAccount(acc), nil
+}
+
+// CreateTransaction records a deposit, withdraw, transfer or fee and posts
+// its journal entry under a single lock, so the balance changes and the
+// records are all-or-nothing.
+func (s *MemoryStore) CreateTransaction(fromAccount, toAccount int, transactionType string, amount Money) (*Account, error) {
+	if !amount.IsPositive() {
+		return nil, invalidf("transaction amount must be positive")
+	}
+	entry, err := transactionEntry(fromAccount, toAccount, transactionType, amount)
+	if err != nil {
+		return nil, err
+	}
+	switch transactionType {
+	case "deposit", "interest":
+		fromAccount = 0
+	case "withdraw", "fee":
+		toAccount = 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.postTransactionLocked(&Transaction{FromAccount: fromAccount, ToAccount: toAccount, Type: transactionType, Amount: amount}, entry)
+}
+
+func (s *MemoryStore) CreateExchange(x *Exchange) (*Account, error) {
+	entry, err := exchangeEntry(x.FromAccount, x.ToAccount, x.Debit, x.Credit)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.postTransactionLocked(x.transaction(), entry)
+}
+
+func (s *MemoryStore) postTransactionLocked(t *Transaction, entry *JournalEntry) (*Account, error) {
+	// same order as the postgres store: the accounts' status and funds,
+	// then the limits, the quote and the fees
+	if _, err := s.checkEntriesLocked(entry); err != nil {
+		return nil, err
+	}
+	if limitedTransaction(t.Type) {
+		limits, err := s.limitsLocked(t.FromAccount).in(t.Amount.Currency, s.fxRatesLocked())
+		if err != nil {
+			return nil, err
+		}
+		totals := s.debitTotalsLocked(t.FromAccount, t.Amount.Currency)
+		if err := limits.check(t.FromAccount, t.Amount, totals); err != nil {
+			return nil, err
+		}
+	}
+
+	var quote *FXQuote
+	if t.FXQuoteID != "" {
+		now := time.Now().UTC()
+		quote = s.fxQuotes[t.FXQuoteID]
+		if quote == nil || quote.AccountNumber != t.FromAccount || quote.UsedAt != nil || !now.Before(quote.ExpiresAt) {
+			return nil, conflictf("FX quote %s has expired or was already used", t.FXQuoteID)
+		}
+	}
+
+	// nothing is posted until the amount and its fees are known to fit
+	// together
+	var fees []Fee
+	payer := feePayer(t)
+	if acc, ok := s.lookupNumber(payer); ok {
+		var err error
+		if fees, err = transactionFees(s.fees, acc, t); err != nil {
+			return nil, err
+		}
+	}
+	transactions := []*Transaction{t}
+	entries := []*JournalEntry{entry}
+	for _, fee := range fees {
+		feeTx, feeEntry, err := feeTransaction(payer, fee)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, feeTx)
+		entries = append(entries, feeEntry)
+	}
+	updated, err := s.checkEntriesLocked(entries...)
+	if err != nil {
+		return nil, err
+	}
+
+	// everything fits, post the transaction and its fees together
+	for i, e := range entries {
+		e.TransactionID = s.nextTxID + i
+	}
+	s.applyEntriesLocked(updated, entries...)
+	for i, tx := range transactions {
+		s.appendTransactionLocked(tx, entries[i])
+	}
+	if quote != nil {
+		now := time.Now().UTC()
+		quote.UsedAt = &now
+	}
+
+	if creditTransaction(t.Type) {
+		acc, _ := s.lookupNumber(t.ToAccount)
+		return copyAccount(acc), nil
+	}
+	acc, _ := s.lookupNumber(t.FromAccount)
+	return copyAccount(acc), nil
+}
+
+func (s *MemoryStore) appendTransactionLocked(t *Transaction, entry *JournalEntry) {
+	c := *t
+	c.ID = s.nextTxID
+	c.CreatedAt = entry.CreatedAt
+	s.transactions = append(s.transactions, &c)
+	s.nextTxID++
+}
+
+func (s *MemoryStore) PostJournalEntry(entry *JournalEntry) error {
+	if err := entry.validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.postEntryLocked(entry)
+}
+
+// postEntryLocked checks and applies entry. Every new balance is computed
+// before anything is mutated, so a rejected entry leaves no trace.
+func (s *MemoryStore) postEntryLocked(entry *JournalEntry) error {
+	updated, err := s.checkEntriesLocked(entry)
+	if err != nil {
+		return err
+	}
+	s.applyEntriesLocked(updated, entry)
+	return nil
+}
+
+// checkEntriesLocked runs checkEntries against the store's accounts.
+func (s *MemoryStore) checkEntriesLocked(entries ...*JournalEntry) (map[int]Money, error) {
+	accounts := map[int]*Account{}
+	for _, entry := range entries {
+		_, numbers := entry.customerChanges()
+		for _, n := range numbers {
+			if acc, ok := s.lookupNumber(n); ok {
+				accounts[n] = acc
+			}
+		}
+	}
+	return checkEntries(accounts, entries...)
+}
+
+// applyEntriesLocked stores entries that checkEntriesLocked accepted,
+// together with the balances it returned.
+func (s *MemoryStore) applyEntriesLocked(balances map[int]Money, entries ...*JournalEntry) {
+	for n, balance := range balances {
+		acc, _ := s.lookupNumber(n)
+		acc.Balance = balance
+	}
+	now := time.Now().UTC()
+	for _, entry := range entries {
+		entry.ID = s.nextEntryID
+		s.nextEntryID++
+		entry.CreatedAt = now
+		stored := *entry
+		stored.Postings = slices.Clone(entry.Postings)
+		s.journal = append(s.journal, &stored)
+	}
+}
+
+func (s *MemoryStore) GetLedgerBalance(account LedgerAccount, currency string) (Money, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.ledgerBalanceLocked(account, currency), nil
+}
+
+func (s *MemoryStore) ledgerBalanceLocked(account LedgerAccount, currency string) Money {
+	balance := Money{Currency: currency}
+	for _, entry := range s.journal {
+		for _, p := range entry.Postings {
+			if p.Account == account && p.Amount.Currency == currency {
+				balance.Amount += p.signed()
+			}
+		}
+	}
+	return balance
+}
+
+func (s *MemoryStore) ReconcileBalances() ([]BalanceMismatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mismatches := []BalanceMismatch{}
+	for id := 1; id < s.nextID; id++ {
+		acc, ok := s.accounts[id]
+		if !ok {
+			continue
+		}
+		ledger := s.ledgerBalanceLocked(customerLedgerAccount(acc.AccountNumber), acc.Balance.Currency)
+		if ledger != acc.Balance {
+			mismatches = append(mismatches, BalanceMismatch{AccountNumber: acc.AccountNumber, Balance: acc.Balance, Ledger: ledger})
+		}
+	}
+	return mismatches, nil
+}
+
+func (s *MemoryStore) GetTransactions(accountNumber int, f TransactionFilter) ([]*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transactions := []*Transaction{}
+	for i := len(s.transactions) - 1; i >= 0; i-- {
+		tx := s.transactions[i]
+		if tx.FromAccount != accountNumber && tx.ToAccount != accountNumber {
+			continue
+		}
+		if !f.matches(tx) {
+			continue
+		}
+		c := *tx
+		c.Direction = c.directionFor(accountNumber)
+		transactions = append(transactions, &c)
+		if f.Limit > 0 && len(transactions) == f.Limit {
+			break
+		}
+	}
+	return transactions, nil
+}
+
+type idempotencyKey struct {
+	accountNumber int
+	key           string
+}
+
+func (s *MemoryStore) ReserveIdempotencyKey(rec *IdempotencyRecord) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, existing := range s.idempotency {
+		if !existing.ExpiresAt.After(rec.CreatedAt) {
+			delete(s.idempotency, k)
+		}
+	}
+	k := idempotencyKey{rec.AccountNumber, rec.Key}
+	if existing, ok := s.idempotency[k]; ok {
+		c := *existing
+		return &c, nil
+	}
+	c := *rec
+	s.idempotency[k] = &c
+	return nil, nil
+}
+
+func (s *MemoryStore) CompleteIdempotencyKey(rec *IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.idempotency[idempotencyKey{rec.AccountNumber, rec.Key}]
+	if !ok {
+		return fmt.Errorf("idempotency key %q not reserved", rec.Key)
+	}
+	stored.StatusCode = rec.StatusCode
+	stored.Response = rec.Response
+	stored.ExpiresAt = rec.ExpiresAt
+	return nil
+}
+
+func (s *MemoryStore) ReleaseIdempotencyKey(accountNumber int, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := idempotencyKey{accountNumber, key}
+	if rec, ok := s.idempotency[k]; ok && rec.StatusCode == 0 {
+		delete(s.idempotency, k)
+	}
+	return nil
+}
+
+func (s *MemoryStore) CreateRefreshToken(t *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := *t
+	s.refresh[t.TokenHash] = &c
+	return nil
+}
+
+func (s *MemoryStore) ConsumeRefreshToken(tokenHash string) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.refresh[tokenHash]
+	if !ok {
+		return nil, notFoundf("refresh token not found")
+	}
+	if t.UsedAt != nil || t.RevokedAt != nil {
+		s.revokeFamilyLocked(t.FamilyID)
+		return nil, errRefreshTokenReused
+	}
+	now := time.Now().UTC()
+	t.UsedAt = &now
+	c := *t
+	return &c, nil
+}
+
+func (s *MemoryStore) RevokeRefreshTokenFamily(tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.refresh[tokenHash]
+	if !ok {
+		return notFoundf("refresh token not found")
+	}
+	s.revokeFamilyLocked(t.FamilyID)
+	return nil
+}
+
+func (s *MemoryStore) revokeFamilyLocked(family string) {
+	now := time.Now().UTC()
+	for _, t := range s.refresh {
+		if t.FamilyID == family && t.RevokedAt == nil {
+			t.RevokedAt = &now
+		}
+	}
+}
+
+func (s *MemoryStore) RevokeToken(jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, exp := range s.revoked {
+		if exp.Before(now) {
+			delete(s.revoked, id)
+		}
+	}
+	s.revoked[jti] = expiresAt
+	return nil
+}
+
+func (s *MemoryStore) IsTokenRevoked(jti string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.revoked[jti]
+	return ok, nil
+}
+
+func (s *MemoryStore) GetLoginFailures(key string) (*LoginFailures, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.loginFails[key]
+	if !ok {
+		return nil, nil
+	}
+	c := *f
+	return &c, nil
+}
+
+func (s *MemoryStore) RegisterLoginFailure(key string, at, resetBefore time.Time) (*LoginFailures, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.loginFails[key]
+	if !ok || f.LastFailureAt.Before(resetBefore) {
+		f = &LoginFailures{Key: key}
+		s.loginFails[key] = f
+	}
+	f.Failures++
+	f.LastFailureAt = at
+	c := *f
+	return &c, nil
+}
+
+func (s *MemoryStore) ClearLoginFailures(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.loginFails, key)
+	return nil
+}
+
+func (s *MemoryStore) RecordLoginEvent(e *LoginEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := *e
+	s.loginEvents = append(s.loginEvents, &c)
+	return nil
+}
+
+func (s *MemoryStore) GetTOTPCredential(accountNumber int) (*TOTPCredential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.totp[accountNumber]
+	if !ok {
+		return nil, nil
+	}
+	cc := *c
+	return &cc, nil
+}
+
+func (s *MemoryStore) SaveTOTPCredential(c *TOTPCredential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.totp[c.AccountNumber]; ok && existing.Enabled {
+		return conflictf("two-factor authentication is already enabled")
+	}
+	cc := *c
+	cc.Enabled = false
+	cc.LastStep = 0
+	s.totp[c.AccountNumber] = &cc
+	return nil
+}
+
+func (s *MemoryStore) EnableTOTP(accountNumber int, recoveryCodeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.totp[accountNumber]
+	if !ok || c.Enabled {
+		return conflictf("no pending two-factor enrollment for account %d", accountNumber)
+	}
+	c.Enabled = true
+	codes := make(map[string]bool, len(recoveryCodeHashes))
+	for _, hash := range recoveryCodeHashes {
+		codes[hash] = false
+	}
+	s.recovery[accountNumber] = codes
+	return nil
+}
+
+func (s *MemoryStore) DeleteTOTPCredential(accountNumber int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.totp, accountNumber)
+	delete(s.recovery, accountNumber)
+	return nil
+}
+
+func (s *MemoryStore) ConsumeTOTPStep(accountNumber int, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.totp[accountNumber]
+	if !ok || step <= c.LastStep {
+		return false, nil
+	}
+	c.LastStep = step
+	return true, nil
+}
+
+func (s *MemoryStore) ConsumeRecoveryCode(accountNumber int, codeHash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	used, ok := s.recovery[accountNumber][codeHash]
+	if !ok || used {
+		return false, nil
+	}
+	s.recovery[accountNumber][codeHash] = true
+	return true, nil
+}
+
+func (s *MemoryStore) SetDefaultLimits(limits AccountLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.limits = limits
+}
+
+func (s *MemoryStore) SetFeeSchedule(fees FeeSchedule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fees = fees
+}
+
+func (s *MemoryStore) GetAccountLimits(accountNumber int) (AccountLimits, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, custom := s.accLimits[accountNumber]
+	return s.limitsLocked(accountNumber), custom, nil
+}
+
+func (s *MemoryStore) SetAccountLimits(accountNumber int, limits AccountLimits) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.lookupNumber(accountNumber); !ok {
+		return notFoundf("Account with number %d not found", accountNumber)
+	}
+	s.accLimits[accountNumber] = limits
+	return nil
+}
+
+func (s *MemoryStore) ClearAccountLimits(accountNumber int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.accLimits, accountNumber)
+	return nil
+}
+
+func (s *MemoryStore) GetDebitTotals(accountNumber int, currency string) (DebitTotals, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.debitTotalsLocked(accountNumber, currency), nil
+}
+
+func (s *MemoryStore) limitsLocked(accountNumber int) AccountLimits {
+	if l, ok := s.accLimits[accountNumber]; ok {
+		return l
+	}
+	return s.limits
+}
+
+func (s *MemoryStore) debitTotalsLocked(accountNumber int, currency string) DebitTotals {
+	t := DebitTotals{Daily: NewMoney(0, currency), Monthly: NewMoney(0, currency)}
+	now := time.Now()
+	for _, tx := range s.transactions {
+		if tx.FromAccount != accountNumber || !limitedTransaction(tx.Type) || tx.Amount.Currency != currency {
+			continue
+		}
+		if tx.CreatedAt.After(now.Add(-monthlyLimitWindow)) {
+			t.Monthly.Amount += tx.Amount.Amount
+		}
+		if tx.CreatedAt.After(now.Add(-dailyLimitWindow)) {
+			t.Daily.Amount += tx.Amount.Amount
+		}
+	}
+	return t
+}
+
+func (s *MemoryStore) lookupNumber(accountnumber int) (*Account, bool) {
+	id, ok := s.byNumber[accountnumber]
+	if !ok {
+		return nil, false
+	}
+	return s.accounts[id], true
+}
+
+func copyAccount(a *Account) *Account {
+	c := *a
+	return &c
+}
+
+func (s *MemoryStore) GetFXRates() ([]*FXRate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.fxRatesLocked(), nil
+}
+
+func (s *MemoryStore) fxRatesLocked() []*FXRate {
+	rates := make([]*FXRate, 0, len(s.fxRates))
+	for _, r := range s.fxRates {
+		c := *r
+		rates = append(rates, &c)
+	}
+	slices.SortFunc(rates, func(a, b *FXRate) int { return strings.Compare(a.Pair(), b.Pair()) })
+	return rates
+}
+
+// SetFXRates adds or replaces rates. A pair replaces its inverse, so the
+// table never holds two rates for the same currencies.
+func (s *MemoryStore) SetFXRates(rates []*FXRate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range rates {
+		c := *r
+		delete(s.fxRates, [2]string{r.Quote, r.Base})
+		s.fxRates[[2]string{r.Base, r.Quote}] = &c
+	}
+	return nil
+}
+
+func (s *MemoryStore) CreateFXQuote(q *FXQuote) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.fxQuotes[q.ID]; ok {
+		return conflictf("FX quote %s already exists", q.ID)
+	}
+	c := *q
+	s.fxQuotes[q.ID] = &c
+	return nil
+}
+
+func (s *MemoryStore) GetFXQuote(id string) (*FXQuote, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, ok := s.fxQuotes[id]
+	if !ok {
+		return nil, notFoundf("FX quote %s not found", id)
+	}
+	c := *q
+	return &c, nil
+}
+
+func (s *MemoryStore) CreateStandingOrder(o *StandingOrder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o.ID = s.nextOrderID
+	s.nextOrderID++
+	c := *o
+	s.orders[o.ID] = &c
+	return nil
+}
+
+func (s *MemoryStore) GetStandingOrder(id int) (*StandingOrder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[id]
+	if !ok {
+		return nil, notFoundf("standing order %d not found", id)
+	}
+	c := *o
+	return &c, nil
+}
+
+func (s *MemoryStore) GetStandingOrders(accountNumber int) ([]*StandingOrder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orders := []*StandingOrder{}
+	for _, o := range s.orders {
+		if o.FromAccount == accountNumber {
+			c := *o
+			orders = append(orders, &c)
+		}
+	}
+	slices.SortFunc(orders, func(a, b *StandingOrder) int { return b.ID - a.ID })
+	return orders, nil
+}
+
+func (s *MemoryStore) CancelStandingOrder(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[id]
+	if !ok {
+		return notFoundf("standing order %d not found", id)
+	}
+	if o.Status != OrderActive {
+		return conflictf("standing order %d is no longer active", id)
+	}
+	o.Status = OrderCancelled
+	return nil
+}
+
+func (s *MemoryStore) ClaimDueStandingOrders(now, leaseUntil time.Time) ([]*StandingOrder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := []*StandingOrder{}
+	for _, o := range s.orders {
+		if o.Status == OrderActive && !o.NextAttemptAt.After(now) {
+			o.NextAttemptAt = leaseUntil
+			c := *o
+			due = append(due, &c)
+		}
+	}
+	slices.SortFunc(due, func(a, b *StandingOrder) int {
+		if c := a.NextRunAt.Compare(b.NextRunAt); c != 0 {
+			return c
+		}
+		return a.ID - b.ID
+	})
+	return due, nil
+}
+
+func (s *MemoryStore) RecordStandingOrderRun(o *StandingOrder, run *StandingOrderRun) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.recordStandingOrderRunLocked(o, run)
+}
+
+func (s *MemoryStore) ExecuteStandingOrder(o *StandingOrder, run *StandingOrderRun) error {
+	entry, err := transactionEntry(o.FromAccount, o.ToAccount, "transfer", o.Amount)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.orders[o.ID]; !ok {
+		return notFoundf("standing order %d not found", o.ID)
+	}
+	for _, r := range s.orderRuns {
+		if r.OrderID == run.OrderID && r.DueAt.Equal(run.DueAt) && r.Status == RunSucceeded {
+			return fmt.Errorf("standing order %d due %s: %w", run.OrderID, run.DueAt.Format(time.RFC3339), errAlreadyPaid)
+		}
+	}
+	t := &Transaction{FromAccount: o.FromAccount, ToAccount: o.ToAccount, Type: "transfer", Amount: o.Amount}
+	if _, err := s.postTransactionLocked(t, entry); err != nil {
+		return err
+	}
+	return s.recordStandingOrderRunLocked(o, run)
+}
+
+func (s *MemoryStore) recordStandingOrderRunLocked(o *StandingOrder, run *StandingOrderRun) error {
+	stored, ok := s.orders[o.ID]
+	if !ok {
+		return notFoundf("standing order %d not found", o.ID)
+	}
+	run.ID = len(s.orderRuns) + 1
+	c := *run
+	s.orderRuns = append(s.orderRuns, &c)
+
+	status := o.Status
+	if stored.Status == OrderCancelled {
+		status = OrderCancelled
+	}
+	*stored = *o
+	stored.Status = status
+	return nil
+}
+
+func (s *MemoryStore) GetStandingOrderRuns(orderID int) ([]*StandingOrderRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	runs := []*StandingOrderRun{}
+	for _, run := range s.orderRuns {
+		if run.OrderID == orderID {
+			c := *run
+			runs = append(runs, &c)
+		}
+	}
+	return runs, nil
+}
+
+func (s *MemoryStore) GetBalanceAt(accountNumber int, at time.Time) (Money, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.lookupNumber(accountNumber)
+	if !ok {
+		return Money{}, notFoundf("Account with number %d not found", accountNumber)
+	}
+	balance := acc.Balance
+	ledgerAccount := customerLedgerAccount(accountNumber)
+	for _, entry := range s.journal {
+		if entry.CreatedAt.Before(at) {
+			continue
+		}
+		for _, p := range entry.Postings {
+			if p.Account == ledgerAccount && p.Amount.Currency == balance.Currency {
+				balance.Amount -= p.signed()
+			}
+		}
+	}
+	return balance, nil
+}
+
+func (s *MemoryStore) GetInterestState(accountNumber int) (*InterestState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := *s.interestStateLocked(accountNumber)
+	return &c, nil
+}
+
+func (s *MemoryStore) interestStateLocked(accountNumber int) *InterestState {
+	state, ok := s.interest[accountNumber]
+	if !ok {
+		state = &InterestState{AccountNumber: accountNumber, Accrued: "0"}
+		s.interest[accountNumber] = state
+	}
+	return state
+}
+
+func (s *MemoryStore) RecordInterestAccrual(a *InterestAccrual) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.accruals {
+		if existing.AccountNumber == a.AccountNumber && existing.Day.Equal(a.Day) {
+			return conflictf("interest for account %d on %s was already accrued", a.AccountNumber, a.Day.Format(time.DateOnly))
+		}
+	}
+	amount, ok := new(big.Rat).SetString(a.Amount)
+	if !ok {
+		return invalidf("invalid accrual amount %q", a.Amount)
+	}
+	state := s.interestStateLocked(a.AccountNumber)
+	accrued, _ := new(big.Rat).SetString(state.Accrued)
+	state.Accrued = formatDecimal(accrued.Add(accrued, amount), accrualDecimals)
+	state.AccruedThrough = a.Day
+
+	c := *a
+	s.accruals = append(s.accruals, &c)
+	return nil
+}
+
+func (s *MemoryStore) PostInterest(accountNumber int, through time.Time) (Money, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.lookupNumber(accountNumber)
+	if !ok {
+		return Money{}, notFoundf("Account with number %d not found", accountNumber)
+	}
+	state := s.interestStateLocked(accountNumber)
+	paid, rest := interestPayout(state, acc.Balance.Currency)
+
+	if paid.IsPositive() {
+		entry, err := transactionEntry(0, accountNumber, "interest", paid)
+		if err != nil {
+			return Money{}, err
+		}
+		if _, err := s.postTransactionLocked(&Transaction{ToAccount: accountNumber, Type: "interest", Amount: paid}, entry); err != nil {
+			return Money{}, err
+		}
+	}
+	state.Accrued = rest
+	state.PaidThrough = through
+	return paid, nil
+}
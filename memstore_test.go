@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAccount(t *testing.T, s Storage, number int) *Account {
+	t.Helper()
+	acc, err := NewAccount(number, "John", "Doe", "password")
+	assert.Nil(t, err)
+	assert.Nil(t, s.CreateAccount(acc))
+	return acc
+}
+
+func TestMemoryStoreCreateTransaction(t *testing.T) {
+	s := NewMemoryStore()
+	newTestAccount(t, s, 1001)
+	newTestAccount(t, s, 1002)
+
+	acc, err := s.CreateTransaction(0, 1001, "deposit", usd(100))
+	assert.Nil(t, err)
+	assert.Equal(t, usd(100), acc.Balance)
+
+	acc, err = s.CreateTransaction(1001, 0, "withdraw", usd(30))
+	assert.Nil(t, err)
+	assert.Equal(t, usd(70), acc.Balance)
+
+	acc, err = s.CreateTransaction(1001, 1002, "transfer", usd(20))
+	assert.Nil(t, err)
+	assert.Equal(t, usd(50), acc.Balance)
+
+	to, err := s.GetAccountByNumber(1002)
+	assert.Nil(t, err)
+	assert.Equal(t, usd(20), to.Balance)
+	assert.Len(t, s.transactions, 3)
+
+	_, err = s.CreateTransaction(1001, 9999, "transfer", usd(10))
+	assert.NotNil(t, err)
+	acc, _ = s.GetAccountByNumber(1001)
+	assert.Equal(t, usd(50), acc.Balance, "failed transfer must not touch the source balance")
+}
+
+func TestMemoryStoreConcurrentTransfers(t *testing.T) {
+	s := NewMemoryStore()
+	newTestAccount(t, s, 1001)
+	newTestAccount(t, s, 1002)
+	_, err := s.CreateTransaction(0, 1001, "deposit", usd(1000))
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.CreateTransaction(1001, 1002, "transfer", usd(1))
+		}()
+		go func() {
+			defer wg.Done()
+			s.CreateTransaction(1002, 1001, "transfer", usd(1))
+		}()
+	}
+	wg.Wait()
+
+	a, _ := s.GetAccountByNumber(1001)
+	b, _ := s.GetAccountByNumber(1002)
+	total, err := a.Balance.Add(b.Balance)
+	assert.Nil(t, err)
+	assert.Equal(t, usd(1000), total)
+}
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS accounts (
+    id SERIAL PRIMARY KEY,
+    first_name VARCHAR(50),
+    last_name VARCHAR(50),
+    accountnumber INTEGER UNIQUE,
+    balance INTEGER,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    password VARCHAR(100)
+);
+
+CREATE TABLE IF NOT EXISTS transactions (
+    id SERIAL PRIMARY KEY,
+    from_account INTEGER NULL,  -- Allow NULL for deposit
+    to_account INTEGER NULL,    -- Allow NULL for withdraw
+    transactionType VARCHAR(50),
+    amount INTEGER,
+    transactiontime TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (from_account) REFERENCES accounts(accountnumber) ON DELETE SET NULL,
+    FOREIGN KEY (to_account) REFERENCES accounts(accountnumber) ON DELETE SET NULL,
+    CHECK (transactionType IN ('deposit', 'withdraw', 'transfer'))
+);
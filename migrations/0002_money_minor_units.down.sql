@@ -0,0 +1,4 @@
+ALTER TABLE transactions DROP COLUMN currency;
+ALTER TABLE transactions ALTER COLUMN amount TYPE INTEGER USING amount / 100;
+ALTER TABLE accounts DROP COLUMN currency;
+ALTER TABLE accounts ALTER COLUMN balance TYPE INTEGER USING balance / 100;
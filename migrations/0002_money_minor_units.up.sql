@@ -0,0 +1,21 @@
+-- Amounts used to be whole units in INTEGER columns. Store them as BIGINT
+-- minor units (USD cents) with an explicit currency. Databases set up before
+-- migrations existed may already have these columns.
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'accounts' AND column_name = 'currency'
+    ) THEN
+        ALTER TABLE accounts ALTER COLUMN balance TYPE BIGINT USING balance::bigint * 100;
+        ALTER TABLE accounts ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD';
+    END IF;
+
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'transactions' AND column_name = 'currency'
+    ) THEN
+        ALTER TABLE transactions ALTER COLUMN amount TYPE BIGINT USING amount::bigint * 100;
+        ALTER TABLE transactions ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD';
+    END IF;
+END $$;
@@ -0,0 +1,39 @@
+CREATE TABLE IF NOT EXISTS journal_entries (
+    id SERIAL PRIMARY KEY,
+    transaction_id INTEGER NULL REFERENCES transactions(id),
+    description VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS ledger_postings (
+    id SERIAL PRIMARY KEY,
+    entry_id INTEGER NOT NULL REFERENCES journal_entries(id),
+    ledger_account VARCHAR(64) NOT NULL,
+    side VARCHAR(6) NOT NULL CHECK (side IN ('debit', 'credit')),
+    amount BIGINT NOT NULL CHECK (amount > 0),
+    currency CHAR(3) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS ledger_postings_account_idx ON ledger_postings (ledger_account);
+
+-- Give accounts that predate the ledger an opening entry for their current
+-- balance so reconciliation holds for them too.
+DO $$
+DECLARE
+    r RECORD;
+    entry INTEGER;
+    customer VARCHAR(64);
+BEGIN
+    FOR r IN
+        SELECT accountnumber, balance, currency FROM accounts a
+        WHERE balance <> 0 AND NOT EXISTS (
+            SELECT 1 FROM ledger_postings p WHERE p.ledger_account = 'customer:' || a.accountnumber
+        )
+    LOOP
+        customer := 'customer:' || r.accountnumber;
+        INSERT INTO journal_entries (description) VALUES ('opening balance') RETURNING id INTO entry;
+        INSERT INTO ledger_postings (entry_id, ledger_account, side, amount, currency) VALUES
+            (entry, CASE WHEN r.balance > 0 THEN 'system:opening_balance' ELSE customer END, 'debit', abs(r.balance), r.currency),
+            (entry, CASE WHEN r.balance > 0 THEN customer ELSE 'system:opening_balance' END, 'credit', abs(r.balance), r.currency);
+    END LOOP;
+END $$;
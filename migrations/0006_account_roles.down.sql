@@ -0,0 +1 @@
+ALTER TABLE accounts DROP COLUMN IF EXISTS status, DROP COLUMN IF EXISTS role;
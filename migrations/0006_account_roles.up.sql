@@ -0,0 +1,5 @@
+ALTER TABLE accounts
+    ADD COLUMN IF NOT EXISTS role VARCHAR(16) NOT NULL DEFAULT 'customer'
+        CHECK (role IN ('customer', 'teller', 'admin')),
+    ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'active'
+        CHECK (status IN ('active', 'frozen'));
@@ -0,0 +1 @@
+DROP SEQUENCE IF EXISTS account_number_seq;
@@ -0,0 +1,4 @@
+-- account numbers are allocated by the server: nextval() plus a Luhn check
+-- digit computed in the application
+CREATE SEQUENCE IF NOT EXISTS account_number_seq
+    START 10000000 MINVALUE 10000000 MAXVALUE 99999999 NO CYCLE;
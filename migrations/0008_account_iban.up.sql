@@ -0,0 +1,3 @@
+-- filled in by the application for accounts that predate IBANs, since the
+-- bank code comes from configuration
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS iban VARCHAR(34) NULL UNIQUE;
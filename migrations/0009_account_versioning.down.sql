@@ -0,0 +1 @@
+ALTER TABLE accounts DROP COLUMN IF EXISTS password_changed_at, DROP COLUMN IF EXISTS version;
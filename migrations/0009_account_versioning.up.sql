@@ -0,0 +1,5 @@
+-- version is bumped on every UpdateAccount for optimistic concurrency;
+-- tokens issued before password_changed_at are no longer accepted
+ALTER TABLE accounts
+    ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1,
+    ADD COLUMN IF NOT EXISTS password_changed_at TIMESTAMP NULL;
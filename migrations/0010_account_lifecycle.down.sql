@@ -0,0 +1,11 @@
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS transactions_from_account_fkey;
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS transactions_to_account_fkey;
+ALTER TABLE transactions
+    ADD CONSTRAINT transactions_from_account_fkey FOREIGN KEY (from_account) REFERENCES accounts(accountnumber) ON DELETE SET NULL,
+    ADD CONSTRAINT transactions_to_account_fkey FOREIGN KEY (to_account) REFERENCES accounts(accountnumber) ON DELETE SET NULL;
+
+ALTER TABLE accounts DROP COLUMN IF EXISTS closed_at;
+-- the old schema only knows active and frozen
+UPDATE accounts SET status = 'frozen' WHERE status NOT IN ('active', 'frozen');
+ALTER TABLE accounts DROP CONSTRAINT IF EXISTS accounts_status_check;
+ALTER TABLE accounts ADD CONSTRAINT accounts_status_check CHECK (status IN ('active', 'frozen'));
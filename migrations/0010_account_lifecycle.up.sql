@@ -0,0 +1,12 @@
+ALTER TABLE accounts DROP CONSTRAINT IF EXISTS accounts_status_check;
+ALTER TABLE accounts ADD CONSTRAINT accounts_status_check
+    CHECK (status IN ('pending', 'active', 'frozen', 'dormant', 'closed'));
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS closed_at TIMESTAMP NULL;
+
+-- accounts are closed, never deleted, so refuse deletes that would wipe the
+-- account out of its transaction history
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS transactions_from_account_fkey;
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS transactions_to_account_fkey;
+ALTER TABLE transactions
+    ADD CONSTRAINT transactions_from_account_fkey FOREIGN KEY (from_account) REFERENCES accounts(accountnumber) ON DELETE RESTRICT,
+    ADD CONSTRAINT transactions_to_account_fkey FOREIGN KEY (to_account) REFERENCES accounts(accountnumber) ON DELETE RESTRICT;
@@ -0,0 +1,16 @@
+-- failed login counters, keyed by "account:<number>" or "ip:<address>"
+CREATE TABLE IF NOT EXISTS login_failures (
+    key VARCHAR(64) PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    last_failure_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS login_events (
+    id SERIAL PRIMARY KEY,
+    account_number INTEGER NOT NULL,
+    ip VARCHAR(64) NOT NULL,
+    outcome VARCHAR(16) NOT NULL CHECK (outcome IN ('success', 'failure', 'throttled')),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS login_events_account_idx ON login_events (account_number, created_at);
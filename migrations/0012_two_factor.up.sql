@@ -0,0 +1,16 @@
+-- TOTP secrets; a credential is pending until its first code is confirmed
+CREATE TABLE IF NOT EXISTS totp_credentials (
+    account_number INTEGER PRIMARY KEY REFERENCES accounts(accountnumber) ON DELETE RESTRICT,
+    secret VARCHAR(64) NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    last_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- sha256 hashes of single-use recovery codes
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    account_number INTEGER NOT NULL REFERENCES accounts(accountnumber) ON DELETE RESTRICT,
+    code_hash CHAR(64) NOT NULL,
+    used_at TIMESTAMP,
+    PRIMARY KEY (account_number, code_hash)
+);
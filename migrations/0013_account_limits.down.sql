@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS transactions_from_account_time_idx;
+DROP TABLE IF EXISTS account_limits;
@@ -0,0 +1,12 @@
+-- per-account overrides of the configured limits; zero means no limit
+CREATE TABLE IF NOT EXISTS account_limits (
+    account_number INTEGER PRIMARY KEY REFERENCES accounts(accountnumber) ON DELETE RESTRICT,
+    single_max BIGINT NOT NULL CHECK (single_max >= 0),
+    daily_max BIGINT NOT NULL CHECK (daily_max >= 0),
+    monthly_max BIGINT NOT NULL CHECK (monthly_max >= 0),
+    currency CHAR(3) NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- the rolling totals are summed per source account over recent rows
+CREATE INDEX IF NOT EXISTS transactions_from_account_time_idx ON transactions (from_account, transactiontime);
@@ -0,0 +1,9 @@
+-- the old schema has no fee type; fees come closest to withdrawals
+UPDATE transactions SET transactionType = 'withdraw' WHERE transactionType = 'fee';
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS transactions_transactiontype_check;
+ALTER TABLE transactions ADD CONSTRAINT transactions_transactiontype_check
+    CHECK (transactionType IN ('deposit', 'withdraw', 'transfer'));
+
+ALTER TABLE accounts DROP CONSTRAINT IF EXISTS accounts_overdraft_check;
+ALTER TABLE accounts DROP COLUMN IF EXISTS overdraft_fee;
+ALTER TABLE accounts DROP COLUMN IF EXISTS overdraft_limit;
@@ -0,0 +1,10 @@
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS overdraft_limit BIGINT NOT NULL DEFAULT 0 CHECK (overdraft_limit >= 0);
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS overdraft_fee BIGINT NOT NULL DEFAULT 0 CHECK (overdraft_fee >= 0);
+
+-- last line of defence: no code path may take a balance past its overdraft
+ALTER TABLE accounts DROP CONSTRAINT IF EXISTS accounts_overdraft_check;
+ALTER TABLE accounts ADD CONSTRAINT accounts_overdraft_check CHECK (balance >= -overdraft_limit);
+
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS transactions_transactiontype_check;
+ALTER TABLE transactions ADD CONSTRAINT transactions_transactiontype_check
+    CHECK (transactionType IN ('deposit', 'withdraw', 'transfer', 'fee'));
@@ -0,0 +1,2 @@
+ALTER TABLE transactions DROP COLUMN IF EXISTS converted_currency;
+ALTER TABLE transactions DROP COLUMN IF EXISTS converted_amount;
@@ -0,0 +1,4 @@
+-- what reached the destination of a transfer between currencies; amount and
+-- currency stay the side taken from the source account
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS converted_amount BIGINT NULL CHECK (converted_amount > 0);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS converted_currency CHAR(3) NULL;
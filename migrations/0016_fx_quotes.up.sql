@@ -0,0 +1,28 @@
+-- mid rates; one Base buys rate units of Quote and the inverse is derived
+CREATE TABLE IF NOT EXISTS fx_rates (
+    base CHAR(3) NOT NULL,
+    quote CHAR(3) NOT NULL,
+    rate NUMERIC NOT NULL CHECK (rate > 0),
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (base, quote)
+);
+
+-- rates locked in for one account until expires_at, usable once
+CREATE TABLE IF NOT EXISTS fx_quotes (
+    id VARCHAR(64) PRIMARY KEY,
+    account_number INTEGER NOT NULL REFERENCES accounts(accountnumber) ON DELETE RESTRICT,
+    amount BIGINT NOT NULL CHECK (amount > 0),
+    currency CHAR(3) NOT NULL,
+    converted_amount BIGINT NOT NULL CHECK (converted_amount > 0),
+    converted_currency CHAR(3) NOT NULL,
+    rate NUMERIC NOT NULL,
+    spread NUMERIC NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+-- the rate and spread a transfer between currencies was converted at
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fx_rate NUMERIC NULL;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fx_spread NUMERIC NULL;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fx_quote_id VARCHAR(64) NULL REFERENCES fx_quotes(id);
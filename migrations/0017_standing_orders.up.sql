@@ -0,0 +1,32 @@
+-- scheduled and recurring transfers; next_attempt_at is next_run_at unless
+-- a failed run is waiting to be retried
+CREATE TABLE IF NOT EXISTS standing_orders (
+    id SERIAL PRIMARY KEY,
+    from_account INTEGER NOT NULL REFERENCES accounts(accountnumber) ON DELETE RESTRICT,
+    to_account INTEGER NOT NULL REFERENCES accounts(accountnumber) ON DELETE RESTRICT,
+    amount BIGINT NOT NULL CHECK (amount > 0),
+    currency CHAR(3) NOT NULL,
+    schedule VARCHAR(10) NOT NULL CHECK (schedule IN ('once', 'daily', 'weekly', 'monthly')),
+    day_of_month INTEGER NOT NULL DEFAULT 0 CHECK (day_of_month BETWEEN 0 AND 31),
+    start_at TIMESTAMP NOT NULL,
+    end_at TIMESTAMP,
+    next_run_at TIMESTAMP NOT NULL,
+    next_attempt_at TIMESTAMP NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    status VARCHAR(10) NOT NULL CHECK (status IN ('active', 'completed', 'cancelled', 'failed')),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS standing_orders_due_idx ON standing_orders (next_attempt_at) WHERE status = 'active';
+CREATE INDEX IF NOT EXISTS standing_orders_from_account_idx ON standing_orders (from_account);
+
+-- every execution attempt, successful or not
+CREATE TABLE IF NOT EXISTS standing_order_runs (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES standing_orders(id) ON DELETE CASCADE,
+    due_at TIMESTAMP NOT NULL,
+    attempt INTEGER NOT NULL,
+    status VARCHAR(10) NOT NULL CHECK (status IN ('succeeded', 'failed')),
+    error TEXT NOT NULL DEFAULT '',
+    executed_at TIMESTAMP NOT NULL
+);
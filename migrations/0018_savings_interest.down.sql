@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS interest_accruals;
+DROP TABLE IF EXISTS interest_state;
+
+-- the old schema has no interest type; interest payments come closest to deposits
+UPDATE transactions SET transactionType = 'deposit' WHERE transactionType = 'interest';
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS transactions_transactiontype_check;
+ALTER TABLE transactions ADD CONSTRAINT transactions_transactiontype_check
+    CHECK (transactionType IN ('deposit', 'withdraw', 'transfer', 'fee'));
+
+ALTER TABLE accounts DROP COLUMN IF EXISTS product;
@@ -0,0 +1,24 @@
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS product VARCHAR(10) NOT NULL DEFAULT 'checking'
+    CHECK (product IN ('checking', 'savings'));
+
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS transactions_transactiontype_check;
+ALTER TABLE transactions ADD CONSTRAINT transactions_transactiontype_check
+    CHECK (transactionType IN ('deposit', 'withdraw', 'transfer', 'fee', 'interest'));
+
+-- interest accrued but not yet paid, in minor units with fractions
+CREATE TABLE IF NOT EXISTS interest_state (
+    account_number INTEGER PRIMARY KEY REFERENCES accounts(accountnumber) ON DELETE RESTRICT,
+    accrued NUMERIC NOT NULL DEFAULT 0,
+    accrued_through DATE,
+    paid_through DATE
+);
+
+-- one row per savings account and day, so a day is never accrued twice
+CREATE TABLE IF NOT EXISTS interest_accruals (
+    account_number INTEGER NOT NULL REFERENCES accounts(accountnumber) ON DELETE RESTRICT,
+    day DATE NOT NULL,
+    balance BIGINT NOT NULL,
+    rate NUMERIC NOT NULL,
+    amount NUMERIC NOT NULL CHECK (amount >= 0),
+    PRIMARY KEY (account_number, day)
+);
@@ -0,0 +1,4 @@
+-- an occurrence of a standing order pays out at most once, even if a
+-- second pass picks it up after the lease runs out
+CREATE UNIQUE INDEX IF NOT EXISTS standing_order_runs_succeeded_idx
+    ON standing_order_runs (order_id, due_at) WHERE status = 'succeeded';
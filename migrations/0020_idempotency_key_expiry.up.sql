@@ -0,0 +1,6 @@
+-- idempotency keys are only remembered for a while, after which they are
+-- pruned and may be used again
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;
+UPDATE idempotency_keys SET expires_at = created_at + INTERVAL '24 hours' WHERE expires_at IS NULL;
+ALTER TABLE idempotency_keys ALTER COLUMN expires_at SET NOT NULL;
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
@@ -0,0 +1,16 @@
+-- accounts opened before numbers were allocated chose their own, which
+-- mostly fail the Luhn check; they are recorded here and keep working
+CREATE TABLE IF NOT EXISTS legacy_account_numbers (
+    account_number INTEGER PRIMARY KEY REFERENCES accounts(accountnumber) ON DELETE CASCADE
+);
+
+INSERT INTO legacy_account_numbers (account_number)
+SELECT a.accountnumber FROM accounts a
+WHERE a.accountnumber < 10 OR (
+    SELECT SUM(CASE WHEN i % 2 = 1 THEN d * 2 - CASE WHEN d > 4 THEN 9 ELSE 0 END ELSE d END) % 10
+    FROM (
+        SELECT i, (a.accountnumber::BIGINT / POWER(10, i)::BIGINT) % 10 AS d
+        FROM generate_series(0, 9) AS i
+    ) AS digits
+) <> 0
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"math/big"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const DefaultCurrency = "USD"
+
+// currencyExponents holds the number of minor-unit digits for the ISO 4217
+// currencies we know about.
+var currencyExponents = map[string]int{
+	"AUD": 2,
+	"BHD": 3,
+	"CAD": 2,
+	"CHF": 2,
+	"CNY": 2,
+	"CZK": 2,
+	"DKK": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"HKD": 2,
+	"INR": 2,
+	"JOD": 3,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"MXN": 2,
+	"NOK": 2,
+	"NZD": 2,
+	"OMR": 3,
+	"PLN": 2,
+	"SEK": 2,
+	"SGD": 2,
+	"USD": 2,
+	"ZAR": 2,
+}
+
+// Money is an exact amount of a currency stored as an integer number of
+// minor units (cents for USD). Never use float64 for balances or amounts.
+type Money struct {
+	Amount   int64  // minor units
+	Currency string // ISO 4217 code
+}
+
+func NewMoney(minor int64, currency string) Money {
+	return Money{Amount: minor, Currency: currency}
+}
+
+// bareExponent is how many decimal places a bare amount, one sent without
+// a currency, is kept to until it takes the currency of the account it is
+// for: the most of any currency above.
+const bareExponent = 3
+
+func currencyExponent(currency string) (int, error) {
+	exp, ok := currencyExponents[currency]
+	if !ok {
+		return 0, invalidf("unsupported currency %q", currency)
+	}
+	return exp, nil
+}
+
+// ParseMoney parses a decimal string such as "10.25" or "-3" into Money.
+// Parsing is exact: more fractional digits than the currency allows is an
+// error rather than a silent truncation.
+func ParseMoney(s, currency string) (Money, error) {
+	exp, err := currencyExponent(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	return parseMinor(s, exp, currency)
+}
+
+func parseMinor(s string, exp int, currency string) (Money, error) {
+	str := strings.TrimSpace(s)
+	neg := false
+	switch {
+	case strings.HasPrefix(str, "-"):
+		neg = true
+		str = str[1:]
+	case strings.HasPrefix(str, "+"):
+		str = str[1:]
+	}
+
+	intPart, fracPart, hasDot := strings.Cut(str, ".")
+	if intPart == "" && fracPart == "" || hasDot && fracPart == "" || !isDigits(intPart) || !isDigits(fracPart) {
+		return Money{}, invalidf("invalid amount %q", s)
+	}
+	if len(fracPart) > exp {
+		if strings.Trim(fracPart[exp:], "0") != "" {
+			return Money{}, invalidf("amount %q has more than %d decimal places%s", s, exp, forCurrency(currency))
+		}
+		fracPart = fracPart[:exp]
+	}
+	fracPart += strings.Repeat("0", exp-len(fracPart))
+
+	digits := strings.TrimLeft(intPart+fracPart, "0")
+	if digits == "" {
+		return Money{Currency: currency}, nil
+	}
+	n, ok := new(big.Int).SetString(digits, 10)
+	if !ok || !n.IsInt64() {
+		return Money{}, invalidf("amount %q is out of range", s)
+	}
+	minor := n.Int64()
+	if neg {
+		minor = -minor
+	}
+	return Money{Amount: minor, Currency: currency}, nil
+}
+
+func forCurrency(currency string) string {
+	if currency == "" {
+		return ""
+	}
+	return " for " + currency
+}
+
+// inCurrency gives a bare amount the currency of the account it is for.
+// Amounts that name their currency are returned as they are.
+func (m Money) inCurrency(currency string) (Money, error) {
+	if m.Currency != "" {
+		return m, nil
+	}
+	exp, err := currencyExponent(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	scale := int64(math.Pow10(bareExponent - exp))
+	if m.Amount%scale != 0 {
+		return Money{}, invalidf("amount %s has more than %d decimal places%s", m.Decimal(), exp, forCurrency(currency))
+	}
+	return Money{Amount: m.Amount / scale, Currency: currency}, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (m Money) IsZero() bool     { return m.Amount == 0 }
+func (m Money) IsPositive() bool { return m.Amount > 0 }
+func (m Money) IsNegative() bool { return m.Amount < 0 }
+
+func (m Money) Neg() Money {
+	return Money{Amount: -m.Amount, Currency: m.Currency}
+}
+
+func (m Money) SameCurrency(o Money) bool {
+	return m.Currency == o.Currency
+}
+
+func (m Money) Add(o Money) (Money, error) {
+	if !m.SameCurrency(o) {
+		return Money{}, invalidf("currency mismatch: %s and %s", m.Currency, o.Currency)
+	}
+	sum := m.Amount + o.Amount
+	if (o.Amount > 0 && sum < m.Amount) || (o.Amount < 0 && sum > m.Amount) {
+		return Money{}, invalidf("amount overflow")
+	}
+	return Money{Amount: sum, Currency: m.Currency}, nil
+}
+
+func (m Money) Sub(o Money) (Money, error) {
+	if o.Amount == math.MinInt64 {
+		return Money{}, invalidf("amount overflow")
+	}
+	return m.Add(o.Neg())
+}
+
+// Cmp compares two amounts of the same currency, returning -1, 0 or +1.
+func (m Money) Cmp(o Money) (int, error) {
+	if !m.SameCurrency(o) {
+		return 0, invalidf("currency mismatch: %s and %s", m.Currency, o.Currency)
+	}
+	switch {
+	case m.Amount < o.Amount:
+		return -1, nil
+	case m.Amount > o.Amount:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// MulRat multiplies m by r and rounds the result to the nearest minor unit,
+// with ties going to the even neighbour (banker's rounding).
+func (m Money) MulRat(r *big.Rat) Money {
+	prod := new(big.Rat).Mul(new(big.Rat).SetInt64(m.Amount), r)
+	return Money{Amount: roundHalfEven(prod), Currency: m.Currency}
+}
+
+func roundHalfEven(r *big.Rat) int64 {
+	num, den := r.Num(), r.Denom()
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+
+	// compare 2*|rem| against den to decide which way to round
+	twice := new(big.Int).Abs(rem)
+	twice.Lsh(twice, 1)
+	switch c := twice.Cmp(den); {
+	case c > 0, c == 0 && q.Bit(0) == 1:
+		if num.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q.Int64()
+}
+
+// formatDecimal prints r rounded to the given number of decimal places,
+// without trailing zeros.
+func formatDecimal(r *big.Rat, places int) string {
+	s := r.FloatString(places)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
+
+// Decimal formats the amount in major units, e.g. "10.25".
+func (m Money) Decimal() string {
+	exp, ok := currencyExponents[m.Currency]
+	switch {
+	case m.Currency == "":
+		exp = bareExponent
+	case !ok:
+		exp = 2
+	}
+	abs := new(big.Int).Abs(big.NewInt(m.Amount)).String()
+	sign := ""
+	if m.Amount < 0 {
+		sign = "-"
+	}
+	if exp == 0 {
+		return sign + abs
+	}
+	if len(abs) <= exp {
+		abs = strings.Repeat("0", exp-len(abs)+1) + abs
+	}
+	return sign + abs[:len(abs)-exp] + "." + abs[len(abs)-exp:]
+}
+
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+type moneyJSON struct {
+	Amount   json.RawMessage `json:"amount"`
+	Currency string          `json:"currency"`
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+	}{m.Decimal(), m.Currency})
+}
+
+// UnmarshalJSON accepts a JSON number (10.25), a decimal string ("10.25") or
+// an object {"amount": "10.25", "currency": "USD"}. Bare amounts are left
+// without a currency for the handler to put in the account's with
+// inCurrency. Numbers are parsed from their literal text, so no float
+// rounding ever happens.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	currency := ""
+	if len(data) > 0 && data[0] == '{' {
+		var obj moneyJSON
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return err
+		}
+		if obj.Currency != "" {
+			currency = strings.ToUpper(obj.Currency)
+		}
+		data = bytes.TrimSpace(obj.Amount)
+	}
+
+	var lit string
+	switch {
+	case len(data) > 0 && data[0] == '"':
+		if err := json.Unmarshal(data, &lit); err != nil {
+			return err
+		}
+	default:
+		var num json.Number
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&num); err != nil {
+			return invalidf("invalid amount %s", data)
+		}
+		lit = num.String()
+	}
+	if strings.ContainsAny(lit, "eE") {
+		return invalidf("invalid amount %q: exponent notation is not supported", lit)
+	}
+
+	var parsed Money
+	var err error
+	if currency == "" {
+		parsed, err = parseMinor(lit, bareExponent, "")
+	} else {
+		parsed, err = ParseMoney(lit, currency)
+	}
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// UnmarshalYAML lets config files write amounts like UnmarshalJSON does:
+// "1000.00" in DefaultCurrency, or {amount: "1000.00", currency: EUR}.
+func (m *Money) UnmarshalYAML(value *yaml.Node) error {
+	amount, currency := value.Value, DefaultCurrency
+	if value.Kind == yaml.MappingNode {
+		var obj struct {
+			Amount   string `yaml:"amount"`
+			Currency string `yaml:"currency"`
+		}
+		if err := value.Decode(&obj); err != nil {
+			return err
+		}
+		amount = obj.Amount
+		if obj.Currency != "" {
+			currency = strings.ToUpper(obj.Currency)
+		}
+	}
+
+	parsed, err := ParseMoney(amount, currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
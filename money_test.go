@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func usd(minor int64) Money {
+	return NewMoney(minor, "USD")
+}
+
+func TestParseMoney(t *testing.T) {
+	cases := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"10.25", 1025, true},
+		{"10", 1000, true},
+		{"0.1", 10, true},
+		{".5", 50, true},
+		{"-3.07", -307, true},
+		{"1.250", 125, true},
+		{"10.255", 0, false},
+		{"1.", 0, false},
+		{"abc", 0, false},
+		{"", 0, false},
+		{"99999999999999999999", 0, false},
+	}
+	for _, c := range cases {
+		m, err := ParseMoney(c.in, "USD")
+		if !c.ok {
+			assert.NotNil(t, err, c.in)
+			continue
+		}
+		assert.Nil(t, err, c.in)
+		assert.Equal(t, c.want, m.Amount, c.in)
+	}
+
+	m, err := ParseMoney("1500", "JPY")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1500), m.Amount)
+	_, err = ParseMoney("1.5", "JPY")
+	assert.NotNil(t, err)
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var req DepositRequest
+	err := json.Unmarshal([]byte(`{"accountnumber": 1, "amount": 10.25}`), &req)
+	assert.Nil(t, err)
+	amount, err := req.Amount.inCurrency("USD")
+	assert.Nil(t, err)
+	assert.Equal(t, usd(1025), amount)
+
+	// bare amounts take the currency of the account they are for
+	err = json.Unmarshal([]byte(`{"amount": "500"}`), &req)
+	assert.Nil(t, err)
+	amount, err = req.Amount.inCurrency("JPY")
+	assert.Nil(t, err)
+	assert.Equal(t, NewMoney(500, "JPY"), amount)
+	amount, err = req.Amount.inCurrency("BHD")
+	assert.Nil(t, err)
+	assert.Equal(t, NewMoney(500000, "BHD"), amount)
+
+	err = json.Unmarshal([]byte(`{"amount": "0.07"}`), &req)
+	assert.Nil(t, err)
+	_, err = req.Amount.inCurrency("JPY")
+	assert.True(t, errors.Is(err, ErrInvalid))
+	amount, err = req.Amount.inCurrency("EUR")
+	assert.Nil(t, err)
+	assert.Equal(t, NewMoney(7, "EUR"), amount)
+
+	err = json.Unmarshal([]byte(`{"amount": {"amount": "12", "currency": "eur"}}`), &req)
+	assert.Nil(t, err)
+	assert.Equal(t, NewMoney(1200, "EUR"), req.Amount)
+
+	assert.NotNil(t, json.Unmarshal([]byte(`{"amount": 1e3}`), &req))
+	assert.NotNil(t, json.Unmarshal([]byte(`{"amount": 0.0001}`), &req))
+	assert.NotNil(t, json.Unmarshal([]byte(`{"amount": {"amount": "0.001", "currency": "USD"}}`), &req))
+
+	out, err := json.Marshal(usd(-5))
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"amount": "-0.05", "currency": "USD"}`, string(out))
+}
+
+func TestMoneyMulRatRoundsHalfEven(t *testing.T) {
+	half := big.NewRat(1, 2)
+	assert.Equal(t, usd(2), usd(5).MulRat(half))   // 2.5 -> 2
+	assert.Equal(t, usd(4), usd(7).MulRat(half))   // 3.5 -> 4
+	assert.Equal(t, usd(-2), usd(-5).MulRat(half)) // -2.5 -> -2
+	assert.Equal(t, usd(3), usd(10).MulRat(big.NewRat(1, 3)))
+}
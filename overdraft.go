@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// OverdraftConfig sets the fee charged when an account goes into overdraft
+// and the largest limit customers can opt into themselves. Admins are not
+// held to MaxLimit; a zero MaxLimit lets customers pick any limit. Accounts
+// in other currencies get both converted at the mid rate.
+type OverdraftConfig struct {
+	Fee      Money `yaml:"fee"`
+	MaxLimit Money `yaml:"max_limit"`
+}
+
+func (c OverdraftConfig) validate() error {
+	if c.Fee.IsNegative() || c.MaxLimit.IsNegative() {
+		return fmt.Errorf("overdraft fee and max limit must not be negative")
+	}
+	return nil
+}
+
+// checkOverdraft verifies that limit and fee can be set on acc. The limit
+// may not be cut below what the account already owes.
+func checkOverdraft(acc *Account, limit, fee Money) error {
+	if !acc.Balance.SameCurrency(limit) || !acc.Balance.SameCurrency(fee) {
+		return invalidf("account %d is in %s, overdraft limit and fee must be too", acc.AccountNumber, acc.Balance.Currency)
+	}
+	if acc.Status == StatusClosed {
+		return conflictf("account %d is closed", acc.AccountNumber)
+	}
+	if acc.Balance.Amount < -limit.Amount {
+		return conflictf("account %d is overdrawn by %s, more than the new limit", acc.AccountNumber, acc.Balance.Neg())
+	}
+	return nil
+}
+
+// handleSetOverdraft lets customers opt their own account into an overdraft
+// up to the configured maximum, and admins set any limit and fee.
+func (s *APIServer) handleSetOverdraft(w http.ResponseWriter, r *http.Request) error {
+	id, err := accountID(r)
+	if err != nil {
+		return err
+	}
+	caller := r.Context().Value("account").(*Account)
+	isAdmin := caller.Role.Can(PermManageOverdraft)
+	if caller.ID != id && !isAdmin {
+		return forbidden("You can only manage your own account")
+	}
+
+	req := new(SetOverdraftRequest)
+	if err := decodeJSON(r, req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if err := req.validate(); err != nil {
+		return err
+	}
+
+	account, err := s.store.GetAccountById(id)
+	if err != nil {
+		return err
+	}
+	currency := account.Balance.Currency
+	if *req.Limit, err = req.Limit.inCurrency(currency); err != nil {
+		return fieldError("limit", "%v", err)
+	}
+	if req.Fee != nil {
+		if *req.Fee, err = req.Fee.inCurrency(currency); err != nil {
+			return fieldError("fee", "%v", err)
+		}
+	}
+	if !req.Limit.SameCurrency(account.Balance) {
+		return fieldError("limit", "must be in %s, the account's currency", currency)
+	}
+	rates, err := s.store.GetFXRates()
+	if err != nil {
+		return err
+	}
+	max, err := convertMid(rates, s.config.Overdraft.MaxLimit, currency)
+	if err != nil {
+		return conflict("no exchange rate to apply the %s overdraft maximum to %s accounts", s.config.Overdraft.MaxLimit.Currency, currency)
+	}
+
+	var fee Money
+	if req.Fee != nil {
+		if !isAdmin {
+			return forbidden("Only admins can set the overdraft fee")
+		}
+		fee = *req.Fee
+	} else if fee, err = convertMid(rates, s.config.Overdraft.Fee, currency); err != nil {
+		return conflict("no exchange rate to apply the %s overdraft fee to %s accounts", s.config.Overdraft.Fee.Currency, currency)
+	}
+	if !isAdmin && !max.IsZero() && req.Limit.Amount > max.Amount {
+		return fieldError("limit", "must not be more than %s", max)
+	}
+
+	if err := s.store.SetOverdraft(id, *req.Limit, fee); err != nil {
+		return err
+	}
+	if account, err = s.store.GetAccountById(id); err != nil {
+		return err
+	}
+	fmt.Printf("Set overdraft of account %d to %s, fee %s\n", account.AccountNumber, account.OverdraftLimit, account.OverdraftFee)
+
+	return writeJson(w, http.StatusOK, newAccountResponse(account))
+}
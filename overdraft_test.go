@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverdraftFeeOnCrossingZero(t *testing.T) {
+	store := NewMemoryStore()
+	acc := newTestAccount(t, store, 1008)
+	_, err := store.CreateTransaction(0, 1008, "deposit", usd(5000))
+	assert.Nil(t, err)
+	assert.Nil(t, store.SetOverdraft(acc.ID, usd(10000), usd(500)))
+
+	// 100.00 left in the overdraft, the fee has to fit as well
+	var insufficient *InsufficientFundsError
+	_, err = store.CreateTransaction(1008, 0, "withdraw", usd(14600))
+	assert.True(t, errors.As(err, &insufficient))
+
+	updated, err := store.CreateTransaction(1008, 0, "withdraw", usd(8000))
+	assert.Nil(t, err)
+	assert.Equal(t, usd(-3500), updated.Balance)
+
+	// already overdrawn, so no second fee
+	updated, err = store.CreateTransaction(1008, 0, "withdraw", usd(6500))
+	assert.Nil(t, err)
+	assert.Equal(t, usd(-10000), updated.Balance)
+	_, err = store.CreateTransaction(1008, 0, "withdraw", usd(1))
+	assert.True(t, errors.As(err, &insufficient))
+
+	fees, err := store.GetTransactions(1008, TransactionFilter{Types: []string{"fee"}})
+	assert.Nil(t, err)
+	assert.Len(t, fees, 1)
+	assert.Equal(t, usd(500), fees[0].Amount)
+	income, err := store.GetLedgerBalance(LedgerFeeIncome, DefaultCurrency)
+	assert.Nil(t, err)
+	assert.Equal(t, usd(500), income)
+	mismatches, err := store.ReconcileBalances()
+	assert.Nil(t, err)
+	assert.Empty(t, mismatches)
+
+	// the limit cannot be cut below what is owed
+	err = store.SetOverdraft(acc.ID, usd(5000), usd(500))
+	assert.True(t, errors.Is(err, ErrConflict))
+}
+
+func TestSetOverdraftEndpoint(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	server.config.Overdraft = OverdraftConfig{Fee: usd(2500), MaxLimit: usd(50000)}
+	admin := newTestAccount(t, store, 1008)
+	acc := newTestAccount(t, store, 1016)
+	assert.Nil(t, store.SetAccountRole(admin.ID, RoleAdmin))
+
+	adminToken := login(t, server, 1008, "password").Token
+	token := login(t, server, 1016, "password").Token
+	path := "/account/" + strconv.Itoa(acc.ID) + "/overdraft"
+
+	w := doRequest(server, "PUT", path, token, SetOverdraftRequest{Limit: ptr(usd(50001))})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(server, "PUT", path, token, SetOverdraftRequest{Limit: ptr(usd(10000)), Fee: ptr(usd(0))})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = doRequest(server, "PUT", "/account/"+strconv.Itoa(admin.ID)+"/overdraft", token, SetOverdraftRequest{Limit: ptr(usd(10000))})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = doRequest(server, "PUT", path, token, SetOverdraftRequest{Limit: ptr(usd(10000))})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp AccountResponse
+	assert.Nil(t, jsonDecode(w, &resp))
+	assert.Equal(t, usd(10000), *resp.OverdraftLimit)
+	assert.Equal(t, usd(2500), *resp.OverdraftFee)
+
+	w = doRequest(server, "POST", "/withdraw", token, WithdrawRequest{AccountNumber: 1016, Amount: usd(5000)})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	resp = AccountResponse{}
+	assert.Nil(t, jsonDecode(w, &resp))
+	assert.Equal(t, usd(-7500), resp.Balance)
+
+	// admins are not held to the maximum and can waive the fee
+	w = doRequest(server, "PUT", path, adminToken, SetOverdraftRequest{Limit: ptr(usd(100000)), Fee: ptr(usd(0))})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func TestSetOverdraftInOtherCurrencies(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	server.config.Overdraft = OverdraftConfig{Fee: usd(2500), MaxLimit: usd(50000)}
+	acc := newTestAccount(t, store, 1008)
+	store.accounts[acc.ID].Balance = NewMoney(0, "EUR")
+	token := login(t, server, 1008, "password").Token
+	path := "/account/" + strconv.Itoa(acc.ID) + "/overdraft"
+
+	w := doRequest(server, "PUT", path, token, SetOverdraftRequest{Limit: ptr(NewMoney(10000, "EUR"))})
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+
+	assert.Nil(t, store.SetFXRates([]*FXRate{{Base: "EUR", Quote: "USD", Rate: "1.25"}}))
+	w = doRequest(server, "PUT", path, token, SetOverdraftRequest{Limit: ptr(NewMoney(40001, "EUR"))})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(server, "PUT", path, token, SetOverdraftRequest{Limit: ptr(usd(10000))})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doRequest(server, "PUT", path, token, SetOverdraftRequest{Limit: ptr(NewMoney(40000, "EUR"))})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp AccountResponse
+	assert.Nil(t, jsonDecode(w, &resp))
+	assert.Equal(t, NewMoney(40000, "EUR"), *resp.OverdraftLimit)
+	assert.Equal(t, NewMoney(2000, "EUR"), *resp.OverdraftFee)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Role decides what an authenticated account may do beyond operating on
+// its own account.
+type Role string
+
+const (
+	RoleCustomer Role = "customer"
+	RoleTeller   Role = "teller"
+	RoleAdmin    Role = "admin"
+)
+
+type Permission string
+
+const (
+	PermViewAnyAccount  Permission = "accounts:view"
+	PermListAccounts    Permission = "accounts:list"
+	PermManageStatus    Permission = "accounts:status"
+	PermCloseAccount    Permission = "accounts:close"
+	PermManageRoles     Permission = "roles:manage"
+	PermUnlockLogin     Permission = "logins:unlock"
+	PermManageLimits    Permission = "limits:manage"
+	PermManageOverdraft Permission = "overdraft:manage"
+	PermManageFX        Permission = "fx:manage"
+)
+
+// rolePermissions lists what each role is granted. Customers get nothing
+// here: access to their own account is checked by the handlers.
+var rolePermissions = map[Role][]Permission{
+	RoleCustomer: nil,
+	RoleTeller:   {PermViewAnyAccount},
+	RoleAdmin:    {PermViewAnyAccount, PermListAccounts, PermManageStatus, PermCloseAccount, PermManageRoles, PermUnlockLogin, PermManageLimits, PermManageOverdraft, PermManageFX},
+}
+
+func (r Role) Valid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+func (r Role) Can(perm Permission) bool {
+	for _, p := range rolePermissions[r] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// RequirePermission rejects requests whose account lacks perm. It must run
+// inside JWTauthMiddleWare, and checks the role currently stored on the
+// account rather than the one in the token, so a demotion takes effect
+// immediately.
+func RequirePermission(handlerFunc http.HandlerFunc, perm Permission) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		account, ok := r.Context().Value("account").(*Account)
+		if !ok {
+			permissionDenied(w)
+			return
+		}
+		if !account.Role.Can(perm) {
+			writeJson(w, http.StatusForbidden, forbidden("You are not allowed to perform this action"))
+			return
+		}
+		handlerFunc(w, r)
+	}
+}
+
+// canAccess reports whether the authenticated account may read the account
+// with the given id.
+func canAccess(account *Account, id int) bool {
+	return account.ID == id || account.Role.Can(PermViewAnyAccount)
+}
+
+func accountID(r *http.Request) (int, error) {
+	idStr := mux.Vars(r)["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return 0, badRequest("invalid account id %s", idStr)
+	}
+	return id, nil
+}
+
+func (s *APIServer) handleSetAccountRole(w http.ResponseWriter, r *http.Request) error {
+	id, err := accountID(r)
+	if err != nil {
+		return err
+	}
+
+	req := new(SetRoleRequest)
+	if err := decodeJSON(r, req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if !req.Role.Valid() {
+		return fieldError("role", "must be one of customer, teller or admin")
+	}
+	// stops the last admin from locking everyone out by accident
+	if admin := r.Context().Value("account").(*Account); admin.ID == id {
+		return forbidden("You cannot change your own role")
+	}
+	fmt.Printf("Setting role of account %d to %s\n", id, req.Role)
+
+	if err := s.store.SetAccountRole(id, req.Role); err != nil {
+		return err
+	}
+	account, err := s.store.GetAccountById(id)
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, newAccountResponse(account))
+}
+
+// runRoleCommand implements `gobank role <accountnumber> <role>`, which is
+// how the first admin gets created.
+func runRoleCommand(store Storage, args []string, legacy []int) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: gobank role <accountnumber> <customer|teller|admin>")
+	}
+	number, err := strconv.Atoi(args[0])
+	if err != nil || checkAccountNumber("accountnumber", number, legacy) != nil {
+		return fmt.Errorf("invalid account number %s", args[0])
+	}
+	role := Role(args[1])
+	if !role.Valid() {
+		return fmt.Errorf("unknown role %q", args[1])
+	}
+
+	account, err := store.GetAccountByNumber(number)
+	if err != nil {
+		return err
+	}
+	if err := store.SetAccountRole(account.ID, role); err != nil {
+		return err
+	}
+	fmt.Printf("Account %d is now %s\n", number, role)
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRolePermissions(t *testing.T) {
+	assert.False(t, RoleCustomer.Can(PermViewAnyAccount))
+	assert.True(t, RoleTeller.Can(PermViewAnyAccount))
+	assert.False(t, RoleTeller.Can(PermCloseAccount))
+	assert.True(t, RoleAdmin.Can(PermManageRoles))
+	assert.False(t, Role("root").Valid())
+}
+
+func TestAdminOnlyAccountRoutes(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	admin := newTestAccount(t, store, 1008)
+	teller := newTestAccount(t, store, 1016)
+	customer := newTestAccount(t, store, 1024)
+	assert.Nil(t, store.SetAccountRole(admin.ID, RoleAdmin))
+	assert.Nil(t, store.SetAccountRole(teller.ID, RoleTeller))
+
+	adminToken := login(t, server, 1008, "password").Token
+	tellerToken := login(t, server, 1016, "password").Token
+	customerToken := login(t, server, 1024, "password").Token
+
+	assert.Equal(t, http.StatusUnauthorized, doRequest(server, "GET", "/account", "", nil).Code)
+	assert.Equal(t, http.StatusForbidden, doRequest(server, "GET", "/account", customerToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, doRequest(server, "GET", "/account", tellerToken, nil).Code)
+	assert.Equal(t, http.StatusOK, doRequest(server, "GET", "/account", adminToken, nil).Code)
+
+	// tellers can look at other accounts but not change them
+	customerPath := "/account/" + strconv.Itoa(customer.ID)
+	assert.Equal(t, http.StatusOK, doRequest(server, "GET", customerPath, tellerToken, nil).Code)
+	assert.Equal(t, http.StatusOK, doRequest(server, "GET", customerPath+"/transactions", tellerToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, doRequest(server, "GET", "/account/"+strconv.Itoa(admin.ID), customerToken, nil).Code)
+	assert.Equal(t, http.StatusForbidden, doRequest(server, "DELETE", customerPath, tellerToken, nil).Code)
+
+	w := doRequest(server, "PUT", customerPath+"/role", adminToken, SetRoleRequest{Role: "root"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(server, "PUT", "/account/"+strconv.Itoa(admin.ID)+"/role", adminToken, SetRoleRequest{Role: RoleCustomer})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// demoting the teller takes effect on their existing token
+	w = doRequest(server, "PUT", "/account/"+strconv.Itoa(teller.ID)+"/role", adminToken, SetRoleRequest{Role: RoleCustomer})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, http.StatusForbidden, doRequest(server, "GET", customerPath, tellerToken, nil).Code)
+
+	assert.Equal(t, http.StatusOK, doRequest(server, "DELETE", customerPath, adminToken, nil).Code)
+	closed, err := store.GetAccountById(customer.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusClosed, closed.Status)
+}
+
+func TestFrozenAccountCannotSendMoney(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	admin := newTestAccount(t, store, 1008)
+	acc := newTestAccount(t, store, 1016)
+	assert.Nil(t, store.SetAccountRole(admin.ID, RoleAdmin))
+	_, err := store.CreateTransaction(0, 1016, "deposit", usd(5000))
+	assert.Nil(t, err)
+
+	adminToken := login(t, server, 1008, "password").Token
+	token := login(t, server, 1016, "password").Token
+	accountPath := "/account/" + strconv.Itoa(acc.ID)
+
+	assert.Equal(t, http.StatusForbidden, doRequest(server, "POST", accountPath+"/freeze", token, nil).Code)
+	assert.Equal(t, http.StatusOK, doRequest(server, "POST", accountPath+"/freeze", adminToken, nil).Code)
+
+	w := doRequest(server, "POST", "/withdraw", token, WithdrawRequest{AccountNumber: 1016, Amount: usd(100)})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	// money can still come in
+	w = doRequest(server, "POST", "/deposit", token, DepositRequest{AccountNumber: 1016, Amount: usd(100)})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	assert.Equal(t, http.StatusOK, doRequest(server, "POST", accountPath+"/unfreeze", adminToken, nil).Code)
+	w = doRequest(server, "POST", "/withdraw", token, WithdrawRequest{AccountNumber: 1016, Amount: usd(100)})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"math/big"
+	"time"
+)
+
+// The types in this file are the only shapes handlers write to clients.
+// Storage models (Account, Transaction) are mapped onto them field by field,
+// so a new column on a model never leaks into a response by accident.
+
+type AccountResponse struct {
+	ID            int        `json:"id"`
+	FirstName     string     `json:"firstname"`
+	LastName      string     `json:"lastname"`
+	AccountNumber int        `json:"accountnumber"`
+	IBAN          string     `json:"iban,omitempty"`
+	Balance       Money      `json:"balance"`
+	Role          Role       `json:"role"`
+	Status        string     `json:"status"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	Version       int        `json:"version"`
+	ClosedAt      *time.Time `json:"closedAt,omitempty"`
+	// only set for accounts with an overdraft
+	OverdraftLimit *Money `json:"overdraftLimit,omitempty"`
+	OverdraftFee   *Money `json:"overdraftFee,omitempty"`
+	Product        string `json:"product,omitempty"`
+}
+
+type TransactionResponse struct {
+	ID          int    `json:"id"`
+	FromAccount int    `json:"fromAccount"`
+	ToAccount   int    `json:"toAccount"`
+	Type        string `json:"type"`
+	Amount      Money  `json:"amount"`
+	// the amount credited, for transfers between currencies
+	ConvertedAmount *Money    `json:"convertedAmount,omitempty"`
+	Rate            string    `json:"rate,omitempty"`
+	Spread          string    `json:"spread,omitempty"`
+	QuoteID         string    `json:"quoteId,omitempty"`
+	CreatedAt       time.Time `json:"createdAt"`
+	Direction       string    `json:"direction,omitempty"`
+}
+
+type FXRateResponse struct {
+	Pair      string    `json:"pair"`
+	Rate      string    `json:"rate"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type FXQuoteResponse struct {
+	ID        string    `json:"id"`
+	Amount    Money     `json:"amount"`
+	Converted Money     `json:"convertedAmount"`
+	Rate      string    `json:"rate"`
+	Spread    string    `json:"spread"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type TOTPEnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauthUri"`
+}
+
+type TOTPConfirmResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// LimitsResponse shows an account's limits and what is left of the rolling
+// allowances. The remaining amounts are left out for windows without a limit.
+type LimitsResponse struct {
+	SingleMax        Money  `json:"singleMax"`
+	DailyMax         Money  `json:"dailyMax"`
+	MonthlyMax       Money  `json:"monthlyMax"`
+	DailyUsed        Money  `json:"dailyUsed"`
+	MonthlyUsed      Money  `json:"monthlyUsed"`
+	DailyRemaining   *Money `json:"dailyRemaining,omitempty"`
+	MonthlyRemaining *Money `json:"monthlyRemaining,omitempty"`
+	Custom           bool   `json:"custom"`
+}
+
+type TransactionPage struct {
+	Transactions []TransactionResponse `json:"transactions"`
+	NextCursor   int                   `json:"nextCursor,omitempty"`
+}
+
+func newAccountResponse(a *Account) AccountResponse {
+	resp := AccountResponse{
+		ID:            a.ID,
+		FirstName:     a.FirstName,
+		LastName:      a.LastName,
+		AccountNumber: a.AccountNumber,
+		IBAN:          a.IBAN,
+		Balance:       a.Balance,
+		Role:          a.Role,
+		Status:        a.Status,
+		CreatedAt:     a.CreatedAt,
+		Version:       a.Version,
+		Product:       a.Product,
+	}
+	if !a.ClosedAt.IsZero() {
+		resp.ClosedAt = &a.ClosedAt
+	}
+	if !a.OverdraftLimit.IsZero() {
+		resp.OverdraftLimit = &a.OverdraftLimit
+		resp.OverdraftFee = &a.OverdraftFee
+	}
+	return resp
+}
+
+func newAccountResponses(accounts []*Account) []AccountResponse {
+	resp := make([]AccountResponse, 0, len(accounts))
+	for _, a := range accounts {
+		resp = append(resp, newAccountResponse(a))
+	}
+	return resp
+}
+
+func newLimitsResponse(l AccountLimits, totals DebitTotals, custom bool) LimitsResponse {
+	resp := LimitsResponse{
+		SingleMax:   l.SingleMax,
+		DailyMax:    l.DailyMax,
+		MonthlyMax:  l.MonthlyMax,
+		DailyUsed:   totals.Daily,
+		MonthlyUsed: totals.Monthly,
+		Custom:      custom,
+	}
+	if !l.DailyMax.IsZero() {
+		left := remaining(l.DailyMax, totals.Daily)
+		resp.DailyRemaining = &left
+	}
+	if !l.MonthlyMax.IsZero() {
+		left := remaining(l.MonthlyMax, totals.Monthly)
+		resp.MonthlyRemaining = &left
+	}
+	return resp
+}
+
+func newTransactionResponse(tx *Transaction) TransactionResponse {
+	resp := TransactionResponse{
+		ID:          tx.ID,
+		FromAccount: tx.FromAccount,
+		ToAccount:   tx.ToAccount,
+		Type:        tx.Type,
+		Amount:      tx.Amount,
+		CreatedAt:   tx.CreatedAt,
+		Direction:   tx.Direction,
+		Rate:        tx.FXRate,
+		Spread:      tx.FXSpread,
+		QuoteID:     tx.FXQuoteID,
+	}
+	if tx.Converted.Currency != "" {
+		resp.ConvertedAmount = &tx.Converted
+	}
+	return resp
+}
+
+func newTransactionResponses(transactions []*Transaction) []TransactionResponse {
+	resp := make([]TransactionResponse, 0, len(transactions))
+	for _, tx := range transactions {
+		resp = append(resp, newTransactionResponse(tx))
+	}
+	return resp
+}
+
+func newFXRateResponses(rates []*FXRate) []FXRateResponse {
+	resp := make([]FXRateResponse, 0, len(rates))
+	for _, r := range rates {
+		resp = append(resp, FXRateResponse{Pair: r.Pair(), Rate: r.Rate, UpdatedAt: r.UpdatedAt})
+	}
+	return resp
+}
+
+func newFXQuoteResponse(q *FXQuote) FXQuoteResponse {
+	return FXQuoteResponse{
+		ID:        q.ID,
+		Amount:    q.Amount,
+		Converted: q.Converted,
+		Rate:      q.Rate,
+		Spread:    q.Spread,
+		ExpiresAt: q.ExpiresAt,
+	}
+}
+
+type StandingOrderResponse struct {
+	ID             int                        `json:"id"`
+	FromAccount    int                        `json:"fromAccount"`
+	ToAccount      int                        `json:"toAccount"`
+	Amount         Money                      `json:"amount"`
+	Schedule       string                     `json:"schedule"`
+	DayOfMonth     int                        `json:"dayOfMonth,omitempty"`
+	StartAt        time.Time                  `json:"startAt"`
+	EndAt          *time.Time                 `json:"endAt,omitempty"`
+	Status         string                     `json:"status"`
+	NextRunAt      *time.Time                 `json:"nextRunAt,omitempty"`
+	FailedAttempts int                        `json:"failedAttempts,omitempty"`
+	NextRetryAt    *time.Time                 `json:"nextRetryAt,omitempty"`
+	CreatedAt      time.Time                  `json:"createdAt"`
+	Runs           []StandingOrderRunResponse `json:"runs,omitempty"`
+}
+
+type StandingOrderRunResponse struct {
+	DueAt      time.Time `json:"dueAt"`
+	Attempt    int       `json:"attempt"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	ExecutedAt time.Time `json:"executedAt"`
+}
+
+func newStandingOrderResponse(o *StandingOrder, runs []*StandingOrderRun) StandingOrderResponse {
+	resp := StandingOrderResponse{
+		ID:          o.ID,
+		FromAccount: o.FromAccount,
+		ToAccount:   o.ToAccount,
+		Amount:      o.Amount,
+		Schedule:    o.Schedule,
+		DayOfMonth:  o.DayOfMonth,
+		StartAt:     o.StartAt,
+		EndAt:       o.EndAt,
+		Status:      o.Status,
+		CreatedAt:   o.CreatedAt,
+	}
+	if o.Status == OrderActive {
+		next := o.NextRunAt
+		resp.NextRunAt = &next
+		if o.Attempts > 0 {
+			retry := o.NextAttemptAt
+			resp.FailedAttempts, resp.NextRetryAt = o.Attempts, &retry
+		}
+	}
+	for _, run := range runs {
+		resp.Runs = append(resp.Runs, StandingOrderRunResponse{
+			DueAt:      run.DueAt,
+			Attempt:    run.Attempt,
+			Status:     run.Status,
+			Error:      run.Error,
+			ExecutedAt: run.ExecutedAt,
+		})
+	}
+	return resp
+}
+
+// InterestResponse shows the interest a savings account has accrued but
+// not been paid yet, in major units with fractions of a minor unit.
+type InterestResponse struct {
+	AnnualRate     string     `json:"annualRate"`
+	DayCount       string     `json:"dayCount"`
+	Currency       string     `json:"currency"`
+	Accrued        string     `json:"accrued"`
+	AccruedThrough *time.Time `json:"accruedThrough,omitempty"`
+	PaidThrough    *time.Time `json:"paidThrough,omitempty"`
+}
+
+func newInterestResponse(a *Account, state *InterestState, savings SavingsConfig) InterestResponse {
+	resp := InterestResponse{
+		AnnualRate: savings.AnnualRate,
+		DayCount:   savings.DayCount,
+		Currency:   a.Balance.Currency,
+		Accrued:    "0",
+	}
+	if accrued, ok := new(big.Rat).SetString(state.Accrued); ok {
+		exp, _ := currencyExponent(a.Balance.Currency)
+		accrued.Quo(accrued, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil)))
+		resp.Accrued = formatDecimal(accrued, accrualDecimals+exp)
+	}
+	if !state.AccruedThrough.IsZero() {
+		resp.AccruedThrough = &state.AccruedThrough
+	}
+	if !state.PaidThrough.IsZero() {
+		resp.PaidThrough = &state.PaidThrough
+	}
+	return resp
+}
+
+type FeeResponse struct {
+	Rule   string `json:"rule"`
+	Amount Money  `json:"amount"`
+}
+
+// FeePreviewResponse lists the fees a transaction would be charged. Fees
+// are always taken from the account, on top of the amount for debits.
+type FeePreviewResponse struct {
+	Amount    Money         `json:"amount"`
+	Fees      []FeeResponse `json:"fees"`
+	TotalFees Money         `json:"totalFees"`
+}
+
+func newFeePreviewResponse(amount Money, fees []Fee) FeePreviewResponse {
+	resp := FeePreviewResponse{Amount: amount, Fees: []FeeResponse{}, TotalFees: NewMoney(0, amount.Currency)}
+	for _, fee := range fees {
+		resp.Fees = append(resp.Fees, FeeResponse{Rule: fee.Rule, Amount: fee.Amount})
+		resp.TotalFees.Amount += fee.Amount.Amount
+	}
+	return resp
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func assertNoSecrets(t *testing.T, body string) {
+	t.Helper()
+	assert.NotContains(t, strings.ToLower(body), "password")
+	assert.NotContains(t, body, "$2a$")
+}
+
+func TestResponsesNeverContainPasswordHashes(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+
+	w := doRequest(server, "POST", "/account", "", CreateAccountRequest{FirstName: "John", LastName: "Doe", Password: "s3cret-pass"})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assertNoSecrets(t, w.Body.String())
+	var created AccountResponse
+	assert.Nil(t, jsonDecode(w, &created))
+	assert.True(t, validAccountNumber(created.AccountNumber))
+	number := created.AccountNumber
+
+	newTestAccount(t, store, 1016)
+	assert.Nil(t, store.SetAccountRole(created.ID, RoleAdmin))
+	token := login(t, server, number, "s3cret-pass").Token
+
+	for _, tc := range []struct {
+		method, target string
+		body           any
+	}{
+		{"GET", "/account", nil},
+		{"GET", "/account/" + strconv.Itoa(created.ID), nil},
+		{"POST", "/deposit", DepositRequest{AccountNumber: number, Amount: usd(1000)}},
+		{"POST", "/withdraw", WithdrawRequest{AccountNumber: number, Amount: usd(100)}},
+		{"POST", "/transfer", TransferRequest{FromAccountNumber: number, ToAccountNumber: 1016, Amount: usd(100)}},
+		{"GET", "/account/" + strconv.Itoa(created.ID) + "/transactions", nil},
+		{"POST", "/account/2/freeze", nil},
+		{"PUT", "/account/2/role", SetRoleRequest{Role: RoleTeller}},
+	} {
+		w := doRequest(server, tc.method, tc.target, token, tc.body)
+		assert.Equal(t, http.StatusOK, w.Code, "%s %s: %s", tc.method, tc.target, w.Body.String())
+		assertNoSecrets(t, w.Body.String())
+	}
+}
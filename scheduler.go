@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// SchedulerConfig controls the in-process scheduler that executes standing
+// orders. A failed run is retried up to MaxAttempts times in total, waiting
+// RetryDelay before the first retry and twice as long before each one
+// after that.
+type SchedulerConfig struct {
+	Interval    time.Duration `yaml:"interval"`
+	MaxAttempts int           `yaml:"max_attempts"`
+	RetryDelay  time.Duration `yaml:"retry_delay"`
+}
+
+func (c SchedulerConfig) validate() error {
+	if c.Interval <= 0 || c.RetryDelay <= 0 {
+		return fmt.Errorf("scheduler interval and retry delay must be positive")
+	}
+	if c.MaxAttempts <= 0 {
+		return fmt.Errorf("scheduler max attempts must be positive")
+	}
+	return nil
+}
+
+// retryDelay is how long to wait after the given number of failed
+// attempts.
+func (c SchedulerConfig) retryDelay(failures int) time.Duration {
+	return c.RetryDelay << (failures - 1)
+}
+
+// schedulerLease is how long a claimed order is hidden from other passes.
+// It only matters if the process dies while running an order; the order is
+// then picked up again once the lease runs out. A transfer commits together
+// with its run, so an occurrence that went through is never paid again.
+const schedulerLease = 5 * time.Minute
+
+// Scheduler executes standing orders as they fall due and accrues interest
+// on savings accounts. All its state lives in the store, so a restarted
+// server carries on where it stopped.
+type Scheduler struct {
+	store   Storage
+	config  SchedulerConfig
+	savings SavingsConfig
+}
+
+func newScheduler(store Storage, config SchedulerConfig, savings SavingsConfig) *Scheduler {
+	return &Scheduler{store: store, config: config, savings: savings}
+}
+
+// run checks for due orders and interest every Interval until the process
+// exits.
+func (s *Scheduler) run() {
+	log.Printf("Scheduler running every %s", s.config.Interval)
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now().UTC()
+		if err := s.runDue(now); err != nil {
+			log.Printf("Error running standing orders: %v", err)
+		}
+		if err := s.accrueInterest(now); err != nil {
+			log.Printf("Error accruing interest: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// runDue executes every order due at now.
+func (s *Scheduler) runDue(now time.Time) error {
+	orders, err := s.store.ClaimDueStandingOrders(now, now.Add(schedulerLease))
+	if err != nil {
+		return err
+	}
+	for _, order := range orders {
+		if err := s.execute(order, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execute makes one attempt at the order's current occurrence and records
+// the outcome. Only storage errors while recording are returned; a failed
+// transfer is part of the outcome.
+func (s *Scheduler) execute(order *StandingOrder, now time.Time) error {
+	run := &StandingOrderRun{OrderID: order.ID, DueAt: order.NextRunAt, Attempt: order.Attempts + 1, ExecutedAt: now}
+
+	// the transfer and its run are stored together, scheduled on as if it
+	// went through
+	next := *order
+	s.advance(&next, now)
+	run.Status = RunSucceeded
+	err := s.store.ExecuteStandingOrder(&next, run)
+	if err == nil {
+		fmt.Printf("Standing order %d transferred %s from account %d to account %d\n",
+			order.ID, order.Amount, order.FromAccount, order.ToAccount)
+		return nil
+	}
+	if errors.Is(err, errAlreadyPaid) {
+		// the pass that paid it has already scheduled the order on
+		log.Printf("Skipping standing order %d: %v", order.ID, err)
+		return nil
+	}
+
+	run.Status = RunFailed
+	run.Error = err.Error()
+	fmt.Printf("Standing order %d failed attempt %d: %v\n", order.ID, run.Attempt, err)
+	if run.Attempt < s.config.MaxAttempts {
+		order.Attempts = run.Attempt
+		order.NextAttemptAt = now.Add(s.config.retryDelay(run.Attempt))
+		return s.store.RecordStandingOrderRun(order, run)
+	}
+
+	// out of retries: a one-off order has failed, a recurring one gives up
+	// on this occurrence and waits for the next
+	if order.Schedule == ScheduleOnce {
+		order.Status = OrderFailed
+		order.Attempts = run.Attempt
+		return s.store.RecordStandingOrderRun(order, run)
+	}
+	s.advance(order, now)
+	return s.store.RecordStandingOrderRun(order, run)
+}
+
+// advance moves the order on to its next occurrence after now. Occurrences
+// missed while the server was down are skipped rather than paid in a burst.
+func (s *Scheduler) advance(order *StandingOrder, now time.Time) {
+	order.Attempts = 0
+	next, ok := order.nextRun(order.NextRunAt)
+	for ok && !next.After(now) {
+		next, ok = order.nextRun(next)
+	}
+	if !ok {
+		order.Status = OrderCompleted
+		return
+	}
+	order.NextRunAt = next
+	order.NextAttemptAt = next
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// How often a standing order repeats. Once is a single future-dated
+// transfer.
+const (
+	ScheduleOnce    = "once"
+	ScheduleDaily   = "daily"
+	ScheduleWeekly  = "weekly"
+	ScheduleMonthly = "monthly"
+)
+
+// Standing order states. Active orders are picked up by the scheduler;
+// the others are final.
+const (
+	OrderActive    = "active"
+	OrderCompleted = "completed"
+	OrderCancelled = "cancelled"
+	OrderFailed    = "failed"
+)
+
+// Outcomes recorded for each execution attempt.
+const (
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+)
+
+// errAlreadyPaid is returned by ExecuteStandingOrder for an occurrence that
+// already succeeded, when an earlier pass outlived its lease.
+var errAlreadyPaid = errors.New("occurrence already paid out")
+
+// StandingOrder transfers Amount from FromAccount to ToAccount on a
+// schedule. NextRunAt is when the current occurrence is due; NextAttemptAt
+// equals it unless a failed attempt is waiting to be retried, and Attempts
+// counts the failures of the current occurrence.
+type StandingOrder struct {
+	ID          int
+	FromAccount int
+	ToAccount   int
+	Amount      Money
+	Schedule    string
+	// DayOfMonth is the day monthly orders run on. Months that are too
+	// short run on their last day instead.
+	DayOfMonth    int
+	StartAt       time.Time
+	EndAt         *time.Time
+	NextRunAt     time.Time
+	NextAttemptAt time.Time
+	Attempts      int
+	Status        string
+	CreatedAt     time.Time
+}
+
+// StandingOrderRun is one attempt at executing an occurrence of a standing
+// order.
+type StandingOrderRun struct {
+	ID         int
+	OrderID    int
+	DueAt      time.Time
+	Attempt    int
+	Status     string
+	Error      string
+	ExecutedAt time.Time
+}
+
+func validSchedule(schedule string) bool {
+	switch schedule {
+	case ScheduleOnce, ScheduleDaily, ScheduleWeekly, ScheduleMonthly:
+		return true
+	}
+	return false
+}
+
+// monthlyRun returns the run of a monthly order in the given month, at the
+// time of day of tod.
+func monthlyRun(year int, month time.Month, day int, tod time.Time) time.Time {
+	first := time.Date(year, month, 1, tod.Hour(), tod.Minute(), tod.Second(), 0, time.UTC)
+	last := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(day, last)-1)
+}
+
+// firstRun returns the first occurrence at or after StartAt.
+func (o *StandingOrder) firstRun() time.Time {
+	start := o.StartAt.UTC()
+	if o.Schedule != ScheduleMonthly {
+		return start
+	}
+	run := monthlyRun(start.Year(), start.Month(), o.DayOfMonth, start)
+	if run.Before(start) {
+		run = monthlyRun(start.Year(), start.Month()+1, o.DayOfMonth, start)
+	}
+	return run
+}
+
+// nextRun returns the occurrence following the one due at prev, and false
+// when the order has no more occurrences.
+func (o *StandingOrder) nextRun(prev time.Time) (time.Time, bool) {
+	var next time.Time
+	switch o.Schedule {
+	case ScheduleDaily:
+		next = prev.AddDate(0, 0, 1)
+	case ScheduleWeekly:
+		next = prev.AddDate(0, 0, 7)
+	case ScheduleMonthly:
+		// work from the first of the month so the 31st of January does
+		// not overflow into March
+		next = monthlyRun(prev.Year(), prev.Month()+1, o.DayOfMonth, prev)
+	default:
+		return time.Time{}, false
+	}
+	if o.EndAt != nil && next.After(*o.EndAt) {
+		return time.Time{}, false
+	}
+	return next, true
+}
+
+func (s *APIServer) handleCreateStandingOrder(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.ownAccount(r)
+	if err != nil {
+		return err
+	}
+	req := new(CreateStandingOrderRequest)
+	if err := decodeJSON(r, req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if err := req.validate(time.Now(), s.config.LegacyAccountNumbers); err != nil {
+		return err
+	}
+	if req.Amount, err = req.Amount.inCurrency(account.Balance.Currency); err != nil {
+		return fieldError("amount", "%v", err)
+	}
+
+	to, err := s.store.GetAccountByNumber(req.ToAccountNumber)
+	if err != nil {
+		return err
+	}
+	switch {
+	case to.AccountNumber == account.AccountNumber:
+		return fieldError("toAccountNumber", "must be another account")
+	case !account.Balance.SameCurrency(req.Amount):
+		return &CurrencyMismatchError{AccountNumber: account.AccountNumber, AccountCurrency: account.Balance.Currency, Currency: req.Amount.Currency}
+	case !to.Balance.SameCurrency(req.Amount):
+		return &CurrencyMismatchError{AccountNumber: to.AccountNumber, AccountCurrency: to.Balance.Currency, Currency: req.Amount.Currency}
+	}
+	// the order runs unattended, so large ones are confirmed up front
+	if err := s.requireStepUp(w, r, account.AccountNumber, req.Amount); err != nil {
+		return err
+	}
+
+	order := &StandingOrder{
+		FromAccount: account.AccountNumber,
+		ToAccount:   to.AccountNumber,
+		Amount:      req.Amount,
+		Schedule:    req.Schedule,
+		DayOfMonth:  req.DayOfMonth,
+		StartAt:     req.StartAt.UTC(),
+		EndAt:       req.EndAt,
+		Status:      OrderActive,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if order.Schedule == ScheduleMonthly && order.DayOfMonth == 0 {
+		order.DayOfMonth = order.StartAt.Day()
+	}
+	order.NextRunAt = order.firstRun()
+	order.NextAttemptAt = order.NextRunAt
+	if order.EndAt != nil && order.NextRunAt.After(*order.EndAt) {
+		return fieldError("endAt", "leaves no run after startAt")
+	}
+	if err := s.store.CreateStandingOrder(order); err != nil {
+		return err
+	}
+	fmt.Printf("Created %s standing order %d from account %d to account %d for %s\n",
+		order.Schedule, order.ID, order.FromAccount, order.ToAccount, order.Amount)
+
+	return writeJson(w, http.StatusOK, newStandingOrderResponse(order, nil))
+}
+
+func (s *APIServer) handleGetStandingOrders(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.accessibleAccount(r)
+	if err != nil {
+		return err
+	}
+	orders, err := s.store.GetStandingOrders(account.AccountNumber)
+	if err != nil {
+		return err
+	}
+	resp := make([]StandingOrderResponse, 0, len(orders))
+	for _, o := range orders {
+		resp = append(resp, newStandingOrderResponse(o, nil))
+	}
+	return writeJson(w, http.StatusOK, resp)
+}
+
+// handleGetStandingOrder shows one order together with every execution
+// attempt so far.
+func (s *APIServer) handleGetStandingOrder(w http.ResponseWriter, r *http.Request) error {
+	order, err := s.accountStandingOrder(r)
+	if err != nil {
+		return err
+	}
+	runs, err := s.store.GetStandingOrderRuns(order.ID)
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, newStandingOrderResponse(order, runs))
+}
+
+// handleCancelStandingOrder stops an order from running again. Runs that
+// already happened stand.
+func (s *APIServer) handleCancelStandingOrder(w http.ResponseWriter, r *http.Request) error {
+	if _, err := s.ownAccount(r); err != nil {
+		return err
+	}
+	order, err := s.accountStandingOrder(r)
+	if err != nil {
+		return err
+	}
+	if err := s.store.CancelStandingOrder(order.ID); err != nil {
+		return err
+	}
+	order.Status = OrderCancelled
+	fmt.Printf("Cancelled standing order %d of account %d\n", order.ID, order.FromAccount)
+
+	return writeJson(w, http.StatusOK, newStandingOrderResponse(order, nil))
+}
+
+// accessibleAccount loads the account in the path if the caller may see
+// it.
+func (s *APIServer) accessibleAccount(r *http.Request) (*Account, error) {
+	id, err := accountID(r)
+	if err != nil {
+		return nil, err
+	}
+	account := r.Context().Value("account").(*Account)
+	if !canAccess(account, id) {
+		return nil, forbidden("You are not allowed to access this account")
+	}
+	if account.ID == id {
+		return account, nil
+	}
+	return s.store.GetAccountById(id)
+}
+
+// accountStandingOrder loads the order in the path, which must belong to
+// the account in the path.
+func (s *APIServer) accountStandingOrder(r *http.Request) (*StandingOrder, error) {
+	account, err := s.accessibleAccount(r)
+	if err != nil {
+		return nil, err
+	}
+	idStr := mux.Vars(r)["orderId"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return nil, badRequest("invalid standing order id %s", idStr)
+	}
+	order, err := s.store.GetStandingOrder(id)
+	if err != nil {
+		return nil, err
+	}
+	if order.FromAccount != account.AccountNumber {
+		return nil, notFound("standing order %d not found", id)
+	}
+	return order, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStandingOrderNextRun(t *testing.T) {
+	start := time.Date(2026, time.January, 31, 9, 0, 0, 0, time.UTC)
+	monthly := &StandingOrder{Schedule: ScheduleMonthly, DayOfMonth: 31, StartAt: start}
+	assert.Equal(t, start, monthly.firstRun())
+
+	// short months run on their last day and the 31st comes back after
+	var runs []string
+	for run, ok := monthly.firstRun(), true; ok && len(runs) < 4; run, ok = monthly.nextRun(run) {
+		runs = append(runs, run.Format("2006-01-02 15:04"))
+	}
+	assert.Equal(t, []string{"2026-01-31 09:00", "2026-02-28 09:00", "2026-03-31 09:00", "2026-04-30 09:00"}, runs)
+
+	// day 5 has already passed in January, so the first run is in February
+	monthly = &StandingOrder{Schedule: ScheduleMonthly, DayOfMonth: 5, StartAt: start}
+	assert.Equal(t, time.Date(2026, time.February, 5, 9, 0, 0, 0, time.UTC), monthly.firstRun())
+
+	end := start.AddDate(0, 0, 14)
+	weekly := &StandingOrder{Schedule: ScheduleWeekly, StartAt: start, EndAt: &end}
+	next, ok := weekly.nextRun(start.AddDate(0, 0, 7))
+	assert.True(t, ok)
+	assert.Equal(t, end, next)
+	_, ok = weekly.nextRun(end)
+	assert.False(t, ok)
+
+	_, ok = (&StandingOrder{Schedule: ScheduleOnce}).nextRun(start)
+	assert.False(t, ok)
+}
+
+func TestSchedulerExecutesStandingOrders(t *testing.T) {
+	store := NewMemoryStore()
+	newTestAccount(t, store, 1008)
+	newTestAccount(t, store, 1016)
+	scheduler := newScheduler(store, SchedulerConfig{Interval: time.Minute, MaxAttempts: 2, RetryDelay: time.Hour}, SavingsConfig{})
+
+	start := time.Date(2026, time.March, 1, 8, 0, 0, 0, time.UTC)
+	daily := &StandingOrder{FromAccount: 1008, ToAccount: 1016, Amount: usd(3000), Schedule: ScheduleDaily,
+		StartAt: start, NextRunAt: start, NextAttemptAt: start, Status: OrderActive}
+	once := &StandingOrder{FromAccount: 1008, ToAccount: 1016, Amount: usd(9000), Schedule: ScheduleOnce,
+		StartAt: start, NextRunAt: start, NextAttemptAt: start, Status: OrderActive}
+	assert.Nil(t, store.CreateStandingOrder(daily))
+	assert.Nil(t, store.CreateStandingOrder(once))
+
+	// nothing is due yet
+	assert.Nil(t, scheduler.runDue(start.Add(-time.Second)))
+	runs, err := store.GetStandingOrderRuns(daily.ID)
+	assert.Nil(t, err)
+	assert.Empty(t, runs)
+
+	// no money: both fail and are retried an hour later
+	assert.Nil(t, scheduler.runDue(start))
+	daily, err = store.GetStandingOrder(daily.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, daily.Attempts)
+	assert.Equal(t, start.Add(time.Hour), daily.NextAttemptAt)
+	assert.Equal(t, start, daily.NextRunAt)
+
+	_, err = store.CreateTransaction(0, 1008, "deposit", usd(10000))
+	assert.Nil(t, err)
+	assert.Nil(t, scheduler.runDue(start.Add(time.Hour)))
+
+	daily, err = store.GetStandingOrder(daily.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, daily.Attempts)
+	assert.Equal(t, start.AddDate(0, 0, 1), daily.NextRunAt)
+	runs, err = store.GetStandingOrderRuns(daily.ID)
+	assert.Nil(t, err)
+	assert.Len(t, runs, 2)
+	assert.Equal(t, RunFailed, runs[0].Status)
+	assert.NotEmpty(t, runs[0].Error)
+	assert.Equal(t, RunSucceeded, runs[1].Status)
+
+	// the one-off order is out of attempts
+	once, err = store.GetStandingOrder(once.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, OrderFailed, once.Status)
+
+	// a run missed while the server was down is made once, then the
+	// schedule resumes
+	assert.Nil(t, scheduler.runDue(start.AddDate(0, 0, 3)))
+	daily, err = store.GetStandingOrder(daily.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, start.AddDate(0, 0, 4), daily.NextRunAt)
+	acc, err := store.GetAccountByNumber(1016)
+	assert.Nil(t, err)
+	assert.Equal(t, usd(6000), acc.Balance)
+
+	// cancelled orders stop running
+	assert.Nil(t, store.CancelStandingOrder(daily.ID))
+	assert.Nil(t, scheduler.runDue(start.AddDate(0, 0, 5)))
+	runs, err = store.GetStandingOrderRuns(daily.ID)
+	assert.Nil(t, err)
+	assert.Len(t, runs, 3)
+}
+
+func TestStandingOrderOccurrencePaysOnce(t *testing.T) {
+	store := NewMemoryStore()
+	newTestAccount(t, store, 1008)
+	newTestAccount(t, store, 1016)
+	_, err := store.CreateTransaction(0, 1008, "deposit", usd(10000))
+	assert.Nil(t, err)
+	scheduler := newScheduler(store, SchedulerConfig{Interval: time.Minute, MaxAttempts: 2, RetryDelay: time.Hour}, SavingsConfig{})
+
+	start := time.Date(2026, time.March, 1, 8, 0, 0, 0, time.UTC)
+	order := &StandingOrder{FromAccount: 1008, ToAccount: 1016, Amount: usd(3000), Schedule: ScheduleDaily,
+		StartAt: start, NextRunAt: start, NextAttemptAt: start, Status: OrderActive}
+	assert.Nil(t, store.CreateStandingOrder(order))
+
+	// a second pass still holding the occurrence after the first paid it
+	stale := *order
+	assert.Nil(t, scheduler.execute(order, start))
+	assert.Nil(t, scheduler.execute(&stale, start.Add(schedulerLease)))
+
+	acc, err := store.GetAccountByNumber(1016)
+	assert.Nil(t, err)
+	assert.Equal(t, usd(3000), acc.Balance)
+	runs, err := store.GetStandingOrderRuns(order.ID)
+	assert.Nil(t, err)
+	assert.Len(t, runs, 1)
+	order, err = store.GetStandingOrder(order.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, start.AddDate(0, 0, 1), order.NextRunAt)
+}
+
+func TestStandingOrderEndpoints(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	acc := newTestAccount(t, store, 1008)
+	other := newTestAccount(t, store, 1016)
+	token := login(t, server, 1008, "password").Token
+	path := "/account/" + strconv.Itoa(acc.ID) + "/standing-orders"
+
+	startAt := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	req := CreateStandingOrderRequest{ToAccountNumber: 1016, Amount: usd(1000), Schedule: "monthly", StartAt: startAt, DayOfMonth: 32}
+	w := doRequest(server, "POST", path, token, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	req.DayOfMonth = 0
+	w = doRequest(server, "POST", "/account/"+strconv.Itoa(other.ID)+"/standing-orders", token, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = doRequest(server, "POST", path, token, req)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var order StandingOrderResponse
+	assert.Nil(t, jsonDecode(w, &order))
+	assert.Equal(t, startAt.Day(), order.DayOfMonth)
+	assert.Equal(t, startAt, *order.NextRunAt)
+
+	w = doRequest(server, "GET", path, token, nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var orders []StandingOrderResponse
+	assert.Nil(t, jsonDecode(w, &orders))
+	assert.Len(t, orders, 1)
+
+	orderPath := path + "/" + strconv.Itoa(order.ID)
+	assert.Equal(t, http.StatusNotFound, doRequest(server, "GET", path+"/99", token, nil).Code)
+	w = doRequest(server, "DELETE", orderPath, token, nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, http.StatusConflict, doRequest(server, "DELETE", orderPath, token, nil).Code)
+
+	w = doRequest(server, "GET", orderPath, token, nil)
+	order = StandingOrderResponse{}
+	assert.Nil(t, jsonDecode(w, &order))
+	assert.Equal(t, OrderCancelled, order.Status)
+	assert.Nil(t, order.NextRunAt)
+}
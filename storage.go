@@ -2,30 +2,110 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"slices"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type Storage interface {
 	CreateAccount(*Account) error
-	DeleteAccount(int) error
+	NextAccountNumber() (int, error)
+	GetLegacyAccountNumbers() ([]int, error)
 	UpdateAccount(*Account) error
 	GetAccountById(int) (*Account, error)
 	GetAccounts() ([]*Account, error)
 	GetAccountByNumber(int) (*Account, error)
-	UpdateAccountBalance(int, float64) (*Account, error)
-	CreateTransaction(int, int, string, float64) (*Account, error)
+	GetAccountByIBAN(string) (*Account, error)
+	SetAccountStatus(int, string) error
+	SetAccountRole(int, Role) error
+	SetOverdraft(id int, limit, fee Money) error
+	UpdateAccountBalance(int, Money) (*Account, error)
+	CreateTransaction(int, int, string, Money) (*Account, error)
+	CreateExchange(*Exchange) (*Account, error)
+	GetTransactions(int, TransactionFilter) ([]*Transaction, error)
+	ReserveIdempotencyKey(*IdempotencyRecord) (*IdempotencyRecord, error)
+	CompleteIdempotencyKey(*IdempotencyRecord) error
+	ReleaseIdempotencyKey(int, string) error
+	PostJournalEntry(*JournalEntry) error
+	GetLedgerBalance(LedgerAccount, string) (Money, error)
+	ReconcileBalances() ([]BalanceMismatch, error)
+	CreateRefreshToken(*RefreshToken) error
+	ConsumeRefreshToken(string) (*RefreshToken, error)
+	RevokeRefreshTokenFamily(string) error
+	RevokeToken(string, time.Time) error
+	IsTokenRevoked(string) (bool, error)
+	GetLoginFailures(string) (*LoginFailures, error)
+	RegisterLoginFailure(key string, at, resetBefore time.Time) (*LoginFailures, error)
+	ClearLoginFailures(string) error
+	RecordLoginEvent(*LoginEvent) error
+	GetTOTPCredential(int) (*TOTPCredential, error)
+	SaveTOTPCredential(*TOTPCredential) error
+	EnableTOTP(accountNumber int, recoveryCodeHashes []string) error
+	DeleteTOTPCredential(int) error
+	ConsumeTOTPStep(accountNumber int, step int64) (bool, error)
+	ConsumeRecoveryCode(accountNumber int, codeHash string) (bool, error)
+	SetDefaultLimits(AccountLimits)
+	SetFeeSchedule(FeeSchedule)
+	GetAccountLimits(int) (limits AccountLimits, custom bool, err error)
+	SetAccountLimits(int, AccountLimits) error
+	ClearAccountLimits(int) error
+	GetDebitTotals(accountNumber int, currency string) (DebitTotals, error)
+	GetFXRates() ([]*FXRate, error)
+	SetFXRates([]*FXRate) error
+	CreateFXQuote(*FXQuote) error
+	GetFXQuote(string) (*FXQuote, error)
+	CreateStandingOrder(*StandingOrder) error
+	GetStandingOrder(int) (*StandingOrder, error)
+	GetStandingOrders(accountNumber int) ([]*StandingOrder, error)
+	CancelStandingOrder(int) error
+	ClaimDueStandingOrders(now, leaseUntil time.Time) ([]*StandingOrder, error)
+	RecordStandingOrderRun(*StandingOrder, *StandingOrderRun) error
+	ExecuteStandingOrder(*StandingOrder, *StandingOrderRun) error
+	GetStandingOrderRuns(orderID int) ([]*StandingOrderRun, error)
+	GetBalanceAt(accountNumber int, at time.Time) (Money, error)
+	GetInterestState(accountNumber int) (*InterestState, error)
+	RecordInterestAccrual(*InterestAccrual) error
+	PostInterest(accountNumber int, through time.Time) (Money, error)
+}
+
+// InsufficientFundsError is returned by CreateTransaction when the source
+// account cannot cover the amount. The check happens inside the storage
+// transaction, so it is never based on a stale balance.
+type InsufficientFundsError struct {
+	AccountNumber int
+	Balance       Money
+	Requested     Money
+}
+
+func (e *InsufficientFundsError) Error() string {
+	return fmt.Sprintf("insufficient funds in account %d", e.AccountNumber)
+}
+
+// CurrencyMismatchError is returned when money in one currency is moved
+// into or out of an account held in another without an explicit
+// conversion.
+type CurrencyMismatchError struct {
+	AccountNumber   int
+	AccountCurrency string
+	Currency        string
+}
+
+func (e *CurrencyMismatchError) Error() string {
+	return fmt.Sprintf("account %d is in %s, not %s", e.AccountNumber, e.AccountCurrency, e.Currency)
 }
 
 type PostGresStore struct {
-	db *sql.DB
+	db     *sql.DB
+	limits AccountLimits // for accounts without an override
+	fees   FeeSchedule
 }
 
-func NewPostGresStore() (*PostGresStore, error) {
+func NewPostGresStore(cfg DatabaseConfig) (*PostGresStore, error) {
 	fmt.Println("Starting database connection...")
-	connStr := "host=localhost port=5432 user=postgres dbname=gobankpostgres password=helloworld sslmode=disable"
-	db, err := sql.Open("postgres", connStr)
+	db, err := sql.Open("postgres", cfg.ConnString())
 
 	if err != nil {
 		fmt.Println("Error opening database:", err)
@@ -42,64 +122,44 @@ func NewPostGresStore() (*PostGresStore, error) {
 	return &PostGresStore{db: db}, nil
 }
 
+// init brings the schema up to date by applying any pending embedded
+// migrations. See migrate.go and the migrations directory.
 func (s *PostGresStore) init() error {
-	if err := s.createAccountTable(); err != nil {
-		return err
-	}
-
-	if err := s.createTransactionsTable(); err != nil {
+	migrator, err := NewMigrator(s.db)
+	if err != nil {
 		return err
 	}
-	return nil
-}
-
-func (s *PostGresStore) createAccountTable() error {
-	query := `create table if not exists accounts (
-		id serial primary key,
-		first_name varchar(50),
-		last_name varchar(50),
-		accountnumber integer unique , 
-		balance integer,
-		created_at timestamp default current_timestamp,
-		password varchar(100)
-	)`
-	_, err := s.db.Exec(query)
-	return err
-}
-
-func (s *PostGresStore) createTransactionsTable() error {
-	query := `CREATE TABLE IF NOT EXISTS transactions (
-    id SERIAL PRIMARY KEY,
-    from_account INTEGER NULL,  -- Allow NULL for deposit
-    to_account INTEGER NULL,    -- Allow NULL for withdraw
-    transactionType VARCHAR(50),
-    amount INTEGER,
-    transactiontime TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    FOREIGN KEY (from_account) REFERENCES accounts(accountnumber) ON DELETE SET NULL,
-    FOREIGN KEY (to_account) REFERENCES accounts(accountnumber) ON DELETE SET NULL,
-    CHECK (transactionType IN ('deposit', 'withdraw', 'transfer'))
-)`
-	_, err := s.db.Exec(query)
-	return err
+	return migrator.Up(0)
 }
 
 func (s *PostGresStore) EnterTransaction() {
 	s.db.Close()
 }
 
+const accountColumns = "id, first_name, last_name, accountnumber, COALESCE(iban, ''), balance, currency, created_at, password, role, status, version, password_changed_at, closed_at, overdraft_limit, overdraft_fee, product"
+
 func (s *PostGresStore) CreateAccount(ac *Account) error {
-	query := `insert into accounts (first_name, last_name, accountnumber, balance, created_at, password) 
-	values ($1, $2, $3, $4, $5, $6) returning id`
+	query := `insert into accounts (first_name, last_name, accountnumber, balance, currency, created_at, password, role, status, iban, product) 
+	values ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''), COALESCE(NULLIF($11, ''), 'checking')) returning id`
 
 	err := s.db.QueryRow(
 		query,
 		ac.FirstName,
 		ac.LastName,
 		ac.AccountNumber,
-		ac.Balance,
+		ac.Balance.Amount,
+		ac.Balance.Currency,
 		ac.CreatedAt,
-		ac.Password).Scan(&ac.ID)
+		ac.Password,
+		ac.Role,
+		ac.Status,
+		ac.IBAN,
+		ac.Product).Scan(&ac.ID)
 
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return conflictf("account with number %d already exists", ac.AccountNumber)
+	}
 	if err != nil {
 		return err
 	}
@@ -109,21 +169,86 @@ func (s *PostGresStore) CreateAccount(ac *Account) error {
 }
 
 func (s *PostGresStore) GetAccountByNumber(accountnumber int) (*Account, error) {
-	fmt.Print("Getting account by number called")
-	rows, err := s.db.Query("SELECT * FROM accounts WHERE accountnumber = $1", accountnumber)
+	rows, err := s.db.Query("SELECT "+accountColumns+" FROM accounts WHERE accountnumber = $1", accountnumber)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
 		return scanAccounts(rows)
 
 	}
+	return nil, notFoundf("Account with number %d not found", accountnumber)
+}
+
+func (s *PostGresStore) GetAccountByIBAN(iban string) (*Account, error) {
+	account, err := scanAccounts(s.db.QueryRow("SELECT "+accountColumns+" FROM accounts WHERE iban = $1", iban))
+	if err == sql.ErrNoRows {
+		return nil, notFoundf("Account with IBAN %s not found", iban)
+	}
+	return account, err
+}
+
+// assignMissingIBANs gives an IBAN to accounts created before IBANs existed.
+func (s *PostGresStore) assignMissingIBANs(cfg IBANConfig) error {
+	rows, err := s.db.Query("SELECT accountnumber FROM accounts WHERE iban IS NULL")
+	if err != nil {
+		return err
+	}
+	var numbers []int
+	for rows.Next() {
+		var n int
+		if err := rows.Scan(&n); err != nil {
+			rows.Close()
+			return err
+		}
+		numbers = append(numbers, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, n := range numbers {
+		if _, err := s.db.Exec("UPDATE accounts SET iban = $1 WHERE accountnumber = $2 AND iban IS NULL", cfg.IBAN(n), n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NextAccountNumber allocates a fresh account number from
+// account_number_seq and appends its check digit.
+func (s *PostGresStore) NextAccountNumber() (int, error) {
+	var seq int
+	if err := s.db.QueryRow("SELECT nextval('account_number_seq')").Scan(&seq); err != nil {
+		return 0, err
+	}
+	return withCheckDigit(seq), nil
+}
+
+// GetLegacyAccountNumbers returns the numbers without a check digit that
+// accounts already had when allocated numbers were introduced.
+func (s *PostGresStore) GetLegacyAccountNumbers() ([]int, error) {
+	rows, err := s.db.Query(`SELECT account_number FROM legacy_account_numbers ORDER BY account_number`)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
-	return nil, fmt.Errorf("Account with number %d not found", accountnumber)
+
+	numbers := []int{}
+	for rows.Next() {
+		var n int
+		if err := rows.Scan(&n); err != nil {
+			return nil, err
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers, rows.Err()
 }
 
 func (s *PostGresStore) GetAccounts() ([]*Account, error) {
-	rows, err := s.db.Query("SELECT * FROM accounts")
+	rows, err := s.db.Query("SELECT " + accountColumns + " FROM accounts")
 	if err != nil {
 		return nil, err
 	}
@@ -132,8 +257,7 @@ func (s *PostGresStore) GetAccounts() ([]*Account, error) {
 	var accounts []*Account
 
 	for rows.Next() {
-		account := new(Account)
-		account, err = scanAccounts(rows)
+		account, err := scanAccounts(rows)
 		if err != nil {
 			return nil, err
 
@@ -149,135 +273,1252 @@ func (s *PostGresStore) GetAccounts() ([]*Account, error) {
 }
 
 func (s *PostGresStore) GetAccountById(Id int) (*Account, error) {
-	rows, err := s.db.Query("SELECT * FROM accounts WHERE id = $1", Id)
+	rows, err := s.db.Query("SELECT "+accountColumns+" FROM accounts WHERE id = $1", Id)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
 		return scanAccounts(rows)
 
 	}
-	defer rows.Close()
-	return nil, fmt.Errorf("Account with id %d not found", Id)
+	return nil, notFoundf("Account with id %d not found", Id)
 }
 
-func (s *PostGresStore) DeleteAccount(Id int) error {
-	_, err := s.db.Exec("DELETE FROM accounts WHERE id = $1", Id)
+// UpdateAccount saves the profile and password of a, provided nobody else
+// updated the account since a was read, and bumps a.Version. Refresh tokens
+// created before the last password change are revoked in the same
+// transaction.
+func (s *PostGresStore) UpdateAccount(a *Account) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var passwordChangedAt sql.NullTime
+	if !a.PasswordChangedAt.IsZero() {
+		passwordChangedAt = sql.NullTime{Time: a.PasswordChangedAt, Valid: true}
+	}
+	res, err := tx.Exec(`UPDATE accounts SET first_name = $1, last_name = $2, password = $3, password_changed_at = $4, version = version + 1
+	WHERE id = $5 AND version = $6`, a.FirstName, a.LastName, a.Password, passwordChangedAt, a.ID, a.Version)
 	if err != nil {
 		return err
 	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM accounts WHERE id = $1)`, a.ID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return notFoundf("Account with id %d not found", a.ID)
+		}
+		return conflictf("account %d was modified by another request, reload it and try again", a.ID)
+	}
+
+	if passwordChangedAt.Valid {
+		_, err := tx.Exec(`UPDATE refresh_tokens SET revoked_at = $1
+		WHERE account_number = $2 AND revoked_at IS NULL AND created_at < $3`, time.Now().UTC(), a.AccountNumber, a.PasswordChangedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	a.Version++
 	return nil
 }
 
-func (s *PostGresStore) UpdateAccount(a *Account) error {
+// SetAccountStatus moves an account to another lifecycle state. The row is
+// locked while the transition is checked, so a transfer cannot slip in
+// between the zero balance check and the close.
+func (s *PostGresStore) SetAccountStatus(id int, status string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	acc, err := scanAccounts(tx.QueryRow("SELECT "+accountColumns+" FROM accounts WHERE id = $1 FOR UPDATE", id))
+	if err == sql.ErrNoRows {
+		return notFoundf("Account with id %d not found", id)
+	}
+	if err != nil {
+		return err
+	}
+	if acc.Status == status {
+		return nil
+	}
+	if err := checkStatusTransition(acc, status); err != nil {
+		return err
+	}
+
+	var closedAt sql.NullTime
+	if status == StatusClosed {
+		closedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+	}
+	if _, err := tx.Exec("UPDATE accounts SET status = $1, closed_at = $2 WHERE id = $3", status, closedAt, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetOverdraft changes an account's overdraft limit and fee. The row is
+// locked so the limit cannot be cut below a balance that is being drawn
+// down at the same time.
+func (s *PostGresStore) SetOverdraft(id int, limit, fee Money) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	acc, err := scanAccounts(tx.QueryRow("SELECT "+accountColumns+" FROM accounts WHERE id = $1 FOR UPDATE", id))
+	if err == sql.ErrNoRows {
+		return notFoundf("Account with id %d not found", id)
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkOverdraft(acc, limit, fee); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE accounts SET overdraft_limit = $1, overdraft_fee = $2 WHERE id = $3", limit.Amount, fee.Amount, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
+func (s *PostGresStore) SetAccountRole(id int, role Role) error {
+	res, err := s.db.Exec("UPDATE accounts SET role = $1 WHERE id = $2", role, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return notFoundf("Account with id %d not found", id)
+	}
 	return nil
 }
 
-func (s *PostGresStore) UpdateAccountBalance(accountNumber int, newBalance float64) (*Account, error) {
-	// Perform the update
-	_, err := s.db.Exec("UPDATE accounts SET balance = $1 WHERE accountnumber = $2", newBalance, accountNumber)
+// UpdateAccountBalance sets an account's balance by posting the difference
+// against the adjustments ledger account, so the ledger stays balanced.
+func (s *PostGresStore) UpdateAccountBalance(accountNumber int, newBalance Money) (*Account, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	locked, err := lockAccounts(tx, accountNumber)
 	if err != nil {
 		return nil, err
 	}
+	diff, err := newBalance.Sub(locked[accountNumber].Balance)
+	if err != nil {
+		return nil, err
+	}
+	if !diff.IsZero() {
+		entry := balancingEntry("balance adjustment", LedgerAdjustments, accountNumber, diff)
+		if err := insertEntry(tx, entry, map[int]Money{accountNumber: diff}); err != nil {
+			return nil, err
+		}
+	}
 
 	// Fetch the updated account from the database
-	updatedAccount := &Account{}
-	err = s.db.QueryRow("SELECT id, first_name, last_name, accountnumber, balance, created_at FROM accounts WHERE accountnumber = $1", accountNumber).
-		Scan(&updatedAccount.ID, &updatedAccount.FirstName, &updatedAccount.LastName, &updatedAccount.AccountNumber, &updatedAccount.Balance, &updatedAccount.CreatedAt)
+	updated, err := s.getAccountSummary(tx, accountNumber)
+	if err != nil {
+		return nil, err
+	}
+	return updated, tx.Commit()
+}
 
+func (s *PostGresStore) CreateTransaction(fromAccount, toAccount int, transactionType string, amount Money) (*Account, error) {
+	if !amount.IsPositive() {
+		return nil, invalidf("transaction amount must be positive")
+	}
+	entry, err := transactionEntry(fromAccount, toAccount, transactionType, amount)
 	if err != nil {
 		return nil, err
 	}
+	return s.postTransaction(&Transaction{FromAccount: fromAccount, ToAccount: toAccount, Type: transactionType, Amount: amount}, entry)
+}
 
-	// Return the updated account
-	return updatedAccount, nil
+// CreateExchange transfers x.Debit out of x.FromAccount and x.Credit into
+// x.ToAccount, each in its account's currency. The caller decides the rate;
+// a quote named by x.QuoteID is used up in the same transaction.
+func (s *PostGresStore) CreateExchange(x *Exchange) (*Account, error) {
+	entry, err := exchangeEntry(x.FromAccount, x.ToAccount, x.Debit, x.Credit)
+	if err != nil {
+		return nil, err
+	}
+	return s.postTransaction(x.transaction(), entry)
 }
 
-func (s *PostGresStore) CreateTransaction(fromAccount, toAccount int, transactionType string, amount float64) (*Account, error) {
+// postTransaction records t and posts its journal entry in one database
+// transaction, returning the account the money came out of (or went into,
+// for deposits).
+func (s *PostGresStore) postTransaction(t *Transaction, entry *JournalEntry) (*Account, error) {
 	tx, err := s.db.Begin()
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
 
-	var query string
-	switch transactionType {
-	case "transfer":
-		query = `INSERT INTO transactions (from_account, to_account, transactionType, amount) 
-                 VALUES ($1, $2, $3, $4)`
-		_, err = tx.Exec(query, fromAccount, toAccount, transactionType, amount)
-		if err != nil {
+	updated, err := s.postTransactionTx(tx, t, entry)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// postTransactionTx does the work of postTransaction inside tx, for
+// callers that commit more alongside it.
+func (s *PostGresStore) postTransactionTx(tx *sql.Tx, t *Transaction, entry *JournalEntry) (*Account, error) {
+	// take the row locks and check funds before anything else touches the
+	// accounts, the transactions foreign keys would otherwise grab weaker
+	// locks first and let two transfers deadlock
+	changes, numbers := entry.customerChanges()
+	locked, err := lockAccounts(tx, numbers...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := checkEntries(locked, entry); err != nil {
+		return nil, err
+	}
+	// the source row is locked now, so concurrent debits of the same
+	// account are checked against the limits one at a time
+	if limitedTransaction(t.Type) {
+		if err := s.checkLimits(tx, t.FromAccount, t.Amount); err != nil {
 			return nil, err
 		}
-		_, err = tx.Exec(`UPDATE accounts SET balance = balance - $1 WHERE accountnumber = $2`, amount, fromAccount)
-		if err != nil {
+	}
+
+	// a quote is used up with the transfer it paid for, or not at all
+	if t.FXQuoteID != "" {
+		if err := consumeFXQuote(tx, t.FXQuoteID, t.FromAccount); err != nil {
 			return nil, err
 		}
-		_, err = tx.Exec(`UPDATE accounts SET balance = balance + $1 WHERE accountnumber = $2`, amount, toAccount)
-		if err != nil {
+	}
+
+	// fees are worked out against the balance before the transaction and
+	// checked together with the amount; the payer is always one of the
+	// locked accounts
+	var fees []Fee
+	payer := feePayer(t)
+	if payer != 0 {
+		if fees, err = transactionFees(s.fees, locked[payer], t); err != nil {
 			return nil, err
 		}
-
-	case "deposit":
-		fmt.Print("Deposit called with amount: for account ", amount, toAccount)
-		query = `INSERT INTO transactions (from_account, to_account, transactionType, amount) 
-                 VALUES (NULL, $1, $2, $3)` // from_account is NULL for deposits
-		_, err = tx.Exec(query, toAccount, transactionType, amount)
+	}
+	transactions := []*Transaction{t}
+	entries := []*JournalEntry{entry}
+	for _, fee := range fees {
+		feeTx, feeEntry, err := feeTransaction(payer, fee)
 		if err != nil {
 			return nil, err
 		}
-		_, err = tx.Exec(`UPDATE accounts SET balance = balance + $1 WHERE accountnumber = $2`, amount, toAccount)
-		if err != nil {
+		transactions = append(transactions, feeTx)
+		entries = append(entries, feeEntry)
+	}
+	if _, err := checkEntries(locked, entries...); err != nil {
+		return nil, err
+	}
+
+	if err := insertTransaction(tx, t, entry, changes); err != nil {
+		return nil, err
+	}
+	for i, feeTx := range transactions[1:] {
+		feeChanges, _ := entries[i+1].customerChanges()
+		if err := insertTransaction(tx, feeTx, entries[i+1], feeChanges); err != nil {
 			return nil, err
 		}
+	}
+
+	// read the result inside the transaction so it reflects exactly this change
+	if creditTransaction(t.Type) {
+		return s.getAccountSummary(tx, t.ToAccount)
+	}
+	return s.getAccountSummary(tx, t.FromAccount)
+}
+
+// insertTransaction writes the transactions row for t, then its journal
+// entry.
+func insertTransaction(tx *sql.Tx, t *Transaction, entry *JournalEntry, changes map[int]Money) error {
+	var from, to any // NULL for the side a transaction does not have
+	if !creditTransaction(t.Type) {
+		from = t.FromAccount
+	}
+	if creditTransaction(t.Type) || t.Type == "transfer" {
+		to = t.ToAccount
+	}
+	var convertedAmount, convertedCurrency, rate, spread, quoteID any
+	if t.Converted.Currency != "" {
+		convertedAmount, convertedCurrency = t.Converted.Amount, t.Converted.Currency
+		rate, spread = t.FXRate, t.FXSpread
+	}
+	if t.FXQuoteID != "" {
+		quoteID = t.FXQuoteID
+	}
+	err := tx.QueryRow(`INSERT INTO transactions (from_account, to_account, transactionType, amount, currency, converted_amount, converted_currency,
+		fx_rate, fx_spread, fx_quote_id) 
+                 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`,
+		from, to, t.Type, t.Amount.Amount, t.Amount.Currency, convertedAmount, convertedCurrency, rate, spread, quoteID).Scan(&entry.TransactionID)
+	if err != nil {
+		return err
+	}
+	return insertEntry(tx, entry, changes)
+}
+
+// PostJournalEntry posts an arbitrary balanced entry atomically, updating the
+// stored balance of every customer account it touches.
+func (s *PostGresStore) PostJournalEntry(entry *JournalEntry) error {
+	if err := entry.validate(); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	changes, err := lockForEntry(tx, entry)
+	if err != nil {
+		return err
+	}
+	if err := insertEntry(tx, entry, changes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-	case "withdraw":
-		query = `INSERT INTO transactions (from_account, to_account, transactionType, amount) 
-                 VALUES ($1, NULL, $2, $3)`
-		_, err = tx.Exec(query, fromAccount, transactionType, amount)
+// lockForEntry locks every customer account in entry and checks that the
+// resulting balances are allowed. It returns the net change per account.
+func lockForEntry(tx *sql.Tx, entry *JournalEntry) (map[int]Money, error) {
+	changes, numbers := entry.customerChanges()
+	locked, err := lockAccounts(tx, numbers...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := checkEntries(locked, entry); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// insertEntry writes entry and its postings and applies changes to the
+// cached account balances. The accounts must already be locked.
+func insertEntry(tx *sql.Tx, entry *JournalEntry, changes map[int]Money) error {
+	var transactionID any
+	if entry.TransactionID != 0 {
+		transactionID = entry.TransactionID
+	}
+	err := tx.QueryRow(`INSERT INTO journal_entries (transaction_id, description) VALUES ($1, $2) RETURNING id, created_at`,
+		transactionID, entry.Description).Scan(&entry.ID, &entry.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range entry.Postings {
+		_, err := tx.Exec(`INSERT INTO ledger_postings (entry_id, ledger_account, side, amount, currency) VALUES ($1, $2, $3, $4, $5)`,
+			entry.ID, p.Account, p.Side, p.Amount.Amount, p.Amount.Currency)
 		if err != nil {
+			return err
+		}
+	}
+
+	for n, change := range changes {
+		if change.IsZero() {
+			continue
+		}
+		if _, err := tx.Exec(`UPDATE accounts SET balance = balance + $1 WHERE accountnumber = $2`, change.Amount, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetLedgerBalance derives an account's balance (credits minus debits) from
+// its postings alone.
+func (s *PostGresStore) GetLedgerBalance(account LedgerAccount, currency string) (Money, error) {
+	balance := Money{Currency: currency}
+	err := s.db.QueryRow(`SELECT COALESCE(SUM(CASE WHEN side = 'credit' THEN amount ELSE -amount END), 0)
+	FROM ledger_postings WHERE ledger_account = $1 AND currency = $2`, account, currency).Scan(&balance.Amount)
+	return balance, err
+}
+
+// ReconcileBalances compares every stored account balance with the sum of
+// its ledger postings and returns the accounts that disagree.
+func (s *PostGresStore) ReconcileBalances() ([]BalanceMismatch, error) {
+	rows, err := s.db.Query(`SELECT a.accountnumber, a.balance, a.currency,
+		COALESCE(SUM(CASE WHEN p.side = 'credit' THEN p.amount ELSE -p.amount END), 0) AS ledger
+	FROM accounts a
+	LEFT JOIN ledger_postings p ON p.ledger_account = 'customer:' || a.accountnumber AND p.currency = a.currency
+	GROUP BY a.accountnumber, a.balance, a.currency
+	HAVING a.balance <> COALESCE(SUM(CASE WHEN p.side = 'credit' THEN p.amount ELSE -p.amount END), 0)
+	ORDER BY a.accountnumber`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mismatches := []BalanceMismatch{}
+	for rows.Next() {
+		var m BalanceMismatch
+		if err := rows.Scan(&m.AccountNumber, &m.Balance.Amount, &m.Balance.Currency, &m.Ledger.Amount); err != nil {
 			return nil, err
 		}
-		_, err = tx.Exec(`UPDATE accounts SET balance = balance - $1 WHERE accountnumber = $2`, amount, fromAccount)
+		m.Ledger.Currency = m.Balance.Currency
+		mismatches = append(mismatches, m)
+	}
+	return mismatches, rows.Err()
+}
+
+// lockAccounts takes row locks on the given accounts, always in ascending
+// account number order, and returns them keyed by account number.
+func lockAccounts(tx *sql.Tx, accountNumbers ...int) (map[int]*Account, error) {
+	ordered := slices.Clone(accountNumbers)
+	slices.Sort(ordered)
+
+	rows, err := tx.Query(`SELECT `+accountColumns+` FROM accounts
+	WHERE accountnumber = ANY($1) ORDER BY accountnumber FOR UPDATE`, pq.Array(ordered))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locked := make(map[int]*Account, len(ordered))
+	for rows.Next() {
+		account, err := scanAccounts(rows)
 		if err != nil {
 			return nil, err
 		}
+		locked[account.AccountNumber] = account
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, number := range ordered {
+		if _, ok := locked[number]; !ok {
+			return nil, notFoundf("Account with number %d not found", number)
+		}
+	}
+	return locked, nil
+}
+
+func (s *PostGresStore) GetTransactions(accountNumber int, f TransactionFilter) ([]*Transaction, error) {
+	query := `SELECT id, COALESCE(from_account, 0), COALESCE(to_account, 0), transactionType, amount, currency, transactiontime,
+		COALESCE(converted_amount, 0), COALESCE(converted_currency, ''),
+		COALESCE(fx_rate::text, ''), COALESCE(fx_spread::text, ''), COALESCE(fx_quote_id, '')
+	FROM transactions WHERE (from_account = $1 OR to_account = $1)`
+	args := []any{accountNumber}
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
 	}
 
-	err = tx.Commit()
+	if len(f.Types) > 0 {
+		query += " AND transactionType = ANY(" + arg(pq.Array(f.Types)) + ")"
+	}
+	if !f.From.IsZero() {
+		query += " AND transactiontime >= " + arg(f.From)
+	}
+	if !f.To.IsZero() {
+		query += " AND transactiontime < " + arg(f.To)
+	}
+	if f.MinAmount != nil {
+		query += " AND amount >= " + arg(*f.MinAmount)
+	}
+	if f.MaxAmount != nil {
+		query += " AND amount <= " + arg(*f.MaxAmount)
+	}
+	if f.BeforeID > 0 {
+		query += " AND id < " + arg(f.BeforeID)
+	}
+	query += " ORDER BY id DESC"
+	if f.Limit > 0 {
+		query += " LIMIT " + arg(f.Limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	transactions := []*Transaction{}
+	for rows.Next() {
+		tx := new(Transaction)
+		if err := rows.Scan(&tx.ID, &tx.FromAccount, &tx.ToAccount, &tx.Type, &tx.Amount.Amount, &tx.Amount.Currency, &tx.CreatedAt,
+			&tx.Converted.Amount, &tx.Converted.Currency, &tx.FXRate, &tx.FXSpread, &tx.FXQuoteID); err != nil {
+			return nil, err
+		}
+		tx.Direction = tx.directionFor(accountNumber)
+		transactions = append(transactions, tx)
+	}
+	return transactions, rows.Err()
+}
 
-	updatedAccount := &Account{}
-	switch transactionType {
-	case "deposit":
-		err = s.db.QueryRow("SELECT id, first_name, last_name, accountnumber, balance, created_at FROM accounts WHERE accountnumber = $1", toAccount).
-			Scan(&updatedAccount.ID, &updatedAccount.FirstName, &updatedAccount.LastName, &updatedAccount.AccountNumber, &updatedAccount.Balance, &updatedAccount.CreatedAt)
-	case "withdraw", "transfer":
-		err = s.db.QueryRow("SELECT id, first_name, last_name, accountnumber, balance, created_at FROM accounts WHERE accountnumber = $1", fromAccount).
-			Scan(&updatedAccount.ID, &updatedAccount.FirstName, &updatedAccount.LastName, &updatedAccount.AccountNumber, &updatedAccount.Balance, &updatedAccount.CreatedAt)
+// ReserveIdempotencyKey claims rec's key for the account. If the key was
+// already used the stored record is returned instead and nothing is written.
+// Expired keys are pruned on the way, so their key can be claimed again.
+func (s *PostGresStore) ReserveIdempotencyKey(rec *IdempotencyRecord) (*IdempotencyRecord, error) {
+	if _, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE expires_at <= $1`, rec.CreatedAt); err != nil {
+		return nil, err
 	}
+	res, err := s.db.Exec(`INSERT INTO idempotency_keys (account_number, key, fingerprint, created_at, expires_at)
+	VALUES ($1, $2, $3, $4, $5) ON CONFLICT (account_number, key) DO NOTHING`,
+		rec.AccountNumber, rec.Key, rec.Fingerprint, rec.CreatedAt, rec.ExpiresAt)
 	if err != nil {
 		return nil, err
 	}
+	if n, err := res.RowsAffected(); err != nil || n == 1 {
+		return nil, err
+	}
+
+	existing := &IdempotencyRecord{AccountNumber: rec.AccountNumber, Key: rec.Key}
+	err = s.db.QueryRow(`SELECT fingerprint, status_code, response, created_at, expires_at FROM idempotency_keys
+	WHERE account_number = $1 AND key = $2`, rec.AccountNumber, rec.Key).
+		Scan(&existing.Fingerprint, &existing.StatusCode, &existing.Response, &existing.CreatedAt, &existing.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+func (s *PostGresStore) CompleteIdempotencyKey(rec *IdempotencyRecord) error {
+	_, err := s.db.Exec(`UPDATE idempotency_keys SET status_code = $1, response = $2, expires_at = $3
+	WHERE account_number = $4 AND key = $5`, rec.StatusCode, rec.Response, rec.ExpiresAt, rec.AccountNumber, rec.Key)
+	return err
+}
+
+func (s *PostGresStore) ReleaseIdempotencyKey(accountNumber int, key string) error {
+	_, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE account_number = $1 AND key = $2 AND status_code = 0`, accountNumber, key)
+	return err
+}
+
+func (s *PostGresStore) CreateRefreshToken(t *RefreshToken) error {
+	_, err := s.db.Exec(`INSERT INTO refresh_tokens (token_hash, family_id, account_number, created_at, expires_at)
+	VALUES ($1, $2, $3, $4, $5)`, t.TokenHash, t.FamilyID, t.AccountNumber, t.CreatedAt, t.ExpiresAt)
+	return err
+}
+
+// ConsumeRefreshToken marks the token as used and returns it. A token can be
+// consumed only once; presenting it again revokes its whole family and
+// returns errRefreshTokenReused.
+func (s *PostGresStore) ConsumeRefreshToken(tokenHash string) (*RefreshToken, error) {
+	t := &RefreshToken{TokenHash: tokenHash}
+	err := s.db.QueryRow(`UPDATE refresh_tokens SET used_at = $2
+	WHERE token_hash = $1 AND used_at IS NULL AND revoked_at IS NULL
+	RETURNING family_id, account_number, created_at, expires_at, used_at`, tokenHash, time.Now().UTC()).
+		Scan(&t.FamilyID, &t.AccountNumber, &t.CreatedAt, &t.ExpiresAt, &t.UsedAt)
+	if err == nil {
+		return t, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if err := s.RevokeRefreshTokenFamily(tokenHash); err != nil {
+		return nil, err
+	}
+	return nil, errRefreshTokenReused
+}
+
+func (s *PostGresStore) RevokeRefreshTokenFamily(tokenHash string) error {
+	res, err := s.db.Exec(`UPDATE refresh_tokens SET revoked_at = $2
+	WHERE revoked_at IS NULL AND family_id = (SELECT family_id FROM refresh_tokens WHERE token_hash = $1)`, tokenHash, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+
+	var exists bool
+	if err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM refresh_tokens WHERE token_hash = $1)`, tokenHash).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return notFoundf("refresh token not found")
+	}
+	return nil
+}
+
+// RevokeToken adds an access token id to the revocation list until the
+// token would have expired anyway. Expired entries are pruned on the way.
+func (s *PostGresStore) RevokeToken(jti string, expiresAt time.Time) error {
+	if _, err := s.db.Exec(`DELETE FROM revoked_tokens WHERE expires_at < $1`, time.Now().UTC()); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING`, jti, expiresAt)
+	return err
+}
+
+func (s *PostGresStore) IsTokenRevoked(jti string) (bool, error) {
+	var revoked bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1)`, jti).Scan(&revoked)
+	return revoked, err
+}
+
+// GetLoginFailures returns the failure counter for key, or nil if there is
+// none.
+func (s *PostGresStore) GetLoginFailures(key string) (*LoginFailures, error) {
+	f := &LoginFailures{Key: key}
+	err := s.db.QueryRow(`SELECT failures, last_failure_at FROM login_failures WHERE key = $1`, key).
+		Scan(&f.Failures, &f.LastFailureAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// RegisterLoginFailure atomically counts a failed login for key. A counter
+// whose last failure is older than resetBefore starts again from one.
+func (s *PostGresStore) RegisterLoginFailure(key string, at, resetBefore time.Time) (*LoginFailures, error) {
+	f := &LoginFailures{Key: key}
+	err := s.db.QueryRow(`INSERT INTO login_failures (key, failures, last_failure_at) VALUES ($1, 1, $2)
+	ON CONFLICT (key) DO UPDATE SET
+		failures = CASE WHEN login_failures.last_failure_at < $3 THEN 1 ELSE login_failures.failures + 1 END,
+		last_failure_at = $2
+	RETURNING failures, last_failure_at`, key, at, resetBefore).Scan(&f.Failures, &f.LastFailureAt)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *PostGresStore) ClearLoginFailures(key string) error {
+	_, err := s.db.Exec(`DELETE FROM login_failures WHERE key = $1`, key)
+	return err
+}
+
+func (s *PostGresStore) RecordLoginEvent(e *LoginEvent) error {
+	_, err := s.db.Exec(`INSERT INTO login_events (account_number, ip, outcome, created_at) VALUES ($1, $2, $3, $4)`,
+		e.AccountNumber, e.IP, e.Outcome, e.CreatedAt)
+	return err
+}
+
+// GetTOTPCredential returns the account's TOTP credential, or nil if it
+// has none.
+func (s *PostGresStore) GetTOTPCredential(accountNumber int) (*TOTPCredential, error) {
+	c := &TOTPCredential{AccountNumber: accountNumber}
+	err := s.db.QueryRow(`SELECT secret, enabled, last_step, created_at FROM totp_credentials WHERE account_number = $1`, accountNumber).
+		Scan(&c.Secret, &c.Enabled, &c.LastStep, &c.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SaveTOTPCredential stores a pending credential, replacing any earlier
+// pending one. An enabled credential has to be deleted first.
+func (s *PostGresStore) SaveTOTPCredential(c *TOTPCredential) error {
+	res, err := s.db.Exec(`INSERT INTO totp_credentials (account_number, secret, enabled, last_step, created_at)
+	VALUES ($1, $2, FALSE, 0, $3)
+	ON CONFLICT (account_number) DO UPDATE SET secret = $2, last_step = 0, created_at = $3
+	WHERE NOT totp_credentials.enabled`, c.AccountNumber, c.Secret, c.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 1 {
+		return err
+	}
+	return conflictf("two-factor authentication is already enabled")
+}
+
+// EnableTOTP enables a pending credential and replaces the account's
+// recovery codes.
+func (s *PostGresStore) EnableTOTP(accountNumber int, recoveryCodeHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE totp_credentials SET enabled = TRUE WHERE account_number = $1 AND NOT enabled`, accountNumber)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return conflictf("no pending two-factor enrollment for account %d", accountNumber)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE account_number = $1`, accountNumber); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (account_number, code_hash) VALUES ($1, $2)`, accountNumber, hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostGresStore) DeleteTOTPCredential(accountNumber int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE account_number = $1`, accountNumber); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM totp_credentials WHERE account_number = $1`, accountNumber); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ConsumeTOTPStep records step as used. It reports false if that step or a
+// later one was already accepted, which stops a code being replayed.
+func (s *PostGresStore) ConsumeTOTPStep(accountNumber int, step int64) (bool, error) {
+	res, err := s.db.Exec(`UPDATE totp_credentials SET last_step = $2 WHERE account_number = $1 AND last_step < $2`, accountNumber, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// ConsumeRecoveryCode marks an unused recovery code as used.
+func (s *PostGresStore) ConsumeRecoveryCode(accountNumber int, codeHash string) (bool, error) {
+	res, err := s.db.Exec(`UPDATE recovery_codes SET used_at = $3
+	WHERE account_number = $1 AND code_hash = $2 AND used_at IS NULL`, accountNumber, codeHash, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *PostGresStore) SetDefaultLimits(limits AccountLimits) {
+	s.limits = limits
+}
+
+func (s *PostGresStore) SetFeeSchedule(fees FeeSchedule) {
+	s.fees = fees
+}
+
+// GetAccountLimits returns the limits that apply to the account: its
+// override if it has one, the defaults otherwise.
+func (s *PostGresStore) GetAccountLimits(accountNumber int) (AccountLimits, bool, error) {
+	return s.accountLimits(s.db, accountNumber)
+}
+
+func (s *PostGresStore) accountLimits(q queryer, accountNumber int) (AccountLimits, bool, error) {
+	var single, daily, monthly int64
+	var currency string
+	err := q.QueryRow(`SELECT single_max, daily_max, monthly_max, currency FROM account_limits WHERE account_number = $1`, accountNumber).
+		Scan(&single, &daily, &monthly, &currency)
+	if err == sql.ErrNoRows {
+		return s.limits, false, nil
+	}
+	if err != nil {
+		return AccountLimits{}, false, err
+	}
+	return AccountLimits{
+		SingleMax:  NewMoney(single, currency),
+		DailyMax:   NewMoney(daily, currency),
+		MonthlyMax: NewMoney(monthly, currency),
+	}, true, nil
+}
+
+func (s *PostGresStore) SetAccountLimits(accountNumber int, l AccountLimits) error {
+	_, err := s.db.Exec(`INSERT INTO account_limits (account_number, single_max, daily_max, monthly_max, currency, updated_at)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (account_number) DO UPDATE SET
+		single_max = $2, daily_max = $3, monthly_max = $4, currency = $5, updated_at = $6`,
+		accountNumber, l.SingleMax.Amount, l.DailyMax.Amount, l.MonthlyMax.Amount, l.currency(), time.Now().UTC())
+	return err
+}
+
+func (s *PostGresStore) ClearAccountLimits(accountNumber int) error {
+	_, err := s.db.Exec(`DELETE FROM account_limits WHERE account_number = $1`, accountNumber)
+	return err
+}
+
+func (s *PostGresStore) GetDebitTotals(accountNumber int, currency string) (DebitTotals, error) {
+	return debitTotals(s.db, accountNumber, currency)
+}
+
+// debitTotals sums the withdrawals and transfers sent from the account in
+// currency over the rolling windows.
+func debitTotals(q queryer, accountNumber int, currency string) (DebitTotals, error) {
+	t := DebitTotals{Daily: NewMoney(0, currency), Monthly: NewMoney(0, currency)}
+	err := q.QueryRow(`SELECT
+		COALESCE(SUM(amount) FILTER (WHERE transactiontime > LOCALTIMESTAMP - make_interval(secs => $3)), 0),
+		COALESCE(SUM(amount), 0)
+	FROM transactions
+	WHERE from_account = $1 AND currency = $2 AND transactionType IN ('withdraw', 'transfer')
+		AND transactiontime > LOCALTIMESTAMP - make_interval(secs => $4)`,
+		accountNumber, currency, dailyLimitWindow.Seconds(), monthlyLimitWindow.Seconds()).
+		Scan(&t.Daily.Amount, &t.Monthly.Amount)
+	return t, err
+}
+
+func (s *PostGresStore) checkLimits(q queryer, accountNumber int, amount Money) error {
+	limits, _, err := s.accountLimits(q, accountNumber)
+	if err != nil {
+		return err
+	}
+	// rates are read in the caller's transaction, and only when needed
+	var rates []*FXRate
+	if limits.currency() != amount.Currency {
+		if rates, err = fxRates(q); err != nil {
+			return err
+		}
+	}
+	if limits, err = limits.in(amount.Currency, rates); err != nil {
+		return err
+	}
+	totals, err := debitTotals(q, accountNumber, amount.Currency)
+	if err != nil {
+		return err
+	}
+	return limits.check(accountNumber, amount, totals)
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// GetFXRates returns the rate table ordered by pair.
+func (s *PostGresStore) GetFXRates() ([]*FXRate, error) {
+	return fxRates(s.db)
+}
+
+func fxRates(q queryer) ([]*FXRate, error) {
+	rows, err := q.Query(`SELECT base, quote, rate::text, updated_at FROM fx_rates ORDER BY base, quote`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rates := []*FXRate{}
+	for rows.Next() {
+		r := new(FXRate)
+		if err := rows.Scan(&r.Base, &r.Quote, &r.Rate, &r.UpdatedAt); err != nil {
+			return nil, err
+		}
+		rates = append(rates, r)
+	}
+	return rates, rows.Err()
+}
+
+// SetFXRates adds or replaces rates. A pair replaces its inverse, so the
+// table never holds two rates for the same currencies.
+func (s *PostGresStore) SetFXRates(rates []*FXRate) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, r := range rates {
+		if _, err := tx.Exec(`DELETE FROM fx_rates WHERE base = $1 AND quote = $2`, r.Quote, r.Base); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO fx_rates (base, quote, rate, updated_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (base, quote) DO UPDATE SET rate = $3, updated_at = $4`, r.Base, r.Quote, r.Rate, r.UpdatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostGresStore) CreateFXQuote(q *FXQuote) error {
+	_, err := s.db.Exec(`INSERT INTO fx_quotes (id, account_number, amount, currency, converted_amount, converted_currency,
+		rate, spread, created_at, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		q.ID, q.AccountNumber, q.Amount.Amount, q.Amount.Currency, q.Converted.Amount, q.Converted.Currency,
+		q.Rate, q.Spread, q.CreatedAt, q.ExpiresAt)
+	return err
+}
+
+func (s *PostGresStore) GetFXQuote(id string) (*FXQuote, error) {
+	q := &FXQuote{ID: id}
+	var usedAt sql.NullTime
+	err := s.db.QueryRow(`SELECT account_number, amount, currency, converted_amount, converted_currency,
+		rate::text, spread::text, created_at, expires_at, used_at
+	FROM fx_quotes WHERE id = $1`, id).Scan(&q.AccountNumber, &q.Amount.Amount, &q.Amount.Currency,
+		&q.Converted.Amount, &q.Converted.Currency, &q.Rate, &q.Spread, &q.CreatedAt, &q.ExpiresAt, &usedAt)
+	if err == sql.ErrNoRows {
+		return nil, notFoundf("FX quote %s not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if usedAt.Valid {
+		q.UsedAt = &usedAt.Time
+	}
+	return q, nil
+}
+
+// consumeFXQuote marks the quote used, failing if it belongs to another
+// account, has expired or was used before.
+func consumeFXQuote(tx *sql.Tx, id string, accountNumber int) error {
+	res, err := tx.Exec(`UPDATE fx_quotes SET used_at = $3
+	WHERE id = $1 AND account_number = $2 AND used_at IS NULL AND expires_at > $3`, id, accountNumber, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return conflictf("FX quote %s has expired or was already used", id)
+	}
+	return nil
+}
+
+const standingOrderColumns = `id, from_account, to_account, amount, currency, schedule, day_of_month, start_at, end_at,
+	next_run_at, next_attempt_at, attempts, status, created_at`
+
+func scanStandingOrder(row rowScanner) (*StandingOrder, error) {
+	o := new(StandingOrder)
+	var endAt sql.NullTime
+	if err := row.Scan(&o.ID, &o.FromAccount, &o.ToAccount, &o.Amount.Amount, &o.Amount.Currency, &o.Schedule, &o.DayOfMonth,
+		&o.StartAt, &endAt, &o.NextRunAt, &o.NextAttemptAt, &o.Attempts, &o.Status, &o.CreatedAt); err != nil {
+		return nil, err
+	}
+	if endAt.Valid {
+		o.EndAt = &endAt.Time
+	}
+	return o, nil
+}
+
+func scanStandingOrders(rows *sql.Rows) ([]*StandingOrder, error) {
+	defer rows.Close()
+	orders := []*StandingOrder{}
+	for rows.Next() {
+		o, err := scanStandingOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
+
+func (s *PostGresStore) CreateStandingOrder(o *StandingOrder) error {
+	return s.db.QueryRow(`INSERT INTO standing_orders (from_account, to_account, amount, currency, schedule, day_of_month,
+		start_at, end_at, next_run_at, next_attempt_at, attempts, status, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) RETURNING id`,
+		o.FromAccount, o.ToAccount, o.Amount.Amount, o.Amount.Currency, o.Schedule, o.DayOfMonth,
+		o.StartAt, o.EndAt, o.NextRunAt, o.NextAttemptAt, o.Attempts, o.Status, o.CreatedAt).Scan(&o.ID)
+}
+
+func (s *PostGresStore) GetStandingOrder(id int) (*StandingOrder, error) {
+	o, err := scanStandingOrder(s.db.QueryRow(`SELECT `+standingOrderColumns+` FROM standing_orders WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, notFoundf("standing order %d not found", id)
+	}
+	return o, err
+}
+
+// GetStandingOrders lists the orders paying out of an account, newest
+// first.
+func (s *PostGresStore) GetStandingOrders(accountNumber int) ([]*StandingOrder, error) {
+	rows, err := s.db.Query(`SELECT `+standingOrderColumns+` FROM standing_orders WHERE from_account = $1 ORDER BY id DESC`, accountNumber)
+	if err != nil {
+		return nil, err
+	}
+	return scanStandingOrders(rows)
+}
+
+func (s *PostGresStore) CancelStandingOrder(id int) error {
+	res, err := s.db.Exec(`UPDATE standing_orders SET status = $2 WHERE id = $1 AND status = $3`, id, OrderCancelled, OrderActive)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return conflictf("standing order %d is no longer active", id)
+	}
+	return nil
+}
+
+// ClaimDueStandingOrders returns the active orders due at now and pushes
+// their next attempt out to leaseUntil, so a concurrent pass or another
+// instance does not run them as well. The orders come back as stored after
+// the claim, oldest occurrence first.
+func (s *PostGresStore) ClaimDueStandingOrders(now, leaseUntil time.Time) ([]*StandingOrder, error) {
+	rows, err := s.db.Query(`UPDATE standing_orders SET next_attempt_at = $3
+	WHERE id IN (
+		SELECT id FROM standing_orders WHERE status = $1 AND next_attempt_at <= $2
+		ORDER BY next_attempt_at, id FOR UPDATE SKIP LOCKED
+	)
+	RETURNING `+standingOrderColumns, OrderActive, now, leaseUntil)
+	if err != nil {
+		return nil, err
+	}
+	orders, err := scanStandingOrders(rows)
+	if err != nil {
+		return nil, err
+	}
+	// RETURNING comes back in no particular order
+	slices.SortFunc(orders, func(a, b *StandingOrder) int {
+		if c := a.NextRunAt.Compare(b.NextRunAt); c != 0 {
+			return c
+		}
+		return a.ID - b.ID
+	})
+	return orders, nil
+}
+
+// RecordStandingOrderRun stores run and the order's state after it. An
+// order cancelled while it was running stays cancelled.
+func (s *PostGresStore) RecordStandingOrderRun(o *StandingOrder, run *StandingOrderRun) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := recordStandingOrderRun(tx, o, run); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ExecuteStandingOrder makes the order's transfer and records run, with the
+// order's state after it, in one transaction, so a crash can never leave
+// money moved for a run that is not recorded. An occurrence that already
+// succeeded is refused with errAlreadyPaid rather than paid twice.
+func (s *PostGresStore) ExecuteStandingOrder(o *StandingOrder, run *StandingOrderRun) error {
+	entry, err := transactionEntry(o.FromAccount, o.ToAccount, "transfer", o.Amount)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	t := &Transaction{FromAccount: o.FromAccount, ToAccount: o.ToAccount, Type: "transfer", Amount: o.Amount}
+	if _, err := s.postTransactionTx(tx, t, entry); err != nil {
+		return err
+	}
+	if err := recordStandingOrderRun(tx, o, run); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func recordStandingOrderRun(tx *sql.Tx, o *StandingOrder, run *StandingOrderRun) error {
+	err := tx.QueryRow(`INSERT INTO standing_order_runs (order_id, due_at, attempt, status, error, executed_at)
+	VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		run.OrderID, run.DueAt, run.Attempt, run.Status, run.Error, run.ExecutedAt).Scan(&run.ID)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return fmt.Errorf("standing order %d due %s: %w", run.OrderID, run.DueAt.Format(time.RFC3339), errAlreadyPaid)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE standing_orders SET next_run_at = $2, next_attempt_at = $3, attempts = $4,
+		status = CASE WHEN status = $6 THEN status ELSE $5 END
+	WHERE id = $1`, o.ID, o.NextRunAt, o.NextAttemptAt, o.Attempts, o.Status, OrderCancelled)
+	return err
+}
+
+func (s *PostGresStore) GetStandingOrderRuns(orderID int) ([]*StandingOrderRun, error) {
+	rows, err := s.db.Query(`SELECT id, order_id, due_at, attempt, status, error, executed_at
+	FROM standing_order_runs WHERE order_id = $1 ORDER BY id`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []*StandingOrderRun{}
+	for rows.Next() {
+		run := new(StandingOrderRun)
+		if err := rows.Scan(&run.ID, &run.OrderID, &run.DueAt, &run.Attempt, &run.Status, &run.Error, &run.ExecutedAt); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// GetBalanceAt returns what the account held at the given moment, by
+// taking the ledger postings since then off its current balance.
+func (s *PostGresStore) GetBalanceAt(accountNumber int, at time.Time) (Money, error) {
+	var balance Money
+	err := s.db.QueryRow(`SELECT a.balance - COALESCE((
+		SELECT SUM(CASE WHEN p.side = 'credit' THEN p.amount ELSE -p.amount END)
+		FROM ledger_postings p JOIN journal_entries e ON e.id = p.entry_id
+		WHERE p.ledger_account = $2 AND p.currency = a.currency AND e.created_at >= $3
+	), 0), a.currency
+	FROM accounts a WHERE a.accountnumber = $1`, accountNumber, customerLedgerAccount(accountNumber), at).
+		Scan(&balance.Amount, &balance.Currency)
+	if err == sql.ErrNoRows {
+		return Money{}, notFoundf("Account with number %d not found", accountNumber)
+	}
+	return balance, err
+}
+
+func (s *PostGresStore) GetInterestState(accountNumber int) (*InterestState, error) {
+	return interestState(s.db, accountNumber, false)
+}
+
+// interestState loads the account's accrual state, a zero one if it has
+// none yet. forUpdate locks the row for the rest of the transaction.
+func interestState(q queryer, accountNumber int, forUpdate bool) (*InterestState, error) {
+	state := &InterestState{AccountNumber: accountNumber, Accrued: "0"}
+	query := `SELECT accrued::text, accrued_through, paid_through FROM interest_state WHERE account_number = $1`
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	var accruedThrough, paidThrough sql.NullTime
+	err := q.QueryRow(query, accountNumber).Scan(&state.Accrued, &accruedThrough, &paidThrough)
+	if err == sql.ErrNoRows {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state.AccruedThrough, state.PaidThrough = accruedThrough.Time, paidThrough.Time
+	return state, nil
+}
+
+// RecordInterestAccrual stores a day's accrual and adds it to the
+// account's accrued interest. A day can only be accrued once.
+func (s *PostGresStore) RecordInterestAccrual(a *InterestAccrual) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO interest_accruals (account_number, day, balance, rate, amount)
+	VALUES ($1, $2, $3, $4, $5) ON CONFLICT (account_number, day) DO NOTHING`,
+		a.AccountNumber, a.Day, a.Balance.Amount, a.Rate, a.Amount)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return conflictf("interest for account %d on %s was already accrued", a.AccountNumber, a.Day.Format(time.DateOnly))
+	}
+	_, err = tx.Exec(`INSERT INTO interest_state (account_number, accrued, accrued_through) VALUES ($1, $2, $3)
+	ON CONFLICT (account_number) DO UPDATE SET accrued = interest_state.accrued + $2, accrued_through = $3`,
+		a.AccountNumber, a.Amount, a.Day)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PostInterest pays the whole minor units of the account's accrued
+// interest as an interest transaction, keeping the fraction for next time,
+// and returns what was paid.
+func (s *PostGresStore) PostInterest(accountNumber int, through time.Time) (Money, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Money{}, err
+	}
+	defer tx.Rollback()
+
+	state, err := interestState(tx, accountNumber, true)
+	if err != nil {
+		return Money{}, err
+	}
+	acc, err := s.getAccountSummary(tx, accountNumber)
+	if err != nil {
+		return Money{}, err
+	}
+	paid, rest := interestPayout(state, acc.Balance.Currency)
+
+	if paid.IsPositive() {
+		t := &Transaction{ToAccount: accountNumber, Type: "interest", Amount: paid}
+		entry, err := transactionEntry(0, accountNumber, t.Type, paid)
+		if err != nil {
+			return Money{}, err
+		}
+		changes, err := lockForEntry(tx, entry)
+		if err != nil {
+			return Money{}, err
+		}
+		if err := insertTransaction(tx, t, entry, changes); err != nil {
+			return Money{}, err
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO interest_state (account_number, accrued, paid_through) VALUES ($1, $2, $3)
+	ON CONFLICT (account_number) DO UPDATE SET accrued = $2, paid_through = $3`, accountNumber, rest, through)
+	if err != nil {
+		return Money{}, err
+	}
+	return paid, tx.Commit()
+}
+
+// getAccountSummary loads an account without its password hash.
+func (s *PostGresStore) getAccountSummary(q queryer, accountNumber int) (*Account, error) {
+	account, err := scanAccounts(q.QueryRow("SELECT "+accountColumns+" FROM accounts WHERE accountnumber = $1", accountNumber))
+	if err != nil {
+		return nil, err
+	}
+	account.Password = ""
+	return account, nil
+}
 
-	return updatedAccount, nil
+// rowScanner is satisfied by both *sql.Rows and *sql.Row.
+type rowScanner interface {
+	Scan(dest ...any) error
 }
 
-func scanAccounts(rows *sql.Rows) (*Account, error) {
+func scanAccounts(rows rowScanner) (*Account, error) {
 	account := new(Account)
+	var passwordChangedAt, closedAt sql.NullTime
 	if err := rows.Scan(
 		&account.ID,
 		&account.FirstName,
 		&account.LastName,
 		&account.AccountNumber,
-		&account.Balance,
+		&account.IBAN,
+		&account.Balance.Amount,
+		&account.Balance.Currency,
 		&account.CreatedAt,
 		&account.Password,
+		&account.Role,
+		&account.Status,
+		&account.Version,
+		&passwordChangedAt,
+		&closedAt,
+		&account.OverdraftLimit.Amount,
+		&account.OverdraftFee.Amount,
+		&account.Product,
 	); err != nil {
 		return account, err
 	}
+	account.OverdraftLimit.Currency = account.Balance.Currency
+	account.OverdraftFee.Currency = account.Balance.Currency
+	account.PasswordChangedAt = passwordChangedAt.Time
+	account.ClosedAt = closedAt.Time
 	return account, nil
 }
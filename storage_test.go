@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testStores returns every Storage implementation available in this
+// environment. Postgres is only included when GOBANK_TEST_POSTGRES is set,
+// since it needs a running database.
+func testStores(t *testing.T) map[string]Storage {
+	stores := map[string]Storage{"memory": NewMemoryStore()}
+	if os.Getenv("GOBANK_TEST_POSTGRES") != "" {
+		cfg := defaultConfig()
+		if err := cfg.applyEnv(); err != nil {
+			t.Fatal(err)
+		}
+		pg, err := NewPostGresStore(cfg.Database)
+		if err != nil {
+			t.Fatalf("connecting to postgres: %v", err)
+		}
+		if err := pg.init(); err != nil {
+			t.Fatalf("initializing postgres: %v", err)
+		}
+		stores["postgres"] = pg
+	}
+	return stores
+}
+
+// TestConcurrentWithdrawalsNeverOverdraw hammers a single account with
+// withdrawals and transfers in both directions. Only as many operations as
+// the balance covers may succeed and no balance may ever go negative.
+func TestConcurrentWithdrawalsNeverOverdraw(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			a := newTestAccount(t, store, 1_000_000+rand.Intn(1_000_000))
+			b := newTestAccount(t, store, 2_000_000+rand.Intn(1_000_000))
+			_, err := store.CreateTransaction(0, a.AccountNumber, "deposit", usd(1000))
+			assert.Nil(t, err)
+			_, err = store.CreateTransaction(0, b.AccountNumber, "deposit", usd(1000))
+			assert.Nil(t, err)
+
+			var wg sync.WaitGroup
+			var succeeded, rejected atomic.Int64
+			run := func(from, to int, kind string) {
+				defer wg.Done()
+				acc, err := store.CreateTransaction(from, to, kind, usd(100))
+				var insufficient *InsufficientFundsError
+				switch {
+				case err == nil:
+					succeeded.Add(1)
+					assert.False(t, acc.Balance.IsNegative())
+				case errors.As(err, &insufficient):
+					rejected.Add(1)
+				default:
+					t.Error(err)
+				}
+			}
+			for i := 0; i < 50; i++ {
+				wg.Add(3)
+				go run(a.AccountNumber, 0, "withdraw")
+				go run(a.AccountNumber, b.AccountNumber, "transfer")
+				go run(b.AccountNumber, a.AccountNumber, "transfer")
+			}
+			wg.Wait()
+
+			a, _ = store.GetAccountByNumber(a.AccountNumber)
+			b, _ = store.GetAccountByNumber(b.AccountNumber)
+			assert.False(t, a.Balance.IsNegative())
+			assert.False(t, b.Balance.IsNegative())
+			assert.Equal(t, int64(150), succeeded.Load()+rejected.Load())
+
+			// transfers only move money around, withdrawals take it out
+			total, _ := a.Balance.Add(b.Balance)
+			withdrawn := int64(0)
+			txs, _ := store.GetTransactions(a.AccountNumber, TransactionFilter{Types: []string{"withdraw"}})
+			for _, tx := range txs {
+				withdrawn += tx.Amount.Amount
+			}
+			assert.Equal(t, int64(2000)-withdrawn, total.Amount)
+		})
+	}
+}
+
+// TestTransactionChecksOrder makes sure both stores report the same error
+// when a transaction breaks more than one rule: the account's status and
+// funds are checked before its limits.
+func TestTransactionChecksOrder(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			acc := newTestAccount(t, store, 3_000_000+rand.Intn(1_000_000))
+			_, err := store.CreateTransaction(0, acc.AccountNumber, "deposit", usd(1000))
+			assert.Nil(t, err)
+			assert.Nil(t, store.SetAccountLimits(acc.AccountNumber, AccountLimits{SingleMax: usd(500)}))
+
+			var insufficient *InsufficientFundsError
+			_, err = store.CreateTransaction(acc.AccountNumber, 0, "withdraw", usd(2000))
+			assert.True(t, errors.As(err, &insufficient), "got %v", err)
+
+			var overLimit *LimitExceededError
+			_, err = store.CreateTransaction(acc.AccountNumber, 0, "withdraw", usd(600))
+			assert.True(t, errors.As(err, &overLimit), "got %v", err)
+
+			assert.Nil(t, store.SetAccountStatus(acc.ID, StatusFrozen))
+			_, err = store.CreateTransaction(acc.AccountNumber, 0, "withdraw", usd(2000))
+			assert.True(t, errors.Is(err, ErrForbidden), "got %v", err)
+		})
+	}
+}
+
+// TestTransactionAndFeesPostedTogether makes sure a fee that cannot be
+// charged stops the transaction it belongs to in both stores.
+func TestTransactionAndFeesPostedTogether(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			store.SetFeeSchedule(FeeSchedule{{Name: "deposit", TransactionType: "deposit", Flat: usd(100)}})
+			defer store.SetFeeSchedule(nil)
+			acc := newTestAccount(t, store, 4_000_000+rand.Intn(1_000_000))
+			_, err := store.CreateTransaction(0, acc.AccountNumber, "deposit", usd(1000))
+			assert.Nil(t, err)
+
+			// a frozen account can still be paid into, but cannot pay the fee
+			assert.Nil(t, store.SetAccountStatus(acc.ID, StatusFrozen))
+			_, err = store.CreateTransaction(0, acc.AccountNumber, "deposit", usd(1000))
+			assert.True(t, errors.Is(err, ErrForbidden), "got %v", err)
+
+			updated, err := store.GetAccountByNumber(acc.AccountNumber)
+			assert.Nil(t, err)
+			assert.Equal(t, usd(900), updated.Balance)
+			txs, err := store.GetTransactions(acc.AccountNumber, TransactionFilter{})
+			assert.Nil(t, err)
+			assert.Len(t, txs, 2)
+			mismatches, err := store.ReconcileBalances()
+			assert.Nil(t, err)
+			assert.Empty(t, mismatches)
+		})
+	}
+}
+
+// TestClaimDueStandingOrders makes sure both stores hand out due orders the
+// same way: oldest occurrence first, with the lease already applied.
+func TestClaimDueStandingOrders(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			from := newTestAccount(t, store, 5_000_000+rand.Intn(1_000_000))
+			to := newTestAccount(t, store, 6_000_000+rand.Intn(1_000_000))
+
+			base := time.Date(2001, time.March, 1, 8, 0, 0, 0, time.UTC)
+			// the older occurrence is waiting for a retry, so it is attempted
+			// after the newer one is due
+			retried := &StandingOrder{FromAccount: from.AccountNumber, ToAccount: to.AccountNumber, Amount: usd(100), Schedule: ScheduleDaily,
+				StartAt: base, NextRunAt: base, NextAttemptAt: base.Add(2 * time.Hour), Attempts: 1, Status: OrderActive, CreatedAt: base}
+			fresh := &StandingOrder{FromAccount: from.AccountNumber, ToAccount: to.AccountNumber, Amount: usd(100), Schedule: ScheduleDaily,
+				StartAt: base, NextRunAt: base.Add(time.Hour), NextAttemptAt: base.Add(time.Hour), Status: OrderActive, CreatedAt: base}
+			assert.Nil(t, store.CreateStandingOrder(retried))
+			assert.Nil(t, store.CreateStandingOrder(fresh))
+
+			now := base.Add(3 * time.Hour)
+			lease := now.Add(schedulerLease)
+			claimed, err := store.ClaimDueStandingOrders(now, lease)
+			assert.Nil(t, err)
+			var ours []*StandingOrder
+			for _, o := range claimed {
+				if o.ID == retried.ID || o.ID == fresh.ID {
+					ours = append(ours, o)
+				}
+			}
+			if assert.Len(t, ours, 2) {
+				assert.Equal(t, retried.ID, ours[0].ID)
+				assert.Equal(t, fresh.ID, ours[1].ID)
+				for _, o := range ours {
+					assert.True(t, o.NextAttemptAt.Equal(lease), "next attempt %s", o.NextAttemptAt)
+				}
+			}
+
+			// claimed orders stay hidden until the lease runs out
+			claimed, err = store.ClaimDueStandingOrders(now, lease)
+			assert.Nil(t, err)
+			for _, o := range claimed {
+				assert.NotContains(t, []int{retried.ID, fresh.ID}, o.ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters (RFC 6238). These are what authenticator apps assume when
+// the otpauth URI does not say otherwise.
+const (
+	totpPeriod        = 30 * time.Second
+	totpDigits        = 6
+	totpSkew          = 1 // steps accepted either side of the current one
+	recoveryCodeCount = 10
+	totpHeader        = "X-TOTP-Code"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TwoFactorConfig configures TOTP, which accounts enable if they choose to.
+// Transfers of StepUpAmount or more from an account with 2FA enabled need a
+// fresh code in the X-TOTP-Code header; a zero amount turns step-up off.
+// RequireEnrollment also refuses such transfers from accounts that never
+// enabled 2FA.
+type TwoFactorConfig struct {
+	Issuer            string `yaml:"issuer"`
+	StepUpAmount      Money  `yaml:"step_up_amount"`
+	RequireEnrollment bool   `yaml:"require_enrollment"`
+}
+
+// TOTPCredential is an account's TOTP secret. It is pending until the
+// first code is confirmed. LastStep is the last time step that was accepted,
+// so a code can never be used twice.
+type TOTPCredential struct {
+	AccountNumber int
+	Secret        string // base32
+	Enabled       bool
+	LastStep      int64
+	CreatedAt     time.Time
+}
+
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// hotp computes the RFC 4226 one-time password for counter.
+func hotp(key []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, code%mod)
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod/time.Second)
+}
+
+// verifyTOTP checks code against the steps around now and returns the step
+// it matched.
+func verifyTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// otpauthURI is what authenticator apps scan from the enrollment QR code.
+func otpauthURI(issuer string, accountNumber int, secret string) string {
+	label := url.PathEscape(fmt.Sprintf("%s:%d", issuer, accountNumber))
+	q := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(int(totpPeriod / time.Second))},
+	}
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// generateRecoveryCodes returns codes in the form xxxxx-xxxxx together with
+// the hashes that get stored.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 6)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		enc := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes[i] = enc[:5] + "-" + enc[5:]
+		hashes[i] = hashToken(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused
+// recovery code. Both are single use.
+func (s *APIServer) verifySecondFactor(accountNumber int, code string) (bool, error) {
+	cred, err := s.store.GetTOTPCredential(accountNumber)
+	if err != nil || cred == nil || !cred.Enabled {
+		return false, err
+	}
+
+	code = strings.TrimSpace(code)
+	if strings.Contains(code, "-") {
+		return s.store.ConsumeRecoveryCode(accountNumber, hashToken(strings.ToLower(code)))
+	}
+	step, ok := verifyTOTP(cred.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return s.store.ConsumeTOTPStep(accountNumber, step)
+}
+
+// twoFactorEnabled reports whether the account has confirmed TOTP.
+func (s *APIServer) twoFactorEnabled(accountNumber int) (bool, error) {
+	cred, err := s.store.GetTOTPCredential(accountNumber)
+	if err != nil {
+		return false, err
+	}
+	return cred != nil && cred.Enabled, nil
+}
+
+// requireStepUp makes transfers of the configured amount or more carry a
+// valid code in the X-TOTP-Code header. Amounts in other currencies are
+// compared with the threshold converted at the mid rate; without a rate
+// every transfer needs a code.
+func (s *APIServer) requireStepUp(w http.ResponseWriter, r *http.Request, accountNumber int, amount Money) error {
+	threshold := s.config.TwoFactor.StepUpAmount
+	if threshold.IsZero() {
+		return nil
+	}
+	enabled, err := s.twoFactorEnabled(accountNumber)
+	if err != nil {
+		return err
+	}
+	if !enabled && !s.config.TwoFactor.RequireEnrollment {
+		return nil
+	}
+	rates, err := s.store.GetFXRates()
+	if err != nil {
+		return err
+	}
+	if converted, err := convertMid(rates, threshold, amount.Currency); err == nil {
+		if amount.Amount < converted.Amount {
+			return nil
+		}
+		threshold = converted
+	}
+
+	if !enabled {
+		return newAPIError(http.StatusForbidden, CodeMFARequired, "transfers of %s or more require two-factor authentication to be enabled", threshold)
+	}
+	code := r.Header.Get(totpHeader)
+	if code == "" {
+		return newAPIError(http.StatusForbidden, CodeMFARequired, "transfers of %s or more require a two-factor code in the %s header", threshold, totpHeader)
+	}
+	return s.checkSecondFactor(w, r, accountNumber, code)
+}
+
+// checkSecondFactor verifies a code sent by an already authenticated
+// client. Wrong codes count as failed logins, so a stolen access token
+// cannot be used to guess the code, and no code is tried while the account
+// or the client IP is locked out.
+func (s *APIServer) checkSecondFactor(w http.ResponseWriter, r *http.Request, accountNumber int, code string) error {
+	ip := clientIP(r)
+	if err := s.checkLoginThrottle(w, accountNumber, ip); err != nil {
+		return err
+	}
+	ok, err := s.verifySecondFactor(accountNumber, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := s.registerLoginFailure(accountNumber, ip); err != nil {
+			return err
+		}
+		return forbidden("invalid two-factor code")
+	}
+	return nil
+}
+
+// handleEnrollTOTP starts enrollment by generating a new secret. It stays
+// pending until a code is confirmed.
+func (s *APIServer) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.ownAccount(r)
+	if err != nil {
+		return err
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return err
+	}
+	err = s.store.SaveTOTPCredential(&TOTPCredential{
+		AccountNumber: account.AccountNumber,
+		Secret:        secret,
+		CreatedAt:     time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeJson(w, http.StatusOK, TOTPEnrollResponse{
+		Secret: secret,
+		URI:    otpauthURI(s.config.TwoFactor.Issuer, account.AccountNumber, secret),
+	})
+}
+
+// handleConfirmTOTP enables 2FA once the client proves it can generate
+// codes, and hands out the recovery codes. They are never shown again.
+func (s *APIServer) handleConfirmTOTP(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.ownAccount(r)
+	if err != nil {
+		return err
+	}
+	req := new(TOTPCodeRequest)
+	if err := decodeJSON(r, req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	cred, err := s.store.GetTOTPCredential(account.AccountNumber)
+	if err != nil {
+		return err
+	}
+	if cred == nil {
+		return conflict("two-factor enrollment has not been started")
+	}
+	if cred.Enabled {
+		return conflict("two-factor authentication is already enabled")
+	}
+	step, ok := verifyTOTP(cred.Secret, strings.TrimSpace(req.Code), time.Now())
+	if !ok {
+		return fieldError("code", "is not a valid code")
+	}
+	if _, err := s.store.ConsumeTOTPStep(account.AccountNumber, step); err != nil {
+		return err
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	if err := s.store.EnableTOTP(account.AccountNumber, hashes); err != nil {
+		return err
+	}
+	fmt.Printf("Two-factor authentication enabled for account %d\n", account.AccountNumber)
+
+	return writeJson(w, http.StatusOK, TOTPConfirmResponse{RecoveryCodes: codes})
+}
+
+// handleDisableTOTP turns 2FA off; it needs a valid code or recovery code.
+func (s *APIServer) handleDisableTOTP(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.ownAccount(r)
+	if err != nil {
+		return err
+	}
+	req := new(TOTPCodeRequest)
+	if err := decodeJSON(r, req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if err := s.checkSecondFactor(w, r, account.AccountNumber, req.Code); err != nil {
+		return err
+	}
+	if err := s.store.DeleteTOTPCredential(account.AccountNumber); err != nil {
+		return err
+	}
+	fmt.Printf("Two-factor authentication disabled for account %d\n", account.AccountNumber)
+
+	return writeJson(w, http.StatusOK, map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+// ownAccount returns the authenticated account if it is the one named in
+// the path.
+func (s *APIServer) ownAccount(r *http.Request) (*Account, error) {
+	id, err := accountID(r)
+	if err != nil {
+		return nil, err
+	}
+	account := r.Context().Value("account").(*Account)
+	if account.ID != id {
+		return nil, forbidden("You can only manage your own account")
+	}
+	return account, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestHOTPMatchesRFC6238Vectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+	assert.Equal(t, "287082", hotp(key, totpStep(time.Unix(59, 0))))
+	assert.Equal(t, "081804", hotp(key, totpStep(time.Unix(1111111109, 0))))
+	assert.Equal(t, "005924", hotp(key, totpStep(time.Unix(1234567890, 0))))
+}
+
+func TestVerifyTOTPAllowsOneStepOfDrift(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111109, 0)
+
+	step, ok := verifyTOTP(secret, "081804", now)
+	assert.True(t, ok)
+	assert.Equal(t, totpStep(now), step)
+	_, ok = verifyTOTP(secret, "081804", now.Add(totpPeriod))
+	assert.True(t, ok)
+	_, ok = verifyTOTP(secret, "081804", now.Add(3*totpPeriod))
+	assert.False(t, ok)
+	_, ok = verifyTOTP(secret, "81804", now)
+	assert.False(t, ok)
+}
+
+func TestStepUpAmountFromYAML(t *testing.T) {
+	var cfg TwoFactorConfig
+	assert.Nil(t, yaml.Unmarshal([]byte(`step_up_amount: "250.50"`), &cfg))
+	assert.Equal(t, usd(25050), cfg.StepUpAmount)
+
+	assert.Nil(t, yaml.Unmarshal([]byte("step_up_amount: {amount: \"10\", currency: eur}"), &cfg))
+	assert.Equal(t, NewMoney(1000, "EUR"), cfg.StepUpAmount)
+}
+
+// totpCodeAt returns the code for secret offset steps from now.
+func totpCodeAt(t *testing.T, secret string, offset int64) string {
+	t.Helper()
+	key, err := totpEncoding.DecodeString(secret)
+	assert.Nil(t, err)
+	return hotp(key, totpStep(time.Now())+offset)
+}
+
+// enrollTOTP enables 2FA on the account and returns its secret and
+// recovery codes. The current step is used up by the confirmation.
+func enrollTOTP(t *testing.T, server *APIServer, id int, token string) (string, []string) {
+	t.Helper()
+	path := "/account/" + strconv.Itoa(id) + "/2fa"
+
+	w := doRequest(server, "POST", path+"/enroll", token, nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var enroll TOTPEnrollResponse
+	assert.Nil(t, jsonDecode(w, &enroll))
+	assert.Contains(t, enroll.URI, "otpauth://totp/goBank:")
+	assert.Contains(t, enroll.URI, "secret="+enroll.Secret)
+
+	w = doRequest(server, "POST", path+"/confirm", token, TOTPCodeRequest{Code: "000000x"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(server, "POST", path+"/confirm", token, TOTPCodeRequest{Code: totpCodeAt(t, enroll.Secret, 0)})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var confirm TOTPConfirmResponse
+	assert.Nil(t, jsonDecode(w, &confirm))
+	assert.Len(t, confirm.RecoveryCodes, recoveryCodeCount)
+	return enroll.Secret, confirm.RecoveryCodes
+}
+
+func TestLoginWithTwoFactor(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	server.config.Login.BaseDelay = 0 // wrong codes count as failed logins
+	acc := newTestAccount(t, store, 1008)
+	token := login(t, server, 1008, "password").Token
+
+	secret, recovery := enrollTOTP(t, server, acc.ID, token)
+	assert.Equal(t, http.StatusConflict, doRequest(server, "POST", "/account/"+strconv.Itoa(acc.ID)+"/2fa/enroll", token, nil).Code)
+
+	w := doRequest(server, "POST", "/login", "", LoginRequest{AccountNumber: 1008, Password: "password"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	var apiErr APIError
+	assert.Nil(t, jsonDecode(w, &apiErr))
+	assert.Equal(t, CodeMFARequired, apiErr.Code)
+
+	w = doRequest(server, "POST", "/login", "", LoginRequest{AccountNumber: 1008, Password: "password", Code: "123456"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	code := totpCodeAt(t, secret, 1)
+	w = doRequest(server, "POST", "/login", "", LoginRequest{AccountNumber: 1008, Password: "password", Code: code})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	// the same code cannot be replayed
+	w = doRequest(server, "POST", "/login", "", LoginRequest{AccountNumber: 1008, Password: "password", Code: code})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// recovery codes work once each
+	w = doRequest(server, "POST", "/login", "", LoginRequest{AccountNumber: 1008, Password: "password", Code: recovery[0]})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = doRequest(server, "POST", "/login", "", LoginRequest{AccountNumber: 1008, Password: "password", Code: recovery[0]})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = doRequest(server, "DELETE", "/account/"+strconv.Itoa(acc.ID)+"/2fa", token, TOTPCodeRequest{Code: recovery[1]})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	login(t, server, 1008, "password")
+}
+
+func TestLargeTransferNeedsStepUp(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	server.config.TwoFactor.StepUpAmount = usd(10000)
+	acc := newTestAccount(t, store, 1008)
+	newTestAccount(t, store, 1016)
+	_, err := store.CreateTransaction(0, 1008, "deposit", usd(50000))
+	assert.Nil(t, err)
+	token := login(t, server, 1008, "password").Token
+
+	small := TransferRequest{FromAccountNumber: 1008, ToAccountNumber: 1016, Amount: usd(9999)}
+	large := TransferRequest{FromAccountNumber: 1008, ToAccountNumber: 1016, Amount: usd(10000)}
+
+	// 2FA is optional, so accounts without it are not held up unless
+	// enrollment is required
+	assert.Equal(t, http.StatusOK, doRequest(server, "POST", "/transfer", token, small).Code)
+	assert.Equal(t, http.StatusOK, doRequest(server, "POST", "/transfer", token, large).Code)
+	server.config.TwoFactor.RequireEnrollment = true
+	w := doRequest(server, "POST", "/transfer", token, large)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	var apiErr APIError
+	assert.Nil(t, jsonDecode(w, &apiErr))
+	assert.Equal(t, CodeMFARequired, apiErr.Code)
+
+	_, recovery := enrollTOTP(t, server, acc.ID, token)
+	assert.Equal(t, http.StatusForbidden, doRequest(server, "POST", "/transfer", token, large).Code)
+
+	send := func(code string) int {
+		buf := new(bytes.Buffer)
+		json.NewEncoder(buf).Encode(large)
+		r := httptest.NewRequest("POST", "/transfer", buf)
+		r.Header.Set("Authorization", "Bearer "+token)
+		r.Header.Set(totpHeader, code)
+		w := httptest.NewRecorder()
+		server.routes().ServeHTTP(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusForbidden, send("123456"))
+	assert.Equal(t, http.StatusOK, send(recovery[0]))
+	assert.Equal(t, http.StatusForbidden, send(recovery[0]))
+
+	sender, err := store.GetAccountByNumber(1008)
+	assert.Nil(t, err)
+	assert.Equal(t, usd(50000-9999-10000-10000), sender.Balance)
+}
+
+func TestWrongStepUpCodesLockOut(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	server.config.TwoFactor.StepUpAmount = usd(10000)
+	server.config.Login.MaxAttempts = 3
+	server.config.Login.BaseDelay = 0
+	acc := newTestAccount(t, store, 1008)
+	newTestAccount(t, store, 1016)
+	_, err := store.CreateTransaction(0, 1008, "deposit", usd(50000))
+	assert.Nil(t, err)
+	token := login(t, server, 1008, "password").Token
+	_, recovery := enrollTOTP(t, server, acc.ID, token)
+
+	send := func(code string) int {
+		buf := new(bytes.Buffer)
+		json.NewEncoder(buf).Encode(TransferRequest{FromAccountNumber: 1008, ToAccountNumber: 1016, Amount: usd(10000)})
+		r := httptest.NewRequest("POST", "/transfer", buf)
+		r.Header.Set("Authorization", "Bearer "+token)
+		r.Header.Set(totpHeader, code)
+		w := httptest.NewRecorder()
+		server.routes().ServeHTTP(w, r)
+		return w.Code
+	}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusForbidden, send("123456"))
+	}
+	// locked out now, even the right code is not tried
+	assert.Equal(t, http.StatusTooManyRequests, send(recovery[0]))
+	w := doRequest(server, "DELETE", "/account/"+strconv.Itoa(acc.ID)+"/2fa", token, TOTPCodeRequest{Code: recovery[0]})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	sender, err := store.GetAccountByNumber(1008)
+	assert.Nil(t, err)
+	assert.Equal(t, usd(50000), sender.Balance)
+}
+
+func TestStepUpAppliesInOtherCurrencies(t *testing.T) {
+	store := NewMemoryStore()
+	server := newTestServer(store)
+	server.config.TwoFactor.StepUpAmount = usd(10000)
+	server.config.TwoFactor.RequireEnrollment = true
+	for _, number := range []int{1008, 1016} {
+		acc := newTestAccount(t, store, number)
+		store.accounts[acc.ID].Balance = NewMoney(0, "EUR")
+	}
+	_, err := store.CreateTransaction(0, 1008, "deposit", NewMoney(50000, "EUR"))
+	assert.Nil(t, err)
+	token := login(t, server, 1008, "password").Token
+	transfer := func(amount int64) int {
+		req := TransferRequest{FromAccountNumber: 1008, ToAccountNumber: 1016, Amount: NewMoney(amount, "EUR")}
+		return doRequest(server, "POST", "/transfer", token, req).Code
+	}
+
+	// no rate to compare against, so every transfer needs a code
+	assert.Equal(t, http.StatusForbidden, transfer(100))
+
+	assert.Nil(t, store.SetFXRates([]*FXRate{{Base: "EUR", Quote: "USD", Rate: "1.25"}}))
+	assert.Equal(t, http.StatusOK, transfer(7999))
+	assert.Equal(t, http.StatusForbidden, transfer(8000))
+}
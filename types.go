@@ -1,47 +1,449 @@
 package main
 
 import (
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+// LoginRequest carries Code only for accounts with two-factor
+// authentication: a TOTP code or one of the recovery codes.
 type LoginRequest struct {
 	AccountNumber int    `json:"accountnumber"`
 	Password      string `json:"password"`
+	Code          string `json:"code,omitempty"`
 }
 
 type DepositRequest struct {
-	AccountNumber int     `json:"accountnumber"`
-	Amount        float64 `json:"amount"`
+	AccountNumber int   `json:"accountnumber"`
+	Amount        Money `json:"amount"`
 }
 
 type WithdrawRequest struct {
-	AccountNumber int     `json:"accountnumber"`
-	Amount        float64 `json:"amount"`
+	AccountNumber int   `json:"accountnumber"`
+	Amount        Money `json:"amount"`
 }
 
+// CreateAccountRequest has no account number: the server allocates one.
 type CreateAccountRequest struct {
-	AccountNumber int    `json:"accountnumber"`
-	FirstName     string `json:"firstname"`
-	LastName      string `json:"lastname"`
-	Password      string `json:"password"`
+	FirstName string `json:"firstname"`
+	LastName  string `json:"lastname"`
+	Password  string `json:"password"`
+	// Currency is the ISO 4217 code the account is held in, DefaultCurrency
+	// if empty.
+	Currency string `json:"currency,omitempty"`
+	// Product is checking, the default, or savings.
+	Product string `json:"product,omitempty"`
+}
+
+// accounts.first_name and last_name are VARCHAR(50)
+const maxNameLength = 50
+
+// UpdateAccountRequest is a partial update: nil fields are left alone.
+// Version must be the version the client last read.
+type UpdateAccountRequest struct {
+	FirstName *string `json:"firstname"`
+	LastName  *string `json:"lastname"`
+	Version   int     `json:"version"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type SetStatusRequest struct {
+	Status string `json:"status"`
+}
+
+type SetRoleRequest struct {
+	Role Role `json:"role"`
 }
 
+// TransferRequest names the destination either by ToAccountNumber or by
+// ToIBAN, never both. Amount is in the source account's currency; a
+// destination held in another currency needs Convert to be set, or QuoteID
+// to exchange at a rate locked in with POST /fx/quote.
 type TransferRequest struct {
-	FromAccountNumber int     `json:"fromAccountNumber"`
-	ToAccountNumber   int     `json:"toAccountNumber"`
-	Amount            float64 `json:"amount"`
+	FromAccountNumber int    `json:"fromAccountNumber"`
+	ToAccountNumber   int    `json:"toAccountNumber,omitempty"`
+	ToIBAN            string `json:"toIban,omitempty"`
+	Amount            Money  `json:"amount"`
+	Convert           bool   `json:"convert,omitempty"`
+	QuoteID           string `json:"quoteId,omitempty"`
+}
+
+// The validate methods reject malformed requests before any storage lookup.
+
+func (r *CreateAccountRequest) validate() error {
+	r.Currency = strings.ToUpper(strings.TrimSpace(r.Currency))
+	if r.Currency == "" {
+		r.Currency = DefaultCurrency
+	}
+	if _, err := currencyExponent(r.Currency); err != nil {
+		return fieldError("currency", "must be a supported ISO 4217 currency code")
+	}
+	r.Product = strings.ToLower(strings.TrimSpace(r.Product))
+	if r.Product == "" {
+		r.Product = ProductChecking
+	}
+	if !validProduct(r.Product) {
+		return fieldError("product", "must be checking or savings")
+	}
+	return nil
+}
+
+func (r *LoginRequest) validate(legacy []int) error {
+	return checkAccountNumber("accountnumber", r.AccountNumber, legacy)
+}
+
+func (r *DepositRequest) validate(legacy []int) error {
+	if err := checkAccountNumber("accountnumber", r.AccountNumber, legacy); err != nil {
+		return err
+	}
+	return checkPositive("amount", r.Amount)
+}
+
+func (r *WithdrawRequest) validate(legacy []int) error {
+	if err := checkAccountNumber("accountnumber", r.AccountNumber, legacy); err != nil {
+		return err
+	}
+	return checkPositive("amount", r.Amount)
+}
+
+func (r *TransferRequest) validate(legacy []int) error {
+	if err := checkAccountNumber("fromAccountNumber", r.FromAccountNumber, legacy); err != nil {
+		return err
+	}
+	switch {
+	case r.ToIBAN != "" && r.ToAccountNumber != 0:
+		return fieldError("toIban", "cannot be combined with toAccountNumber")
+	case r.ToIBAN != "":
+		r.ToIBAN = normalizeIBAN(r.ToIBAN)
+		if err := validateIBAN(r.ToIBAN); err != nil {
+			return fieldError("toIban", "%v", err)
+		}
+	default:
+		if err := checkAccountNumber("toAccountNumber", r.ToAccountNumber, legacy); err != nil {
+			return err
+		}
+	}
+	return checkPositive("amount", r.Amount)
+}
+
+func (r *UpdateAccountRequest) validate() error {
+	var details []FieldError
+	for field, name := range map[string]*string{"firstname": r.FirstName, "lastname": r.LastName} {
+		if name == nil {
+			continue
+		}
+		*name = strings.TrimSpace(*name)
+		if *name == "" || len(*name) > maxNameLength {
+			details = append(details, FieldError{Field: field, Message: fmt.Sprintf("must be 1 to %d characters", maxNameLength)})
+		}
+	}
+	if r.Version <= 0 {
+		details = append(details, FieldError{Field: "version", Message: "is required"})
+	}
+	if len(details) > 0 {
+		slices.SortFunc(details, func(a, b FieldError) int { return strings.Compare(a.Field, b.Field) })
+		return validationError(details...)
+	}
+	return nil
+}
+
+// SetLimitsRequest replaces all three limits of an account. Zero means no
+// limit.
+type SetLimitsRequest struct {
+	SingleMax  *Money `json:"singleMax"`
+	DailyMax   *Money `json:"dailyMax"`
+	MonthlyMax *Money `json:"monthlyMax"`
+}
+
+func (r *SetLimitsRequest) validate() error {
+	var details []FieldError
+	var currency string
+	for _, f := range []struct {
+		name  string
+		value *Money
+	}{{"singleMax", r.SingleMax}, {"dailyMax", r.DailyMax}, {"monthlyMax", r.MonthlyMax}} {
+		switch {
+		case f.value == nil:
+			details = append(details, FieldError{Field: f.name, Message: "is required"})
+		case f.value.IsNegative():
+			details = append(details, FieldError{Field: f.name, Message: "must not be negative"})
+		case currency == "":
+			currency = f.value.Currency
+		case f.value.Currency != currency:
+			details = append(details, FieldError{Field: f.name, Message: fmt.Sprintf("must be in %s like the other limits", currency)})
+		}
+	}
+	if len(details) > 0 {
+		return validationError(details...)
+	}
+	return nil
+}
+
+// SetOverdraftRequest opts an account into an overdraft, or out of it with
+// a zero limit. Only admins may set Fee; otherwise the configured fee applies.
+type SetOverdraftRequest struct {
+	Limit *Money `json:"limit"`
+	Fee   *Money `json:"fee,omitempty"`
+}
+
+func (r *SetOverdraftRequest) validate() error {
+	var details []FieldError
+	if r.Limit == nil {
+		details = append(details, FieldError{Field: "limit", Message: "is required"})
+	} else if r.Limit.IsNegative() {
+		details = append(details, FieldError{Field: "limit", Message: "must not be negative"})
+	}
+	if r.Fee != nil && r.Fee.IsNegative() {
+		details = append(details, FieldError{Field: "fee", Message: "must not be negative"})
+	}
+	if len(details) > 0 {
+		return validationError(details...)
+	}
+	return nil
+}
+
+// FXQuoteRequest asks for a rate to convert Amount, in the caller's
+// currency, into To.
+type FXQuoteRequest struct {
+	Amount Money  `json:"amount"`
+	To     string `json:"to"`
 }
 
+func (r *FXQuoteRequest) validate() error {
+	r.To = strings.ToUpper(strings.TrimSpace(r.To))
+	if _, err := currencyExponent(r.To); err != nil {
+		return fieldError("to", "%v", err)
+	}
+	if r.To == r.Amount.Currency {
+		return fieldError("to", "must differ from the amount's currency")
+	}
+	return checkPositive("amount", r.Amount)
+}
+
+// SetFXRatesRequest adds or replaces rates, keyed by pair as in
+// {"EUR/USD": "1.08"}.
+type SetFXRatesRequest struct {
+	Rates map[string]string `json:"rates"`
+}
+
+// CreateStandingOrderRequest schedules transfers to ToAccountNumber, in
+// the currency of both accounts. Monthly orders run on DayOfMonth, which
+// defaults to the day of StartAt. EndAt is optional for recurring orders
+// and ignored for one-off ones.
+type CreateStandingOrderRequest struct {
+	ToAccountNumber int        `json:"toAccountNumber"`
+	Amount          Money      `json:"amount"`
+	Schedule        string     `json:"schedule"`
+	StartAt         time.Time  `json:"startAt"`
+	EndAt           *time.Time `json:"endAt,omitempty"`
+	DayOfMonth      int        `json:"dayOfMonth,omitempty"`
+}
+
+func (r *CreateStandingOrderRequest) validate(now time.Time, legacy []int) error {
+	var details []FieldError
+	if err := checkAccountNumber("toAccountNumber", r.ToAccountNumber, legacy); err != nil {
+		details = append(details, FieldError{Field: "toAccountNumber", Message: err.Error()})
+	}
+	if !r.Amount.IsPositive() {
+		details = append(details, FieldError{Field: "amount", Message: "must be positive"})
+	}
+	r.Schedule = strings.ToLower(strings.TrimSpace(r.Schedule))
+	if !validSchedule(r.Schedule) {
+		details = append(details, FieldError{Field: "schedule", Message: "must be one of once, daily, weekly or monthly"})
+	}
+	if r.StartAt.IsZero() || r.StartAt.Before(now) {
+		details = append(details, FieldError{Field: "startAt", Message: "must be in the future"})
+	}
+	if r.Schedule == ScheduleOnce {
+		r.EndAt = nil
+	} else if r.EndAt != nil && !r.EndAt.After(r.StartAt) {
+		details = append(details, FieldError{Field: "endAt", Message: "must be after startAt"})
+	}
+	if r.DayOfMonth != 0 && (r.Schedule != ScheduleMonthly || r.DayOfMonth < 1 || r.DayOfMonth > 31) {
+		details = append(details, FieldError{Field: "dayOfMonth", Message: "must be 1 to 31, for monthly orders only"})
+	}
+	if len(details) > 0 {
+		return validationError(details...)
+	}
+	return nil
+}
+
+// FeePreviewRequest describes a deposit, withdrawal or transfer of Amount
+// to or from AccountNumber that has not been made yet.
+type FeePreviewRequest struct {
+	Type          string `json:"type"`
+	AccountNumber int    `json:"accountNumber"`
+	Amount        Money  `json:"amount"`
+}
+
+func (r *FeePreviewRequest) validate(legacy []int) error {
+	var details []FieldError
+	r.Type = strings.ToLower(strings.TrimSpace(r.Type))
+	if r.Type != "deposit" && r.Type != "withdraw" && r.Type != "transfer" {
+		details = append(details, FieldError{Field: "type", Message: "must be one of deposit, withdraw or transfer"})
+	}
+	if err := checkAccountNumber("accountNumber", r.AccountNumber, legacy); err != nil {
+		details = append(details, FieldError{Field: "accountNumber", Message: err.Error()})
+	}
+	if !r.Amount.IsPositive() {
+		details = append(details, FieldError{Field: "amount", Message: "must be positive"})
+	}
+	if len(details) > 0 {
+		return validationError(details...)
+	}
+	return nil
+}
+
+func checkPositive(field string, m Money) error {
+	if !m.IsPositive() {
+		return fieldError(field, "must be positive")
+	}
+	return nil
+}
+
+// Account is the storage model. Handlers respond with AccountResponse and
+// must never encode an Account directly.
 type Account struct {
-	ID            int       `json:"id"`
-	FirstName     string    `json:"firstname"`
-	LastName      string    `json:"lastname"`
-	AccountNumber int       `json:"accountnumber"`
-	Balance       float64   `json:"balance"`
-	CreatedAt     time.Time `json:"createdAt"`
-	Password      string    `json:"password"`
+	ID            int
+	FirstName     string
+	LastName      string
+	AccountNumber int
+	IBAN          string
+	Balance       Money
+	Role          Role
+	Status        string
+	CreatedAt     time.Time
+	Password      string `json:"-"` // bcrypt hash
+	// Version is bumped by every UpdateAccount; an update carrying a stale
+	// version fails with ErrConflict.
+	Version int
+	// PasswordChangedAt is zero until the first password change. Tokens
+	// issued before it are rejected.
+	PasswordChangedAt time.Time
+	// ClosedAt is zero unless Status is closed.
+	ClosedAt time.Time
+	// OverdraftLimit is how far below zero the balance may go; zero means
+	// no overdraft. OverdraftFee is charged each time the balance crosses
+	// from zero or above into overdraft.
+	OverdraftLimit Money
+	OverdraftFee   Money
+	// Product is ProductChecking or ProductSavings.
+	Product string
+}
+
+type Transaction struct {
+	ID          int
+	FromAccount int
+	ToAccount   int
+	Type        string
+	Amount      Money
+	// Converted is what reached ToAccount when it is held in another
+	// currency than Amount; zero otherwise.
+	Converted Money
+	// FXRate and FXSpread are the rate applied to Amount and the spread
+	// taken off the mid rate for it; FXQuoteID is the quote that locked
+	// them in, if any. All empty unless Converted is set.
+	FXRate    string
+	FXSpread  string
+	FXQuoteID string
+	CreatedAt time.Time
+	// Direction is "in" or "out" relative to the account whose history was
+	// requested. It is only set on transactions returned by GetTransactions.
+	Direction string
+}
+
+// TransactionFilter narrows down an account's transaction history. Zero
+// values mean "no constraint". Results are ordered newest first and
+// BeforeID is the pagination cursor: only transactions with a smaller id
+// are returned.
+type TransactionFilter struct {
+	Types     []string
+	From      time.Time // inclusive
+	To        time.Time // exclusive
+	MinAmount *int64    // minor units, inclusive
+	MaxAmount *int64    // minor units, inclusive
+	BeforeID  int
+	Limit     int
+}
+
+// matches applies every constraint in f except Limit to tx.
+func (f TransactionFilter) matches(tx *Transaction) bool {
+	if len(f.Types) > 0 && !slices.Contains(f.Types, tx.Type) {
+		return false
+	}
+	if !f.From.IsZero() && tx.CreatedAt.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !tx.CreatedAt.Before(f.To) {
+		return false
+	}
+	if f.MinAmount != nil && tx.Amount.Amount < *f.MinAmount {
+		return false
+	}
+	if f.MaxAmount != nil && tx.Amount.Amount > *f.MaxAmount {
+		return false
+	}
+	if f.BeforeID > 0 && tx.ID >= f.BeforeID {
+		return false
+	}
+	return true
+}
+
+// directionFor reports whether tx moved money into or out of accountNumber.
+func (tx *Transaction) directionFor(accountNumber int) string {
+	if tx.ToAccount == accountNumber {
+		return "in"
+	}
+	return "out"
+}
+
+// IdempotencyRecord remembers the outcome of a money-moving request sent with
+// an Idempotency-Key header. StatusCode is zero while the original request is
+// still being processed. Once ExpiresAt has passed the key is forgotten and
+// may be used again.
+type IdempotencyRecord struct {
+	AccountNumber int
+	Key           string
+	Fingerprint   string
+	StatusCode    int
+	Response      []byte
+	CreatedAt     time.Time
+	ExpiresAt     time.Time
+}
+
+// RefreshToken is the server-side record of an opaque refresh token. Only
+// the SHA-256 hash of the token is stored. Every rotation issues a new token
+// in the same family; presenting an already used token revokes the family.
+type RefreshToken struct {
+	TokenHash     string
+	FamilyID      string
+	AccountNumber int
+	CreatedAt     time.Time
+	ExpiresAt     time.Time
+	UsedAt        *time.Time
+	RevokedAt     *time.Time
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type TokenResponse struct {
+	Token        string    `json:"token"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	RefreshToken string    `json:"refreshToken"`
 }
 
 func NewAccount(accountnumber int, firstName, LastName, password string) (*Account, error) {
@@ -53,8 +455,12 @@ func NewAccount(accountnumber int, firstName, LastName, password string) (*Accou
 		FirstName:     firstName,
 		LastName:      LastName,
 		AccountNumber: accountnumber,
-		Balance:       0.0,
+		Balance:       NewMoney(0, DefaultCurrency),
+		Role:          RoleCustomer,
+		Status:        StatusActive,
 		CreatedAt:     time.Now().UTC(),
 		Password:      string(encPw),
+		Version:       1,
+		Product:       ProductChecking,
 	}, nil
 }